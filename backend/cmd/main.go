@@ -7,6 +7,9 @@ import (
 	"backend/internal/service"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
 	"os"
@@ -27,23 +30,56 @@ func main() {
 	// Initialize services
 	studentService := service.NewStudentService(db)
 	uploadService := service.NewUploadService(db)
+	webhookService := service.NewWebhookService(db)
+	go webhookService.Watch(uploadService)
+
+	// Metrics that are read when scraped; counters are registered by the metrics package
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatal("Failed to get database instance:", err)
+	}
+	prometheus.MustRegister(collectors.NewDBStatsCollector(sqlDB, config.DBName))
+	prometheus.MustRegister(uploadService.MetricsCollectors()...)
 
 	// Initialize handlers
 	studentHandler := handler.NewStudentHandler(studentService)
 	uploadHandler := handler.NewUploadHandler(uploadService)
+	webhookHandler := handler.NewWebhookHandler(webhookService)
+
+	allowedOrigins := []string{"http://localhost:3000"}
 
 	// Setup router
 	r := mux.NewRouter()
 
 	r.HandleFunc("/upload", uploadHandler.UploadCSV).Methods("POST")
+	r.HandleFunc("/batches/{id}", uploadHandler.GetBatch).Methods("GET")
+	r.HandleFunc("/jobs/{id}/cancel", uploadHandler.CancelJob).Methods("POST")
+	r.HandleFunc("/jobs/{id}/rollback", uploadHandler.RollbackJob).Methods("POST")
 
 	r.HandleFunc("/students", studentHandler.ListStudents).Methods("GET")
+	r.HandleFunc("/students", studentHandler.CreateStudent).Methods("POST")
+	r.HandleFunc("/students/export", studentHandler.ExportStudents).Methods("GET")
+	r.HandleFunc("/students/{id}", studentHandler.GetStudent).Methods("GET")
+	r.HandleFunc("/students/{id}", studentHandler.ReplaceStudent).Methods("PUT")
+	r.HandleFunc("/students/{id}", studentHandler.PatchStudent).Methods("PATCH")
+	r.HandleFunc("/students/{id}", studentHandler.DeleteStudent).Methods("DELETE")
+	r.HandleFunc("/students/{id}/history", studentHandler.GetStudentHistory).Methods("GET")
+	r.HandleFunc("/stats", studentHandler.GetStats).Methods("GET")
+
+	r.HandleFunc("/webhooks", webhookHandler.ListWebhooks).Methods("GET")
+	r.HandleFunc("/webhooks", webhookHandler.CreateWebhook).Methods("POST")
+	r.HandleFunc("/webhooks/{id}", webhookHandler.DeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/webhooks/{id}/deliveries", webhookHandler.GetWebhookDeliveries).Methods("GET")
 
 	////////////////////////////////////////////////////////////////////////////////////////
-	progressHandler := handler.NewProgressHandler(uploadService)
+	progressHandler := handler.NewProgressHandler(uploadService, allowedOrigins)
 
 	r.HandleFunc("/progress/sse", progressHandler.SSEProgress).Methods("GET")
+	r.HandleFunc("/progress/ws", progressHandler.WSProgress).Methods("GET")
+	r.HandleFunc("/progress/stats", progressHandler.GetProgressStats).Methods("GET")
 	//////////////////////////////////////////////////////////////////////////////////////
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
 	// Create uploads directory
 	if err := os.Mkdir("uploads", os.ModePerm); err != nil && !os.IsExist(err) {
 		log.Fatal("Failed to create uploads directory:", err)
@@ -51,7 +87,11 @@ func main() {
 
 	// Start server
 	log.Println("Server running on port 8080")
-	err := http.ListenAndServe(":8080", handlers.CORS(handlers.AllowedOrigins([]string{"http://localhost:3000"}))(r))
+	err = http.ListenAndServe(":8080", handlers.CORS(
+		handlers.AllowedOrigins(allowedOrigins),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "X-User"}),
+	)(r))
 	if err != nil {
 		return
 	}
@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +15,16 @@ var (
 	DBPassword string
 	DBName     string
 	DBPort     string
+
+	// A job's progress is broadcast at most every ProgressInterval, unless it has
+	// moved by ProgressMinChange percent since the last broadcast. Set both to 0
+	// to broadcast every update.
+	ProgressInterval  = 250 * time.Millisecond // PROGRESS_INTERVAL, e.g. "500ms"
+	ProgressMinChange = 1.0                    // PROGRESS_MIN_CHANGE
+
+	// Finished jobs, and batches whose jobs are all gone, are forgotten after
+	// JobRetention; rows they imported stay. 0 keeps them forever.
+	JobRetention = time.Hour // JOB_RETENTION, e.g. "24h"
 )
 
 func LoadConfig() error {
@@ -36,5 +48,28 @@ func LoadConfig() error {
 	DBName = os.Getenv("DB_NAME")
 	DBPort = os.Getenv("DB_PORT")
 
+	// Optional settings
+	if value := os.Getenv("PROGRESS_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return fmt.Errorf("invalid PROGRESS_INTERVAL %q: must be a duration such as 250ms", value)
+		}
+		ProgressInterval = interval
+	}
+	if value := os.Getenv("PROGRESS_MIN_CHANGE"); value != "" {
+		change, err := strconv.ParseFloat(value, 64)
+		if err != nil || change < 0 {
+			return fmt.Errorf("invalid PROGRESS_MIN_CHANGE %q: must be a percentage", value)
+		}
+		ProgressMinChange = change
+	}
+	if value := os.Getenv("JOB_RETENTION"); value != "" {
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention < 0 {
+			return fmt.Errorf("invalid JOB_RETENTION %q: must be a duration such as 1h", value)
+		}
+		JobRetention = retention
+	}
+
 	return nil
 }
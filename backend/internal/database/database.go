@@ -39,16 +39,22 @@ func InitDB() *gorm.DB {
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
-	// Auto-migrate the Student table
-	if err := db.AutoMigrate(&model.Student{}); err != nil {
+	// Auto-migrate the tables
+	if err := db.AutoMigrate(&model.Student{}, &model.ImportBackup{}, &model.GradeChange{}, &model.Webhook{}, &model.WebhookDelivery{}); err != nil {
 		log.Fatal("Failed to auto-migrate the database:", err)
 	}
 
+	// Fuzzy name search needs extensions the database user may not be allowed to create
+	if err := MigrateSearch(db); err != nil {
+		log.Println("Fuzzy name search unavailable, falling back to substring search:", err)
+	}
+
 	return db
 }
 
 func TruncateAllTables(db *gorm.DB) error {
-	tables := []string{"students"} // Add all table names here
+	// webhooks holds configuration and grade_changes an audit trail that must outlive the data
+	tables := []string{"students", "import_backups", "webhook_deliveries"} // Add all table names here
 
 	for _, table := range tables {
 		if err := db.Exec(fmt.Sprintf("TRUNCATE TABLE %s RESTART IDENTITY CASCADE;", table)).Error; err != nil {
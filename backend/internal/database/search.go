@@ -0,0 +1,58 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"log"
+)
+
+// SearchFunction normalizes names for fuzzy search: lower case, and without
+// accents when the unaccent extension is available. It is IMMUTABLE so the
+// trigram index can be built on it.
+const SearchFunction = "student_search_text"
+
+// MigrateSearch sets up fuzzy name search on PostgreSQL: the pg_trgm extension,
+// the normalizing function and a trigram index on the normalized names. It
+// does nothing on other databases.
+func MigrateSearch(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		return err
+	}
+
+	// unaccent is optional; without it search is still case-insensitive and typo-tolerant
+	normalize := "lower($1)"
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS unaccent").Error; err != nil {
+		log.Println("unaccent extension unavailable, name search will be accent-sensitive:", err)
+	} else {
+		// The two-argument form names the dictionary explicitly, which is what makes it safe to mark IMMUTABLE
+		normalize = "lower(public.unaccent('public.unaccent'::regdictionary, $1))"
+	}
+
+	statements := []string{
+		"CREATE OR REPLACE FUNCTION " + SearchFunction + "(text) RETURNS text " +
+			"LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE AS $$ SELECT " + normalize + " $$",
+		"CREATE INDEX IF NOT EXISTS idx_students_name_trgm ON students USING gin (" + SearchFunction + "(student_name) gin_trgm_ops)",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchAvailable reports whether MigrateSearch succeeded on db, so fuzzy name
+// search can be used
+func SearchAvailable(db *gorm.DB) bool {
+	if db.Dialector.Name() != "postgres" {
+		return false
+	}
+
+	var available bool
+	err := db.Raw("SELECT to_regprocedure(?) IS NOT NULL AND EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')",
+		SearchFunction+"(text)").Row().Scan(&available)
+	return err == nil && available
+}
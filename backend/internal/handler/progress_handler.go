@@ -3,28 +3,59 @@ package handler
 import (
 	"backend/internal/service"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type ProgressHandler struct {
 	uploadService *service.UploadService
+	upgrader      websocket.Upgrader
 }
 
-func NewProgressHandler(uploadService *service.UploadService) *ProgressHandler {
-	return &ProgressHandler{uploadService: uploadService}
+// NewProgressHandler creates a ProgressHandler. WebSocket connections are
+// accepted from allowedOrigins and from the server's own origin.
+func NewProgressHandler(uploadService *service.UploadService, allowedOrigins []string) *ProgressHandler {
+	origins := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		origins[origin] = true
+	}
+
+	return &ProgressHandler{
+		uploadService: uploadService,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				return origin == "" || origins[origin] || origin == "http://"+r.Host || origin == "https://"+r.Host
+			},
+		},
+	}
 }
 
-// GetFileProgress returns the progress for a specific file
+// GetFileProgress returns the progress for a specific job, or the latest job for a file name
 func (h *ProgressHandler) GetFileProgress(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Query().Get("jobId")
 	fileName := r.URL.Query().Get("fileName")
-	if fileName == "" {
-		http.Error(w, "fileName parameter is required", http.StatusBadRequest)
+	if jobID == "" && fileName == "" {
+		http.Error(w, "jobId or fileName parameter is required", http.StatusBadRequest)
 		return
 	}
 
-	progress := h.uploadService.GetFileProgress(filepath.Base(fileName))
+	var progress *service.ProgressInfo
+	if jobID != "" {
+		progress = h.uploadService.GetJobProgress(jobID)
+	} else {
+		progress = h.uploadService.GetFileProgress(filepath.Base(fileName))
+	}
 	if progress == nil {
 		http.Error(w, "File not found or not being processed", http.StatusNotFound)
 		return
@@ -76,57 +107,395 @@ func (h *ProgressHandler) GetAllProgress(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
-// SSEProgress streams progress updates to the client using Server-Sent Events (SSE)
-func (h *ProgressHandler) SSEProgress(w http.ResponseWriter, r *http.Request) {
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// sseRetry is how long browsers wait before reconnecting a dropped stream, in milliseconds
+const sseRetry = 3000
 
-	// Create a channel to receive progress updates
-	progressChan := make(chan *service.ProgressInfo)
-	defer close(progressChan)
+// sseHeartbeat is how often a comment is sent on an idle stream, so proxies
+// and load balancers do not close it
+const sseHeartbeat = 15 * time.Second
 
-	// Register the client to receive progress updates
-	h.uploadService.RegisterProgressListener(progressChan)
-	defer h.uploadService.UnregisterProgressListener(progressChan)
+// progressEventTypes maps job statuses to the SSE event types clients listen for
+var progressEventTypes = map[string]string{
+	service.StatusUploading:  "job.uploading",
+	service.StatusQueued:     "job.queued",
+	service.StatusProcessing: "job.progress",
+	service.StatusCompleted:  "job.completed",
+	service.StatusError:      "job.failed",
+	service.StatusCancelled:  "job.cancelled",
+}
 
-	// Send progress updates to the client
-	for {
-		select {
-		case progress := <-progressChan:
-			// Calculate percentage
-			var percentage float64
+// batchEventTypes maps batch statuses to SSE event types. A batch event follows
+// the events of its jobs whenever they change.
+var batchEventTypes = map[string]string{
+	service.StatusUploading:  "batch.uploading",
+	service.StatusProcessing: "batch.progress",
+	service.StatusCompleted:  "batch.completed",
+	service.StatusError:      "batch.failed",
+	service.StatusCancelled:  "batch.cancelled",
+}
+
+// progressEventData is the JSON payload of every job event. Fields are always
+// present; eta_seconds and finished_at are null until they are known.
+type progressEventData struct {
+	JobID         string         `json:"job_id"`
+	BatchID       string         `json:"batch_id"`
+	FileName      string         `json:"file_name"`
+	ParentFile    string         `json:"parent_file"`
+	Status        string         `json:"status"`
+	TotalRecords  int            `json:"total_records"`
+	Processed     int            `json:"processed"`
+	Rejected      int            `json:"rejected"`
+	Duplicates    int            `json:"duplicates"`
+	Percentage    float64        `json:"percentage"`
+	RowsPerSecond float64        `json:"rows_per_second"`
+	ETASeconds    *float64       `json:"eta_seconds"`
+	Error         string         `json:"error"`
+	RowErrors     []rowErrorData `json:"row_errors"`
+	StartedAt     time.Time      `json:"started_at"`
+	FinishedAt    *time.Time     `json:"finished_at"`
+
+	Bytes          int64       `json:"bytes"`   // 0 until processing starts
+	Workers        int         `json:"workers"` // 0 until processing starts
+	BytesPerSecond float64     `json:"bytes_per_second"`
+	Timings        timingsData `json:"timings"`
+}
+
+// timingsData is service.JobTimings in seconds
+type timingsData struct {
+	UploadSeconds    float64 `json:"upload_seconds"`
+	QueueWaitSeconds float64 `json:"queue_wait_seconds"`
+	ParseSeconds     float64 `json:"parse_seconds"`
+	ValidateSeconds  float64 `json:"validate_seconds"`
+	DBWriteSeconds   float64 `json:"db_write_seconds"`
+	CommitSeconds    float64 `json:"commit_seconds"`
+}
+
+type rowErrorData struct {
+	Line      int    `json:"line"`
+	StudentID string `json:"student_id"`
+	Message   string `json:"message"`
+}
+
+// newProgressEventData converts progress as of the given time into an event
+// payload. Throughput is measured from the start of processing, and the ETA
+// assumes it stays the same. Bytes are assumed to be read at the same pace as
+// records, since only the size of the whole file is known.
+func newProgressEventData(progress service.ProgressInfo, at time.Time) progressEventData {
+	data := progressEventData{
+		JobID:        progress.JobID,
+		BatchID:      progress.BatchID,
+		FileName:     progress.FileName,
+		ParentFile:   progress.ParentFile,
+		Status:       progress.Status,
+		TotalRecords: progress.TotalRecords,
+		Processed:    progress.Processed,
+		Rejected:     progress.Rejected,
+		Duplicates:   progress.Duplicates,
+		Error:        progress.Error,
+		RowErrors:    make([]rowErrorData, 0, len(progress.RowErrors)),
+		StartedAt:    progress.StartTime,
+		Bytes:        progress.Bytes,
+		Workers:      progress.Workers,
+		Timings: timingsData{
+			UploadSeconds:    progress.Timings.Upload.Seconds(),
+			QueueWaitSeconds: progress.Timings.QueueWait.Seconds(),
+			ParseSeconds:     progress.Timings.Parse.Seconds(),
+			ValidateSeconds:  progress.Timings.Validate.Seconds(),
+			DBWriteSeconds:   progress.Timings.DBWrite.Seconds(),
+			CommitSeconds:    progress.Timings.Commit.Seconds(),
+		},
+	}
+	for _, rowErr := range progress.RowErrors {
+		data.RowErrors = append(data.RowErrors, rowErrorData{Line: rowErr.Line, StudentID: rowErr.StudentID, Message: rowErr.Message})
+	}
+	if progress.TotalRecords > 0 {
+		data.Percentage = float64(progress.Processed) / float64(progress.TotalRecords) * 100
+	}
+
+	end := at
+	if !progress.EndTime.IsZero() {
+		finished := progress.EndTime
+		data.FinishedAt = &finished
+		end = finished
+	}
+	if progress.Status != service.StatusUploading && progress.Status != service.StatusQueued {
+		if elapsed := end.Sub(progress.StartTime).Seconds(); elapsed > 0 {
+			data.RowsPerSecond = float64(progress.Processed) / elapsed
 			if progress.TotalRecords > 0 {
-				percentage = float64(progress.Processed) / float64(progress.TotalRecords) * 100
+				data.BytesPerSecond = float64(progress.Bytes) * data.Percentage / 100 / elapsed
 			}
+		}
+	}
+	if progress.Status == service.StatusProcessing && progress.TotalRecords > 0 && data.RowsPerSecond > 0 {
+		eta := float64(progress.TotalRecords-progress.Processed) / data.RowsPerSecond
+		data.ETASeconds = &eta
+	}
+	return data
+}
 
-			// Create a response that includes the percentage
-			response := struct {
-				*service.ProgressInfo
-				Percentage float64 `json:"percentage"`
-			}{
-				ProgressInfo: progress,
-				Percentage:   percentage,
-			}
+// SSEProgress streams progress updates to the client using Server-Sent Events
+// (SSE). Events are typed by job status (job.queued, job.progress,
+// job.completed, job.failed, ...) and carry a progressEventData payload and a
+// sequential id; idle streams get a comment every sseHeartbeat. A new client first receives the
+// state of all active jobs; a reconnecting one sends Last-Event-ID (or the
+// last_event_id query parameter) and receives the events it missed, or the
+// state of every job if they are no longer buffered.
+//
+// job and batch (repeated or comma-separated) limit the stream to those jobs,
+// and to the jobs of those batches. The client then starts with the state of
+// every subscribed job, and the stream ends with a stream.end event once all of
+// them have completed or failed. Reconnecting after that gets a 204, which
+// tells browsers to stop retrying.
+func (h *ProgressHandler) SSEProgress(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
 
-			// Marshal the response
-			data, err := json.Marshal(response)
-			if err != nil {
-				log.Println("Error marshaling progress:", err)
-				continue
+	// Subscribe before reading the backlog so nothing falls in between
+	subscription := h.uploadService.SubscribeProgress()
+	defer subscription.Close()
+
+	filter := parseProgressFilter(r.URL.Query())
+	pending := make(map[string]bool) // subscribed jobs that have not finished yet
+	if filter != nil {
+		jobs, _ := h.uploadService.ProgressSnapshot(filter.matches)
+		if len(jobs) == 0 {
+			http.Error(w, "No matching jobs", http.StatusNotFound)
+			return
+		}
+		for _, progress := range jobs {
+			if progress.IsActive() {
+				pending[progress.JobID] = true
 			}
+		}
+	}
 
-			// Send the SSE event
-			_, err = w.Write([]byte("data: " + string(data) + "\n\n"))
-			if err != nil {
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	backlog, cursor := h.initialEvents(lastID, filter)
+
+	if filter != nil && len(pending) == 0 && len(backlog) == 0 {
+		// Everything subscribed to has finished and the client has seen it
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, event := range backlog {
+			if err := writeProgressEvent(w, event); err != nil {
+				log.Println("Error writing SSE data:", err)
+				return
+			}
+			if !event.Progress.IsActive() {
+				delete(pending, event.Progress.JobID)
+			}
+		}
+		for _, batch := range h.uploadService.GetBatches(eventBatchIDs(backlog)) {
+			if err := writeBatchEvent(w, batch); err != nil {
 				log.Println("Error writing SSE data:", err)
 				return
 			}
-			w.(http.Flusher).Flush() // Flush the response to send the data immediately
+		}
+		if filter != nil && len(pending) == 0 {
+			fmt.Fprint(w, "event: stream.end\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush() // Flush the response to send the data immediately
+		if len(backlog) > 0 {
+			// Only traffic the client sees keeps the connection alive; wake-ups for filtered out events do not
+			heartbeat.Reset(sseHeartbeat)
+		}
 
+		select {
+		case <-subscription.C:
+			backlog, cursor = h.nextEvents(subscription, cursor, filter)
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			backlog = nil
 		case <-r.Context().Done():
 			return
 		}
 	}
 }
+
+// GetProgressStats reports how many progress events were published, and how
+// many were coalesced or dropped because subscribers fell behind
+func (h *ProgressHandler) GetProgressStats(w http.ResponseWriter, r *http.Request) {
+	stats := h.uploadService.ProgressBusStats()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"subscribers": stats.Subscribers,
+		"published":   stats.Published,
+		"coalesced":   stats.Coalesced,
+		"dropped":     stats.Dropped,
+	})
+}
+
+// initialEvents returns the events a client connecting with lastID starts
+// with, and the ID of the last event they reflect
+func (h *ProgressHandler) initialEvents(lastID string, filter *progressFilter) ([]service.ProgressEvent, uint64) {
+	if id, err := strconv.ParseUint(lastID, 10, 64); err == nil {
+		if backlog, ok := h.uploadService.ProgressEventsSince(id); ok {
+			if len(backlog) > 0 {
+				id = backlog[len(backlog)-1].ID
+			}
+			return filter.apply(backlog), id
+		}
+	}
+
+	// Without a usable ID only active jobs matter; after a gap any job may have
+	// finished unseen. Subscribers to specific jobs always want all of them.
+	include := (*service.ProgressInfo).IsActive
+	if lastID != "" || filter != nil {
+		include = filter.matches
+	}
+	backlog, cursor := snapshotEvents(h.uploadService, include)
+	return filter.apply(backlog), cursor
+}
+
+// nextEvents collects the queued events after cursor that match the filter,
+// and returns them with the new cursor
+func (h *ProgressHandler) nextEvents(subscription *service.ProgressSubscription, cursor uint64, filter *progressFilter) ([]service.ProgressEvent, uint64) {
+	queued, ok := subscription.Next()
+	if !ok {
+		// Too slow to keep up, so events were dropped: start over from the current state
+		return snapshotEvents(h.uploadService, filter.matches)
+	}
+	return filter.apply(eventsAfter(queued, cursor)), lastEventID(queued, cursor)
+}
+
+// eventsAfter returns the events with IDs above cursor. Events published
+// between subscribing and reading a snapshot or the replay buffer are queued
+// too, but already reflected in what the client was sent.
+func eventsAfter(events []service.ProgressEvent, cursor uint64) []service.ProgressEvent {
+	for i, event := range events {
+		if event.ID > cursor {
+			return events[i:]
+		}
+	}
+	return nil
+}
+
+// lastEventID returns the ID of the last of events, or cursor if it is higher
+func lastEventID(events []service.ProgressEvent, cursor uint64) uint64 {
+	if len(events) > 0 && events[len(events)-1].ID > cursor {
+		return events[len(events)-1].ID
+	}
+	return cursor
+}
+
+// progressFilter limits a progress stream to some jobs and batches. A nil
+// filter matches everything.
+type progressFilter struct {
+	jobs    map[string]bool
+	batches map[string]bool
+}
+
+// parseProgressFilter reads the job and batch parameters, returning nil if
+// there are none
+func parseProgressFilter(query url.Values) *progressFilter {
+	filter := &progressFilter{jobs: make(map[string]bool), batches: make(map[string]bool)}
+	for param, set := range map[string]map[string]bool{"job": filter.jobs, "batch": filter.batches} {
+		for _, value := range query[param] {
+			for _, id := range strings.Split(value, ",") {
+				if id = strings.TrimSpace(id); id != "" {
+					set[id] = true
+				}
+			}
+		}
+	}
+	if len(filter.jobs) == 0 && len(filter.batches) == 0 {
+		return nil
+	}
+	return filter
+}
+
+func (f *progressFilter) matches(progress *service.ProgressInfo) bool {
+	return f == nil || f.jobs[progress.JobID] || f.batches[progress.BatchID]
+}
+
+// apply returns the events that match the filter
+func (f *progressFilter) apply(events []service.ProgressEvent) []service.ProgressEvent {
+	if f == nil {
+		return events
+	}
+	matched := events[:0]
+	for _, event := range events {
+		if f.matches(&event.Progress) {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+// snapshotEvents returns the current state of the jobs include selects as
+// events, and the ID of the last event it reflects. Only the final event
+// carries that ID, so a client cut off halfway through gets the whole
+// snapshot again when it reconnects.
+func snapshotEvents(uploadService *service.UploadService, include func(*service.ProgressInfo) bool) ([]service.ProgressEvent, uint64) {
+	snapshot, lastID := uploadService.ProgressSnapshot(include)
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].StartTime.Before(snapshot[j].StartTime) })
+
+	events := make([]service.ProgressEvent, len(snapshot))
+	for i, progress := range snapshot {
+		events[i] = service.ProgressEvent{Time: time.Now(), Progress: progress}
+	}
+	if len(events) > 0 {
+		events[len(events)-1].ID = lastID
+	}
+	return events, lastID
+}
+
+// eventBatchIDs returns the batches of the jobs in events
+func eventBatchIDs(events []service.ProgressEvent) []string {
+	batchIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		if event.Progress.BatchID != "" {
+			batchIDs = append(batchIDs, event.Progress.BatchID)
+		}
+	}
+	return batchIDs
+}
+
+// writeProgressEvent writes one typed SSE event
+func writeProgressEvent(w io.Writer, event service.ProgressEvent) error {
+	data, err := json.Marshal(newProgressEventData(event.Progress, event.Time))
+	if err != nil {
+		return err
+	}
+
+	if event.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", progressEventTypes[event.Progress.Status], data)
+	return err
+}
+
+// writeBatchEvent writes the state of a batch as a typed SSE event. It has no
+// id, since it is derived from the job events before it.
+func writeBatchEvent(w io.Writer, batch service.BatchSummary) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", batchEventTypes[batch.Status], data)
+	return err
+}
@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"backend/internal/service"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 2 * sseHeartbeat // a client silent for longer is gone
+	wsMaxCommand   = 4096             // bytes
+	wsMessageError = "error"
+)
+
+// wsCommand is a message from a WebSocket client:
+//
+//	{"type": "subscribe", "job_ids": [...], "batch_ids": [...]}
+//	{"type": "unsubscribe", "job_ids": [...], "batch_ids": [...]}
+//	{"type": "cancel", "job_id": "..."}
+type wsCommand struct {
+	Type     string   `json:"type"`
+	JobIDs   []string `json:"job_ids"`
+	BatchIDs []string `json:"batch_ids"`
+	JobID    string   `json:"job_id"`
+}
+
+// wsMessage is a message to a WebSocket client. Progress events have the SSE
+// event type and payload; replies to commands are cancel.accepted or error.
+type wsMessage struct {
+	Type  string      `json:"type"`
+	ID    uint64      `json:"id,omitempty"`
+	Data  interface{} `json:"data,omitempty"` // a progressEventData or a service.BatchSummary
+	JobID string      `json:"job_id,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// WSProgress streams the same progress events as SSEProgress over a WebSocket,
+// for clients whose networks strip SSE. It accepts the same job, batch and
+// last_event_id parameters. Without job or batch the client gets every job
+// until it sends its first subscribe; after that only the jobs and batches it
+// has subscribed to. Subscribing sends the current state of the added jobs.
+// A cancel command cancels a job as POST /jobs/{id}/cancel does.
+func (h *ProgressHandler) WSProgress(w http.ResponseWriter, r *http.Request) {
+	// Subscribe before reading the backlog so nothing falls in between
+	subscription := h.uploadService.SubscribeProgress()
+	defer subscription.Close()
+
+	filter := parseProgressFilter(r.URL.Query())
+	if filter != nil {
+		if jobs, _ := h.uploadService.ProgressSnapshot(filter.matches); len(jobs) == 0 {
+			http.Error(w, "No matching jobs", http.StatusNotFound)
+			return
+		}
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	commands := make(chan []byte)
+	closed := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go readWSCommands(conn, commands, closed, stop)
+
+	ping := time.NewTicker(sseHeartbeat)
+	defer ping.Stop()
+
+	backlog, cursor := h.initialEvents(r.URL.Query().Get("last_event_id"), filter)
+	var replies []wsMessage
+	for {
+		for _, event := range backlog {
+			if err := writeWSMessage(conn, newWSProgressMessage(event)); err != nil {
+				return
+			}
+		}
+		for _, batch := range h.uploadService.GetBatches(eventBatchIDs(backlog)) {
+			if err := writeWSMessage(conn, wsMessage{Type: batchEventTypes[batch.Status], Data: batch}); err != nil {
+				return
+			}
+		}
+		for _, reply := range replies {
+			if err := writeWSMessage(conn, reply); err != nil {
+				return
+			}
+		}
+		backlog, replies = nil, nil
+
+		select {
+		case <-subscription.C:
+			backlog, cursor = h.nextEvents(subscription, cursor, filter)
+		case data := <-commands:
+			var command wsCommand
+			if err := json.Unmarshal(data, &command); err != nil {
+				replies = append(replies, wsMessage{Type: wsMessageError, Error: "invalid command: " + err.Error()})
+				continue
+			}
+			switch command.Type {
+			case "subscribe":
+				backlog, cursor, filter = h.wsSubscribe(subscription, cursor, filter, command)
+			case "unsubscribe":
+				if filter == nil {
+					replies = append(replies, wsMessage{Type: wsMessageError, Error: "not subscribed to any jobs or batches"})
+					continue
+				}
+				for _, id := range command.JobIDs {
+					delete(filter.jobs, id)
+				}
+				for _, id := range command.BatchIDs {
+					delete(filter.batches, id)
+				}
+			case "cancel":
+				replies = append(replies, h.wsCancel(command.JobID))
+			default:
+				replies = append(replies, wsMessage{Type: wsMessageError, Error: "unknown command type " + command.Type})
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// wsSubscribe adds the jobs and batches of command to filter. It returns the
+// state of the added jobs, together with the queued events due to the client,
+// the new cursor and the new filter.
+func (h *ProgressHandler) wsSubscribe(subscription *service.ProgressSubscription, cursor uint64, filter *progressFilter, command wsCommand) ([]service.ProgressEvent, uint64, *progressFilter) {
+	added := &progressFilter{jobs: make(map[string]bool), batches: make(map[string]bool)}
+	for _, id := range command.JobIDs {
+		added.jobs[id] = true
+	}
+	for _, id := range command.BatchIDs {
+		added.batches[id] = true
+	}
+	merge := func() *progressFilter {
+		if filter == nil {
+			return added
+		}
+		for id := range added.jobs {
+			filter.jobs[id] = true
+		}
+		for id := range added.batches {
+			filter.batches[id] = true
+		}
+		return filter
+	}
+
+	// Queued events up to the snapshot only concern the jobs followed before it
+	snapshot, snapshotID := snapshotEvents(h.uploadService, added.matches)
+	queued, ok := subscription.Next()
+	if !ok {
+		filter = merge()
+		events, cursor := snapshotEvents(h.uploadService, filter.matches)
+		return events, cursor, filter
+	}
+	queued = eventsAfter(queued, cursor)
+	split := len(queued)
+	for i, event := range queued {
+		if event.ID > snapshotID {
+			split = i
+			break
+		}
+	}
+
+	events := filter.apply(queued[:split:split])
+	events = append(events, snapshot...)
+	filter = merge()
+	events = append(events, filter.apply(queued[split:])...)
+	return events, lastEventID(queued, snapshotID), filter
+}
+
+// wsCancel cancels a job and returns the reply to the client
+func (h *ProgressHandler) wsCancel(jobID string) wsMessage {
+	err := h.uploadService.CancelJob(jobID)
+	switch {
+	case err == nil:
+		return wsMessage{Type: "cancel.accepted", JobID: jobID}
+	case errors.Is(err, service.ErrJobNotFound):
+		return wsMessage{Type: wsMessageError, JobID: jobID, Error: "job not found"}
+	case errors.Is(err, service.ErrJobFinished):
+		return wsMessage{Type: wsMessageError, JobID: jobID, Error: "job has already finished"}
+	default:
+		return wsMessage{Type: wsMessageError, JobID: jobID, Error: err.Error()}
+	}
+}
+
+// readWSCommands passes the client's messages to commands until the connection
+// fails or stop is closed, then closes closed. Reading also processes pongs,
+// which keep the connection alive.
+func readWSCommands(conn *websocket.Conn, commands chan<- []byte, closed, stop chan struct{}) {
+	defer close(closed)
+
+	conn.SetReadLimit(wsMaxCommand)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("Error reading WebSocket command:", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		select {
+		case commands <- data:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func newWSProgressMessage(event service.ProgressEvent) wsMessage {
+	return wsMessage{Type: progressEventTypes[event.Progress.Status], ID: event.ID, Data: newProgressEventData(event.Progress, event.Time)}
+}
+
+func writeWSMessage(conn *websocket.Conn, message wsMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(message)
+}
@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// exportColumns are the columns of CSV and XLSX exports. The first four are
+// the import columns, so an export can be uploaded again.
+var exportColumns = []string{"student_id", "student_name", "subject", "grade", "created_at", "updated_at"}
+
+// csvFlushRows is how many CSV rows are buffered before they are sent
+const csvFlushRows = 1000
+
+// studentWriter writes an export in one format
+type studentWriter interface {
+	Write(student *model.Student) error
+	Close() error
+}
+
+// exportResponse sets the download headers when the first byte is written,
+// so errors before then can still be reported with a normal error response
+type exportResponse struct {
+	http.ResponseWriter
+	format  string
+	started bool
+}
+
+func (e *exportResponse) Write(p []byte) (int, error) {
+	if !e.started {
+		e.start()
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+func (e *exportResponse) Flush() {
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (e *exportResponse) start() {
+	contentTypes := map[string]string{
+		"csv":    "text/csv; charset=utf-8",
+		"ndjson": "application/x-ndjson",
+		"xlsx":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}
+	e.Header().Set("Content-Type", contentTypes[e.format])
+	e.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="students.%s"`, e.format))
+	e.started = true
+}
+
+// ExportStudents streams every student matching the listing filters and sort
+// as a file download: format=csv (the default), ndjson or xlsx.
+func (h *StudentHandler) ExportStudents(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStudentQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	response := &exportResponse{ResponseWriter: w, format: format}
+
+	var writer studentWriter
+	switch format {
+	case "csv":
+		writer = newCSVStudentWriter(response)
+	case "ndjson":
+		writer = &ndjsonStudentWriter{encoder: json.NewEncoder(response)}
+	case "xlsx":
+		writer, err = newXLSXStudentWriter(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		verr := &service.ValidationError{}
+		verr.Add("format", "must be one of csv, ndjson, xlsx")
+		writeError(w, verr)
+		return
+	}
+
+	err = h.studentService.ExportStudents(q.Filter, q.Sort, writer.Write)
+	if err == nil {
+		err = writer.Close()
+	} else if xlsx, ok := writer.(*xlsxStudentWriter); ok {
+		xlsx.file.Close()
+	}
+	if err != nil {
+		if !response.started {
+			writeError(w, err)
+			return
+		}
+		// The response has started, so all that can be done is to cut it short
+		log.Printf("Export failed: %v", err)
+		return
+	}
+
+	// An empty NDJSON export writes nothing, but is still a download
+	if !response.started {
+		response.start()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// exportRecord returns the exportColumns values of student
+func exportRecord(student *model.Student) []string {
+	return []string{
+		student.StudentID,
+		student.StudentName,
+		student.Subject,
+		strconv.Itoa(student.Grade),
+		student.CreatedAt.UTC().Format(time.RFC3339),
+		student.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+type csvStudentWriter struct {
+	writer  *csv.Writer
+	flusher http.Flusher
+	rows    int
+}
+
+func newCSVStudentWriter(w *exportResponse) *csvStudentWriter {
+	return &csvStudentWriter{writer: csv.NewWriter(w), flusher: w}
+}
+
+func (c *csvStudentWriter) Write(student *model.Student) error {
+	if c.rows == 0 {
+		if err := c.writer.Write(exportColumns); err != nil {
+			return err
+		}
+	}
+	if err := c.writer.Write(exportRecord(student)); err != nil {
+		return err
+	}
+
+	c.rows++
+	if c.rows%csvFlushRows == 0 {
+		c.writer.Flush()
+		c.flusher.Flush()
+		return c.writer.Error()
+	}
+	return nil
+}
+
+func (c *csvStudentWriter) Close() error {
+	if c.rows == 0 {
+		if err := c.writer.Write(exportColumns); err != nil {
+			return err
+		}
+	}
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type ndjsonStudentWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonStudentWriter) Write(student *model.Student) error {
+	return n.encoder.Encode(student)
+}
+
+func (n *ndjsonStudentWriter) Close() error {
+	return nil
+}
+
+// xlsxStudentWriter builds the workbook with excelize's stream writer, which
+// keeps rows on disk rather than in memory. An XLSX file is a zip archive that
+// can only be sent once complete, so it is written out on Close.
+type xlsxStudentWriter struct {
+	out    io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	row    int
+}
+
+func newXLSXStudentWriter(out io.Writer) (*xlsxStudentWriter, error) {
+	file := excelize.NewFile()
+	stream, err := file.NewStreamWriter("Sheet1")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]interface{}, len(exportColumns))
+	for i, column := range exportColumns {
+		header[i] = column
+	}
+	if err := stream.SetRow("A1", header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &xlsxStudentWriter{out: out, file: file, stream: stream, row: 1}, nil
+}
+
+func (x *xlsxStudentWriter) Write(student *model.Student) error {
+	x.row++
+	if x.row > excelize.TotalRows {
+		return fmt.Errorf("export exceeds the %d rows an XLSX sheet can hold", excelize.TotalRows)
+	}
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	return x.stream.SetRow(cell, []interface{}{
+		student.StudentID,
+		student.StudentName,
+		student.Subject,
+		student.Grade,
+		student.CreatedAt.UTC().Format(time.RFC3339),
+		student.UpdatedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func (x *xlsxStudentWriter) Close() error {
+	defer x.file.Close()
+	if err := x.stream.Flush(); err != nil {
+		return err
+	}
+	return x.file.Write(x.out)
+}
@@ -1,11 +1,18 @@
 package handler
 
 import (
+	"backend/internal/model"
 	"backend/internal/service"
 	"encoding/json"
+	"errors"
 	_ "math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type StudentHandler struct {
@@ -17,46 +24,412 @@ func NewStudentHandler(studentService *service.StudentService) *StudentHandler {
 }
 
 func (h *StudentHandler) ListStudents(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
+	q, err := parseStudentQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	page, _ := strconv.Atoi(query.Get("page"))
-	if page < 1 {
-		page = 1
+	page, err := h.studentService.ListStudents(q)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	limit, _ := strconv.Atoi(query.Get("limit"))
-	if limit < 1 {
-		limit = 10
+
+	response := map[string]interface{}{
+		"data":  page.Students,
+		"limit": q.Limit,
+	}
+	if q.UseCursor {
+		response["nextCursor"] = page.NextCursor
+	} else {
+		response["page"] = q.Page
 	}
-	sortBy := query.Get("sort_by")
-	if sortBy == "" {
-		sortBy = "student_name"
+	if page.Total >= 0 {
+		response["total"] = page.Total
+		response["totalPages"] = page.TotalPages
+		response["totalEstimated"] = page.TotalEstimated
 	}
-	sortOrder := query.Get("sort_order")
-	if sortOrder == "" {
-		sortOrder = "asc"
+	if page.SearchMode != "" {
+		response["searchMode"] = page.SearchMode
 	}
-	studentName := query.Get("student_name")
-	subject := query.Get("subject")
-	gradeMin, _ := strconv.Atoi(query.Get("grade_min"))
-	gradeMax, _ := strconv.Atoi(query.Get("grade_max"))
 
-	students, totalCount, totalPages, err := h.studentService.ListStudents(page, limit, sortBy, sortOrder, studentName, subject, gradeMin, gradeMax)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
 
-	response := map[string]interface{}{
-		"data":       students,
-		"page":       page,
-		"limit":      limit,
-		"total":      totalCount,
-		"totalPages": totalPages,
+// userHeader names the user making an API change. There is no authentication,
+// so it is recorded in the grade history as given.
+const userHeader = "X-User"
+
+// studentBody is the JSON body of POST, PUT and PATCH requests. The grade may
+// be a number or a numeric string, as in uploaded files.
+type studentBody struct {
+	StudentID   *string      `json:"student_id"`
+	StudentName *string      `json:"student_name"`
+	Subject     *string      `json:"subject"`
+	Grade       *json.Number `json:"grade"`
+}
+
+// decodeStudentBody reads a studentBody. Malformed JSON and unknown fields
+// fail with a 400; an invalid grade is added to verr.
+func decodeStudentBody(r *http.Request, verr *service.ValidationError) (studentBody, *int, error) {
+	var body studentBody
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		bodyErr := &service.ValidationError{}
+		bodyErr.Add("body", "invalid JSON: %v", err)
+		return body, nil, bodyErr
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(response)
+	if body.Grade == nil {
+		return body, nil, nil
+	}
+	grade, err := service.ParseGrade(body.Grade.String())
+	if err != nil {
+		verr.Add("grade", "must be an integer")
+		return body, nil, nil
+	}
+	return body, &grade, nil
+}
+
+// GetStudent returns a single student
+func (h *StudentHandler) GetStudent(w http.ResponseWriter, r *http.Request) {
+	student, err := h.studentService.GetStudent(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, student)
+}
+
+// CreateStudent adds a single student, validated like an imported row
+func (h *StudentHandler) CreateStudent(w http.ResponseWriter, r *http.Request) {
+	verr := &service.ValidationError{}
+	body, grade, err := decodeStudentBody(r, verr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var student model.Student
+	if body.StudentID != nil {
+		student.StudentID = *body.StudentID
+	}
+	if body.StudentName != nil {
+		student.StudentName = *body.StudentName
+	}
+	if body.Subject != nil {
+		student.Subject = *body.Subject
+	}
+	if grade != nil {
+		student.Grade = *grade
+	} else if body.Grade == nil {
+		verr.Add("grade", "is required")
+	}
+	if err := verr.OrNil(); err != nil {
+		writeErrorStatus(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	created, err := h.studentService.CreateStudent(student, r.Header.Get(userHeader))
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Location", "/students/"+url.PathEscape(created.StudentID))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// ReplaceStudent handles PUT, which must give every field
+func (h *StudentHandler) ReplaceStudent(w http.ResponseWriter, r *http.Request) {
+	h.updateStudent(w, r, true)
+}
+
+// PatchStudent handles PATCH, which changes only the fields given
+func (h *StudentHandler) PatchStudent(w http.ResponseWriter, r *http.Request) {
+	h.updateStudent(w, r, false)
+}
+
+func (h *StudentHandler) updateStudent(w http.ResponseWriter, r *http.Request, replace bool) {
+	id := mux.Vars(r)["id"]
+	verr := &service.ValidationError{}
+	body, grade, err := decodeStudentBody(r, verr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if body.StudentID != nil && *body.StudentID != id {
+		verr.Add("student_id", "cannot be changed")
+	}
+	if err := verr.OrNil(); err != nil {
+		writeErrorStatus(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	changes := service.StudentChanges{
+		StudentName: body.StudentName,
+		Subject:     body.Subject,
+		Grade:       grade,
+		ChangedBy:   r.Header.Get(userHeader),
+	}
+	student, err := h.studentService.UpdateStudent(id, changes, replace)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, student)
+}
+
+// GetStudentHistory returns the grade changes of a student, oldest first
+func (h *StudentHandler) GetStudentHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	history, err := h.studentService.GradeHistory(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"studentId": id,
+		"history":   history,
+	})
+}
+
+// DeleteStudent removes a single student
+func (h *StudentHandler) DeleteStudent(w http.ResponseWriter, r *http.Request) {
+	if err := h.studentService.DeleteStudent(mux.Vars(r)["id"], r.Header.Get(userHeader)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetStats returns grade statistics for the students matching the listing
+// filters, overall and per subject. band_width sets the histogram band width.
+func (h *StudentHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	verr := &service.ValidationError{}
+
+	filter := parseStudentFilter(query, verr)
+	bandWidth := service.DefaultBandWidth
+	if value := query.Get("band_width"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			verr.Add("band_width", "must be a positive integer")
+		} else {
+			bandWidth = n
+		}
+	}
+	if err := verr.OrNil(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	report, err := h.studentService.GradeStats(filter, bandWidth)
 	if err != nil {
+		writeError(w, err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// maxListLimit caps the page size, so a single request cannot read the whole table
+const maxListLimit = 100
+
+// parseStudentQuery reads the listing parameters. Sorting is given either as
+// sort=grade:desc,student_name:asc or with the older sort_by and sort_order;
+// with q, sort=relevance (the default in page mode) ranks the best matches first.
+// Passing cursor (empty for the first page) or pagination=cursor switches from
+// page numbers to keyset pagination, which skips the total unless count is set.
+// Larger limits than maxListLimit are lowered to it.
+func parseStudentQuery(r *http.Request) (service.StudentQuery, error) {
+	query := r.URL.Query()
+	verr := &service.ValidationError{}
+
+	q := service.StudentQuery{
+		Page:   1,
+		Limit:  10,
+		Filter: parseStudentFilter(query, verr),
+	}
+	if value := query.Get("page"); value != "" {
+		if page, err := strconv.Atoi(value); err != nil || page < 1 {
+			verr.Add("page", "must be a positive integer")
+		} else {
+			q.Page = page
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if limit, err := strconv.Atoi(value); err != nil || limit < 1 {
+			verr.Add("limit", "must be a positive integer")
+		} else {
+			q.Limit = min(limit, maxListLimit)
+		}
+	}
+
+	var sortErr error
+	switch {
+	case query.Get("sort") != "":
+		q.Sort, sortErr = service.ParseSortSpec(query.Get("sort"))
+	case query.Get("sort_by") != "" || query.Get("sort_order") != "":
+		sortBy := query.Get("sort_by")
+		if sortBy == "" {
+			sortBy = "student_name"
+		}
+		q.Sort, sortErr = service.LegacySort(sortBy, query.Get("sort_order"))
+	}
+	_, hasCursor := query["cursor"]
+	switch pagination := query.Get("pagination"); pagination {
+	case "", "page":
+		q.UseCursor = hasCursor
+	case "cursor":
+		q.UseCursor = true
+	default:
+		verr.Add("pagination", "must be page or cursor")
+	}
+	q.Cursor = query.Get("cursor")
+
+	defaultCount := service.CountExact
+	if q.UseCursor {
+		defaultCount = service.CountNone
+	}
+	var countErr error
+	q.Count, countErr = service.ParseCountMode(query.Get("count"), defaultCount)
+
+	for _, err := range []error{sortErr, countErr} {
+		var fieldErrs *service.ValidationError
+		if errors.As(err, &fieldErrs) {
+			verr.Errors = append(verr.Errors, fieldErrs.Errors...)
+		}
+	}
+
+	return q, verr.OrNil()
+}
+
+// parseStudentFilter reads the filter parameters shared by the student
+// endpoints. Empty parameters are ignored, so grade_min=0 is a real bound but
+// grade_min= is not. Problems are added to verr.
+//
+//	q                                 fuzzy name search, tolerating typos and accents
+//	student_name                      case-insensitive substring
+//	subject                           repeated or comma-separated, matches any
+//	student_id, student_id_prefix     exact ID or ID prefix
+//	grade_gt, grade_gte               exclusive and inclusive lower bounds (grade_min = grade_gte)
+//	grade_lt, grade_lte               exclusive and inclusive upper bounds (grade_max = grade_lte)
+//	job_id, batch_id                  rows inserted by an upload job or batch
+//	created_after, created_before     RFC 3339 time or YYYY-MM-DD date; after is inclusive,
+//	updated_after, updated_before     before is exclusive
+func parseStudentFilter(query url.Values, verr *service.ValidationError) service.StudentFilter {
+	f := service.StudentFilter{
+		Search:          strings.TrimSpace(query.Get("q")),
+		StudentName:     query.Get("student_name"),
+		StudentID:       query.Get("student_id"),
+		StudentIDPrefix: query.Get("student_id_prefix"),
+		ImportJobID:     query.Get("job_id"),
+		ImportBatchID:   query.Get("batch_id"),
+	}
+
+	for _, value := range query["subject"] {
+		for _, subject := range strings.Split(value, ",") {
+			if subject = strings.TrimSpace(subject); subject != "" {
+				f.Subjects = append(f.Subjects, subject)
+			}
+		}
+	}
+
+	grades := []struct {
+		params []string
+		target **int
+	}{
+		{[]string{"grade_gt"}, &f.GradeGT},
+		{[]string{"grade_gte", "grade_min"}, &f.GradeGTE},
+		{[]string{"grade_lt"}, &f.GradeLT},
+		{[]string{"grade_lte", "grade_max"}, &f.GradeLTE},
+	}
+	for _, grade := range grades {
+		for _, param := range grade.params {
+			value := query.Get(param)
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				verr.Add(param, "must be an integer")
+				continue
+			}
+			if *grade.target != nil && **grade.target != n {
+				verr.Add(param, "conflicts with %s", grade.params[0])
+				continue
+			}
+			*grade.target = &n
+		}
+	}
+
+	times := []struct {
+		param  string
+		target **time.Time
+	}{
+		{"created_after", &f.CreatedAfter},
+		{"created_before", &f.CreatedBefore},
+		{"updated_after", &f.UpdatedAfter},
+		{"updated_before", &f.UpdatedBefore},
+	}
+	for _, t := range times {
+		value := query.Get(t.param)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseTime(value)
+		if err != nil {
+			verr.Add(t.param, "must be an RFC 3339 time or a YYYY-MM-DD date")
+			continue
+		}
+		*t.target = &parsed
+	}
+
+	return f
+}
+
+// parseTime accepts an RFC 3339 timestamp or a date, which means midnight UTC
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// writeError responds with a structured 400 for validation errors, 404 and
+// 409 for missing and duplicate students, and a 500 otherwise
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorStatus(w, err, http.StatusBadRequest)
+}
+
+// writeErrorStatus is writeError with the status used for validation errors,
+// so request bodies that parse but break the rules can get a 422
+func writeErrorStatus(w http.ResponseWriter, err error, validationStatus int) {
+	var verr *service.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeJSON(w, validationStatus, map[string]interface{}{
+			"error":   "invalid request",
+			"details": verr.Errors,
+		})
+	case errors.Is(err, service.ErrStudentNotFound), errors.Is(err, service.ErrWebhookNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, service.ErrStudentExists):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeJSON responds with value encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
 }
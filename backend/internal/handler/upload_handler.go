@@ -1,17 +1,28 @@
 package handler
 
 import (
+	"backend/internal/metrics"
 	"backend/internal/service"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
+// defaultSampleSize is how many sample rows and errors a dry run returns per file by default
+const defaultSampleSize = 10
+
 type UploadHandler struct {
 	uploadService *service.UploadService
 }
@@ -21,6 +32,8 @@ func NewUploadHandler(uploadService *service.UploadService) *UploadHandler {
 }
 
 func (h *UploadHandler) UploadCSV(w http.ResponseWriter, r *http.Request) {
+	receivedAt := time.Now()
+
 	// Ensure uploads directory exists
 	if err := os.MkdirAll("uploads", 0755); err != nil {
 		http.Error(w, "Failed to create uploads directory", http.StatusInternalServerError)
@@ -39,61 +52,401 @@ func (h *UploadHandler) UploadCSV(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex // Protects fileNames from concurrent writes
-	fileNames := make([]string, 0, len(files))
+	opts, err := parseImportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	for _, handler := range files {
-		wg.Add(1)
-		go func(handler *multipart.FileHeader) {
-			defer wg.Done()
+	if r.FormValue("dry_run") != "" {
+		dryRun, err := strconv.ParseBool(r.FormValue("dry_run"))
+		if err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		if dryRun {
+			h.previewUpload(w, r, files, opts)
+			return
+		}
+	}
 
-			file, err := handler.Open()
-			if err != nil {
-				log.Println("Error opening file:", err)
-				return
-			}
-			defer file.Close()
+	// Every POST is a batch; its files are kept together under uploads/<batch>
+	batchID := h.uploadService.CreateBatch(receivedAt)
+	metrics.Uploads.Inc()
+	batchDir := filepath.Join("uploads", batchID)
+	if err := os.MkdirAll(batchDir, 0755); err != nil {
+		h.uploadService.FailBatch(batchID, "failed to create uploads directory")
+		http.Error(w, "Failed to create uploads directory", http.StatusInternalServerError)
+		return
+	}
 
-			savePath := filepath.Join("uploads", handler.Filename)
-			outFile, err := os.Create(savePath)
-			if err != nil {
-				log.Println("Error saving the file:", err)
-				return
-			}
-			defer outFile.Close()
+	// Save all files before responding: the multipart temp files are removed
+	// as soon as the handler returns. Archives become one job per entry.
+	var uploads []uploadedFile
+	for i, handler := range files {
+		expanded, status, err := h.saveUpload(handler, i, batchDir, batchID)
+		if err != nil {
+			os.RemoveAll(batchDir)
+			h.uploadService.FailBatch(batchID, fmt.Sprintf("%s could not be saved", handler.Filename))
+			http.Error(w, fmt.Sprintf("Failed to save %s: %v", handler.Filename, err), status)
+			return
+		}
+		uploads = append(uploads, expanded...)
+	}
 
-			_, err = io.Copy(outFile, file)
-			if err != nil {
-				log.Println("Error writing file:", err)
-				return
-			}
+	jobs := make([]map[string]interface{}, 0, len(uploads))
+	for i := range uploads {
+		jobs = append(jobs, map[string]interface{}{
+			"jobId":      uploads[i].JobID,
+			"fileName":   uploads[i].Name,
+			"parentFile": uploads[i].Parent,
+		})
+	}
+	h.uploadService.BatchUploaded(batchID)
 
-			// Synchronize access to fileNames
-			mu.Lock()
-			fileNames = append(fileNames, handler.Filename)
-			mu.Unlock()
+	var wg sync.WaitGroup
+	for _, upload := range uploads {
+		wg.Add(1)
+		go func(upload uploadedFile) {
+			defer wg.Done()
 
-			// Process the CSV file
-			if err := h.uploadService.ProcessCSV(savePath); err != nil {
-				log.Printf("Error processing file %s: %v", savePath, err)
+			// Process the file
+			if err := h.uploadService.ProcessJob(upload.JobID, upload.Path, opts); err != nil {
+				log.Printf("Error processing file %s: %v", upload.Path, err)
 			}
-		}(handler)
+		}(upload)
 	}
 
 	go func() {
 		wg.Wait()
-		log.Println("All files processed")
+		if batch, err := h.uploadService.GetBatch(batchID); err == nil {
+			log.Printf("Batch %s %s: %d of %d rows processed, %d rejected, %d duplicates; upload %.1fs, processing %.1fs, wall clock %.1fs",
+				batchID, batch.Status, batch.Processed, batch.TotalRecords, batch.Rejected, batch.Duplicates,
+				batch.UploadSeconds, batch.ProcessingSeconds, batch.WallClockSeconds)
+		}
 	}()
 
-	// Return a response with the file names that were processed
+	// Return a response with the jobs that were started
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	response := map[string]interface{}{
 		"message": "Files uploaded successfully and processing started",
-		//"files":   fileNames,
+		"batchId": batchID,
+		"jobs":    jobs,
 	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Println("Error encoding response:", err)
 	}
 }
+
+// uploadedFile is a data file saved from an upload, possibly extracted from an archive
+type uploadedFile struct {
+	Name   string // name shown in progress, the entry path for archive members
+	Path   string
+	Parent string // archive the file came from, if any
+	JobID  string
+}
+
+// saveUpload saves the index-th uploaded file into dir under a job that
+// reports it as uploading until it is saved. An archive's job is handed to
+// the first file extracted from it, and the other files get jobs of their own.
+func (h *UploadHandler) saveUpload(handler *multipart.FileHeader, index int, dir, batchID string) ([]uploadedFile, int, error) {
+	jobID := h.uploadService.CreateUploadingJob(handler.Filename, batchID)
+	expanded, status, err := expandUpload(handler, index, dir)
+	if err != nil {
+		h.uploadService.FailJob(jobID, "Failed to save file: "+err.Error())
+		return nil, status, err
+	}
+
+	if expanded[0].Parent == "" {
+		h.uploadService.JobUploaded(jobID)
+		expanded[0].JobID = jobID
+		return expanded, 0, nil
+	}
+	fileNames := make([]string, len(expanded))
+	for i := range expanded {
+		fileNames[i] = expanded[i].Name
+	}
+	jobIDs := h.uploadService.ArchiveUploaded(jobID, fileNames)
+	if jobIDs == nil {
+		// Cancelled while uploading, so none of its files are imported
+		return []uploadedFile{{Name: handler.Filename, JobID: jobID}}, 0, nil
+	}
+	for i := range expanded {
+		expanded[i].JobID = jobIDs[i]
+	}
+	return expanded, 0, nil
+}
+
+// expandUpload saves the index-th uploaded file into dir. A zip archive is
+// extracted and each data file inside it is returned instead of the archive
+// itself. The status is the HTTP status to report if an error is returned.
+func expandUpload(handler *multipart.FileHeader, index int, dir string) ([]uploadedFile, int, error) {
+	savePath, err := saveUploadedFile(handler, index, dir)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if !isArchiveUpload(handler) {
+		return []uploadedFile{{Name: handler.Filename, Path: savePath}}, 0, nil
+	}
+
+	extractDir := strings.TrimSuffix(savePath, filepath.Ext(savePath)) + "_files"
+	entries, err := service.ExtractArchive(savePath, extractDir)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	os.Remove(savePath)
+
+	expanded := make([]uploadedFile, 0, len(entries))
+	for _, entry := range entries {
+		expanded = append(expanded, uploadedFile{Name: entry.Name, Path: entry.Path, Parent: handler.Filename})
+	}
+	return expanded, 0, nil
+}
+
+// isArchiveUpload reports whether an uploaded file is a zip archive of data files
+func isArchiveUpload(handler *multipart.FileHeader) bool {
+	file, err := handler.Open()
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return service.IsArchiveReader(file, handler.Size)
+}
+
+// GetBatch returns the aggregate state of the jobs from one upload
+func (h *UploadHandler) GetBatch(w http.ResponseWriter, r *http.Request) {
+	batch, err := h.uploadService.GetBatch(mux.Vars(r)["id"])
+	if errors.Is(err, service.ErrBatchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, batch)
+}
+
+// CancelJob stops a queued or processing job. Rows it has already saved are
+// kept; roll the job back to remove them.
+func (h *UploadHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	err := h.uploadService.CancelJob(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, service.ErrJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, service.ErrJobFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RollbackJob undoes an import job: mode=restore (the default) deletes the rows
+// it inserted and restores the ones it overwrote, mode=delete deletes both.
+// With dry_run=true it only reports how many rows would change.
+func (h *UploadHandler) RollbackJob(w http.ResponseWriter, r *http.Request) {
+	mode, err := service.ParseRollbackMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	summary, err := h.uploadService.RollbackJob(mux.Vars(r)["id"], mode, dryRun)
+	switch {
+	case errors.Is(err, service.ErrJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, service.ErrJobRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to roll back job: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// parseImportOptions reads the per-upload processing options from the form
+func parseImportOptions(r *http.Request) (service.ImportOptions, error) {
+	opts := service.DefaultImportOptions()
+
+	duplicatePolicy, err := service.ParseDuplicatePolicy(r.FormValue("duplicate_policy"))
+	if err != nil {
+		return opts, err
+	}
+	opts.DuplicatePolicy = duplicatePolicy
+
+	onConflict, err := service.ParseConflictPolicy(r.FormValue("on_conflict"))
+	if err != nil {
+		return opts, err
+	}
+	opts.OnConflict = onConflict
+
+	format, err := service.ParseFormat(r.FormValue("format"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Format = format
+
+	dialect, err := parseDialect(r)
+	if err != nil {
+		return opts, err
+	}
+	opts.Dialect = dialect
+	opts.Sheet = r.FormValue("sheet")
+
+	encoding, err := service.ParseEncoding(r.FormValue("encoding"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Encoding = encoding
+
+	if value := r.FormValue("map_columns"); value != "" {
+		if opts.MapColumns, err = strconv.ParseBool(value); err != nil {
+			return opts, fmt.Errorf("map_columns must be true or false")
+		}
+	}
+
+	return opts, nil
+}
+
+// parseDialect reads the delimited text settings from the form. Anything not
+// given is left unset so it is sniffed from the file or defaulted.
+func parseDialect(r *http.Request) (service.Dialect, error) {
+	var dialect service.Dialect
+	var err error
+
+	if dialect.Delimiter, err = service.ParseChar("delimiter", r.FormValue("delimiter")); err != nil {
+		return dialect, err
+	}
+	if dialect.Comment, err = service.ParseChar("comment", r.FormValue("comment")); err != nil {
+		return dialect, err
+	}
+	if dialect.Quote, err = service.ParseQuote(r.FormValue("quote")); err != nil {
+		return dialect, err
+	}
+	if dialect.Header, err = service.ParseHeader(r.FormValue("header")); err != nil {
+		return dialect, err
+	}
+
+	for name, target := range map[string]*bool{"trim_spaces": &dialect.TrimSpace, "lazy_quotes": &dialect.LazyQuotes} {
+		if value := r.FormValue(name); value != "" {
+			if *target, err = strconv.ParseBool(value); err != nil {
+				return dialect, fmt.Errorf("%s must be true or false", name)
+			}
+		}
+	}
+
+	if value := r.FormValue("skip_lines"); value != "" {
+		if dialect.SkipLines, err = strconv.Atoi(value); err != nil {
+			return dialect, fmt.Errorf("skip_lines must be an integer")
+		}
+	}
+
+	return dialect, dialect.Validate()
+}
+
+// previewUpload runs a dry run of every uploaded file and responds with the
+// summaries. Files are written to a temporary directory that is removed afterwards.
+func (h *UploadHandler) previewUpload(w http.ResponseWriter, r *http.Request, files []*multipart.FileHeader, opts service.ImportOptions) {
+	sampleSize := defaultSampleSize
+	if value := r.FormValue("sample_size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 1000 {
+			http.Error(w, "sample_size must be an integer between 0 and 1000", http.StatusBadRequest)
+			return
+		}
+		sampleSize = n
+	}
+
+	tempDir, err := os.MkdirTemp("", "dry-run-")
+	if err != nil {
+		http.Error(w, "Failed to create temporary directory", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	type fileResult struct {
+		*service.ImportSummary
+		FileName   string `json:"FileName"`
+		ParentFile string `json:"ParentFile,omitempty"`
+		Error      string `json:"Error,omitempty"`
+	}
+
+	var uploads []uploadedFile
+	var results []fileResult
+	for i, handler := range files {
+		expanded, _, err := expandUpload(handler, i, tempDir)
+		if err != nil {
+			results = append(results, fileResult{FileName: handler.Filename, Error: "failed to save file: " + err.Error()})
+			continue
+		}
+		uploads = append(uploads, expanded...)
+	}
+
+	previews := make([]fileResult, len(uploads))
+	var wg sync.WaitGroup
+	for i, upload := range uploads {
+		wg.Add(1)
+		go func(i int, upload uploadedFile) {
+			defer wg.Done()
+			previews[i].FileName = upload.Name
+			previews[i].ParentFile = upload.Parent
+
+			summary, err := h.uploadService.PreviewFile(upload.Path, opts, sampleSize)
+			if err != nil {
+				previews[i].Error = err.Error()
+				return
+			}
+			previews[i].ImportSummary = summary
+		}(i, upload)
+	}
+	wg.Wait()
+	results = append(results, previews...)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"dry_run": true,
+		"files":   results,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println("Error encoding response:", err)
+	}
+}
+
+// saveUploadedFile copies the index-th uploaded file into dir and returns its path
+func saveUploadedFile(handler *multipart.FileHeader, index int, dir string) (string, error) {
+	file, err := handler.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Prefix with the part index so files uploaded under the same name do not overwrite each other
+	savePath := filepath.Join(dir, fmt.Sprintf("%d-%s", index, filepath.Base(handler.Filename)))
+	outFile, err := os.Create(savePath)
+	if err != nil {
+		return "", err
+	}
+	defer outFile.Close()
+
+	written, err := io.Copy(outFile, file)
+	if err != nil {
+		return "", err
+	}
+	metrics.UploadedFiles.Inc()
+	metrics.BytesReceived.Add(float64(written))
+	metrics.UploadedFileSize.Observe(float64(written))
+	return savePath, nil
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"backend/internal/service"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultDeliveryLimit is how many delivery attempts are listed when no limit is given
+const defaultDeliveryLimit = 50
+
+type WebhookHandler struct {
+	webhookService *service.WebhookService
+}
+
+func NewWebhookHandler(webhookService *service.WebhookService) *WebhookHandler {
+	return &WebhookHandler{webhookService: webhookService}
+}
+
+// webhookBody is the JSON body of POST /webhooks
+type webhookBody struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// CreateWebhook registers a webhook. The response is the only place the
+// secret is shown, which matters when the server generated it.
+func (h *WebhookHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var body webhookBody
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		verr := &service.ValidationError{}
+		verr.Add("body", "invalid JSON: %v", err)
+		writeError(w, verr)
+		return
+	}
+
+	webhook, err := h.webhookService.CreateWebhook(body.URL, body.Secret, body.Events)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"webhook": webhook,
+		"secret":  webhook.Secret,
+	})
+}
+
+// ListWebhooks returns every webhook, without their secrets
+func (h *WebhookHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.webhookService.ListWebhooks()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+// DeleteWebhook removes a webhook and its delivery log
+func (h *WebhookHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := parseWebhookID(r)
+	if err == nil {
+		err = h.webhookService.DeleteWebhook(id)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the latest delivery attempts of a webhook,
+// newest first; limit sets how many
+func (h *WebhookHandler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := parseWebhookID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit := defaultDeliveryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			verr := &service.ValidationError{}
+			verr.Add("limit", "must be a positive integer")
+			writeError(w, verr)
+			return
+		}
+	}
+
+	deliveries, err := h.webhookService.WebhookDeliveries(id, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"webhookId":  id,
+		"deliveries": deliveries,
+	})
+}
+
+// parseWebhookID reads the {id} path variable. An ID that cannot exist is
+// reported as not found, like any other unknown webhook.
+func parseWebhookID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		return 0, service.ErrWebhookNotFound
+	}
+	return uint(id), nil
+}
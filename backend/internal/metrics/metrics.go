@@ -0,0 +1,69 @@
+// Package metrics defines the Prometheus metrics served on /metrics. Gauges
+// that read the state of a service are registered by the service itself.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Namespace prefixes every metric of the service
+const Namespace = "student_import"
+
+var (
+	Uploads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "uploads_total",
+		Help:      "Upload requests accepted for import, excluding dry runs.",
+	})
+	UploadedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "uploaded_files_total",
+		Help:      "Files saved from upload requests, including dry runs, counting an archive as one file.",
+	})
+	BytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "upload_bytes_received_total",
+		Help:      "Bytes of uploaded files saved, including dry runs, before decompression.",
+	})
+	UploadedFileSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "uploaded_file_size_bytes",
+		Help:      "Size of each uploaded file, before decompression.",
+		Buckets:   prometheus.ExponentialBuckets(1<<10, 4, 10), // 1KiB to 256MiB
+	})
+
+	JobsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "jobs_finished_total",
+		Help:      "Import jobs that completed, failed or were cancelled, by final status.",
+	}, []string{"status"})
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time from the start of processing, or from creation for jobs never processed, until an import job finished, by final status.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14), // 100ms to about 14 minutes
+	}, []string{"status"})
+
+	RowsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rows_processed_total",
+		Help:      "Rows handled by import jobs, whether inserted, rejected or skipped as duplicates.",
+	})
+	RowsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rows_rejected_total",
+		Help:      "Rows that failed parsing or validation.",
+	})
+	RowsInserted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rows_inserted_total",
+		Help:      "Rows written to the students table, including rows overwritten with on_conflict=update.",
+	})
+	BatchInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "batch_insert_duration_seconds",
+		Help:      "Time to write and commit one batch of rows, by outcome (ok or error).",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to about 10s
+	}, []string{"outcome"})
+)
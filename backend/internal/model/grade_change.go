@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// GradeChange records one change to a stored grade: an overwrite, or a
+// student created or deleted through the API. Rows are only ever appended, so
+// they form an audit trail of who changed which grade and when.
+type GradeChange struct {
+	ID        uint      `gorm:"primaryKey"`
+	StudentID string    `gorm:"index"`
+	Action    string    `gorm:"default:update"` // "create", "update" or "delete"
+	OldGrade  int       // 0 for a create
+	NewGrade  int       // 0 for a delete
+	Source    string    // "import", "api" or "rollback"
+	JobID     string    // import job that made the change, or that was rolled back
+	ChangedBy string    // user given with an API request, if any
+	ChangedAt time.Time `gorm:"index"`
+}
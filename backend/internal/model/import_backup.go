@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// ImportBackup holds the values a student had before an import job
+// overwrote them, so the job can be rolled back
+type ImportBackup struct {
+	JobID         string `gorm:"primaryKey"` // job that overwrote the student
+	StudentID     string `gorm:"primaryKey"`
+	StudentName   string
+	Subject       string
+	Grade         int
+	ImportJobID   string // origin of the previous values
+	ImportBatchID string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
@@ -1,8 +1,14 @@
 package model
 
+import "time"
+
 type Student struct {
-	StudentID   string `gorm:"primaryKey"` // StudentID is the primary key
-	StudentName string
-	Subject     string
-	Grade       int
+	StudentID     string `gorm:"primaryKey"` // StudentID is the primary key
+	StudentName   string
+	Subject       string
+	Grade         int
+	ImportJobID   string    `gorm:"index"` // Upload job that last wrote the row, empty if created or edited another way
+	ImportBatchID string    `gorm:"index"` // Upload batch that job belonged to
+	CreatedAt     time.Time `gorm:"index"`
+	UpdatedAt     time.Time `gorm:"index"`
 }
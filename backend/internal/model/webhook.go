@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Webhook is a URL that is notified when import jobs finish
+type Webhook struct {
+	ID        uint     `gorm:"primaryKey"`
+	URL       string   `gorm:"not null"`
+	Secret    string   `gorm:"not null" json:"-"` // signs the payloads; only shown when the webhook is created
+	Events    []string `gorm:"serializer:json"`   // event types to send, all of them if empty
+	CreatedAt time.Time
+}
+
+// WebhookDelivery records one attempt to send an event to a webhook
+type WebhookDelivery struct {
+	ID         uint   `gorm:"primaryKey"`
+	WebhookID  uint   `gorm:"index"`
+	DeliveryID string `gorm:"index"` // the same for every attempt to send one event
+	Event      string
+	JobID      string
+	Attempt    int
+	StatusCode int    // 0 if no response was received
+	Error      string // why the attempt failed, if it did
+	DurationMs int64  // how long the attempt took
+	Payload    string
+	CreatedAt  time.Time `gorm:"index"`
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Limits on what an uploaded archive may expand to, so a small zip bomb can
+// neither fill the disk nor queue more jobs than the server can handle. Sizes
+// are checked against the bytes actually extracted, not the sizes the archive
+// declares.
+const (
+	maxArchiveEntrySize = 2 << 30 // 2GB for a single entry
+	maxArchiveSize      = 4 << 30 // 4GB for all entries together
+	maxArchiveEntries   = 1000    // data files, each of which becomes a job
+)
+
+// archiveExtensions are the entry types extracted from an archive; anything else is ignored
+var archiveExtensions = map[string]bool{
+	".csv": true, ".tsv": true, ".txt": true, ".xlsx": true, ".ndjson": true, ".jsonl": true, ".gz": true,
+}
+
+// ArchiveEntry is a data file extracted from an uploaded archive
+type ArchiveEntry struct {
+	Name string // path of the entry inside the archive
+	Path string // where it was extracted to
+}
+
+// IsArchiveReader reports whether r holds a zip archive of data files, such
+// as an uploaded multipart file. XLSX workbooks are zip files too, but are
+// recognized by their content types part.
+func IsArchiveReader(r io.ReaderAt, size int64) bool {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	return isDataArchive(archive)
+}
+
+func isDataArchive(archive *zip.Reader) bool {
+	for _, entry := range archive.File {
+		if entry.Name == "[Content_Types].xml" {
+			return false
+		}
+	}
+	return true
+}
+
+// ExtractArchive extracts the data files in a zip archive into destDir and
+// returns them in archive order. Directory structure is flattened, so entry
+// names never escape destDir, and gzip members are stored decompressed.
+// Archives over the entry count or size limits are rejected.
+func ExtractArchive(archivePath, destDir string) ([]ArchiveEntry, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	var dataFiles []int
+	var declaredSize uint64
+	for i, entry := range archive.File {
+		name := path.Clean(entry.Name)
+		base := path.Base(name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		if !archiveExtensions[strings.ToLower(path.Ext(base))] {
+			continue
+		}
+		dataFiles = append(dataFiles, i)
+		declaredSize += entry.UncompressedSize64
+	}
+	if len(dataFiles) == 0 {
+		return nil, fmt.Errorf("archive contains no supported data files")
+	}
+	if len(dataFiles) > maxArchiveEntries {
+		return nil, fmt.Errorf("archive contains %d data files, more than the limit of %d", len(dataFiles), maxArchiveEntries)
+	}
+	if declaredSize > maxArchiveSize {
+		return nil, fmt.Errorf("archive expands to more than %d bytes", int64(maxArchiveSize))
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries := make([]ArchiveEntry, 0, len(dataFiles))
+	remaining := int64(maxArchiveSize)
+	for _, i := range dataFiles {
+		entry := archive.File[i]
+		name := path.Clean(entry.Name)
+
+		// Prefix with the entry index so equal names in different folders do not collide
+		base := path.Base(name)
+		if strings.EqualFold(path.Ext(base), ".gz") {
+			base = base[:len(base)-len(".gz")]
+		}
+		destPath := filepath.Join(destDir, fmt.Sprintf("%d-%s", i, base))
+		written, err := extractEntry(entry, destPath, min(maxArchiveEntrySize, remaining))
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", entry.Name, err)
+		}
+		remaining -= written
+		entries = append(entries, ArchiveEntry{Name: name, Path: destPath})
+	}
+	return entries, nil
+}
+
+// extractEntry writes entry to destPath, failing once it exceeds limit bytes,
+// and returns how many bytes it wrote. Gzip content is decompressed first, as
+// it would otherwise pass the limits while still compressed; so is gzip
+// inside gzip, which the importer would not look through.
+func extractEntry(entry *zip.File, destPath string, limit int64) (int64, error) {
+	reader, err := entry.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	data := bufio.NewReader(reader)
+	for isGzip(data) {
+		gzipReader, err := gzip.NewReader(data)
+		if err != nil {
+			return 0, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		defer gzipReader.Close()
+		data = bufio.NewReader(gzipReader)
+	}
+
+	outFile, err := os.Create(destPath)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	written, err := io.CopyN(outFile, data, limit+1)
+	if err != nil && err != io.EOF {
+		return written, err
+	}
+	if written > limit {
+		if limit < maxArchiveEntrySize {
+			return written, fmt.Errorf("archive expands to more than %d bytes", int64(maxArchiveSize))
+		}
+		return written, fmt.Errorf("entry expands to more than %d bytes", int64(maxArchiveEntrySize))
+	}
+	return written, nil
+}
+
+// gzipReadCloser closes both the gzip stream and the file underneath it
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// openDecompressed opens filePath, transparently decompressing gzip content
+// so callers always read the original data
+func openDecompressed(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	if !isGzip(buffered) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{buffered, file}, nil
+	}
+
+	gzipReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid gzip data: %w", err)
+	}
+	return &gzipReadCloser{Reader: gzipReader, file: file}, nil
+}
+
+// isGzip reports whether r starts with the gzip magic number
+func isGzip(r *bufio.Reader) bool {
+	magic, _ := r.Peek(2)
+	return len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// dataSize returns the size of the data in filePath once decompressed. For
+// gzip files this is read from the trailer, which holds the size modulo 4GB;
+// a smaller value than the compressed size means it wrapped and the
+// compressed size is used instead.
+func dataSize(filePath string) (int64, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(file, magic); err != nil || magic[0] != 0x1f || magic[1] != 0x8b || fileInfo.Size() < 18 {
+		return fileInfo.Size(), nil
+	}
+
+	trailer := make([]byte, 4)
+	if _, err := file.ReadAt(trailer, fileInfo.Size()-4); err != nil {
+		return fileInfo.Size(), nil
+	}
+	if size := int64(binary.LittleEndian.Uint32(trailer)); size > fileInfo.Size() {
+		return size, nil
+	}
+	return fileInfo.Size(), nil
+}
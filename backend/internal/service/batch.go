@@ -0,0 +1,194 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrBatchNotFound = errors.New("batch not found")
+
+// batchInfo groups the jobs created from one upload request
+type batchInfo struct {
+	jobIDs     []string
+	receivedAt time.Time // when the request arrived
+	uploadedAt time.Time // when all its files were saved
+	err        string    // why saving the files failed
+}
+
+// BatchSummary aggregates the jobs of a batch
+type BatchSummary struct {
+	BatchID      string         `json:"batch_id"`
+	Status       string         `json:"status"` // see batchStatus
+	Error        string         `json:"error"`
+	JobIDs       []string       `json:"job_ids"`
+	JobsByStatus map[string]int `json:"jobs_by_status"`
+	TotalRecords int            `json:"total_records"`
+	Processed    int            `json:"processed"`
+	Rejected     int            `json:"rejected"`
+	Duplicates   int            `json:"duplicates"`
+	Percentage   float64        `json:"percentage"`
+	ReceivedAt   time.Time      `json:"received_at"`
+	UploadedAt   *time.Time     `json:"uploaded_at"`
+	FinishedAt   *time.Time     `json:"finished_at"`
+
+	UploadSeconds     float64 `json:"upload_seconds"`     // receiving and saving the files
+	ProcessingSeconds float64 `json:"processing_seconds"` // summed over the jobs, so it exceeds the wall-clock time when they run in parallel
+	WallClockSeconds  float64 `json:"wall_clock_seconds"` // from receiving the request until the last job finished, or until now
+}
+
+// CreateBatch starts a batch for an upload request received at receivedAt and
+// returns its ID. Jobs created with the ID join the batch.
+func (s *UploadService) CreateBatch(receivedAt time.Time) string {
+	batchID := NewID()
+
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+	s.evictFinished(time.Now())
+	s.batches[batchID] = &batchInfo{receivedAt: receivedAt}
+	return batchID
+}
+
+// BatchUploaded records that every file of a batch has been saved
+func (s *UploadService) BatchUploaded(batchID string) {
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+
+	if batch, exists := s.batches[batchID]; exists {
+		batch.uploadedAt = time.Now()
+	}
+}
+
+// FailBatch records that the files of a batch could not all be saved, and
+// fails its jobs that have not finished, since none of them will be processed
+func (s *UploadService) FailBatch(batchID, errorMsg string) {
+	s.fileProgressLock.Lock()
+	batch, exists := s.batches[batchID]
+	if !exists {
+		s.fileProgressLock.Unlock()
+		return
+	}
+	batch.err = errorMsg
+	var active []string
+	for _, jobID := range batch.jobIDs {
+		if progress := s.fileProgressMap[jobID]; progress != nil && progress.IsActive() {
+			active = append(active, jobID)
+		}
+	}
+	s.fileProgressLock.Unlock()
+
+	for _, jobID := range active {
+		s.FailJob(jobID, "Upload failed: "+errorMsg)
+	}
+}
+
+// GetBatch returns the current state of a batch
+func (s *UploadService) GetBatch(batchID string) (*BatchSummary, error) {
+	s.fileProgressLock.RLock()
+	defer s.fileProgressLock.RUnlock()
+
+	batch, exists := s.batches[batchID]
+	if !exists {
+		return nil, ErrBatchNotFound
+	}
+	return s.summarizeBatch(batchID, batch, time.Now()), nil
+}
+
+// summarizeBatch must be called with fileProgressLock held
+func (s *UploadService) summarizeBatch(batchID string, batch *batchInfo, now time.Time) *BatchSummary {
+	summary := &BatchSummary{
+		BatchID:      batchID,
+		Error:        batch.err,
+		JobIDs:       append([]string{}, batch.jobIDs...),
+		JobsByStatus: make(map[string]int),
+		ReceivedAt:   batch.receivedAt,
+	}
+
+	var finishedAt time.Time
+	for _, jobID := range batch.jobIDs {
+		progress := s.fileProgressMap[jobID]
+		if progress == nil {
+			continue
+		}
+		summary.JobsByStatus[progress.Status]++
+		summary.TotalRecords += progress.TotalRecords
+		summary.Processed += progress.Processed
+		summary.Rejected += progress.Rejected
+		summary.Duplicates += progress.Duplicates
+
+		switch {
+		case progress.Status == StatusProcessing:
+			summary.ProcessingSeconds += now.Sub(progress.StartTime).Seconds()
+		case !progress.IsActive():
+			summary.ProcessingSeconds += progress.EndTime.Sub(progress.StartTime).Seconds()
+			if progress.EndTime.After(finishedAt) {
+				finishedAt = progress.EndTime
+			}
+		}
+	}
+	if summary.TotalRecords > 0 {
+		summary.Percentage = float64(summary.Processed) / float64(summary.TotalRecords) * 100
+	}
+	summary.Status = batchStatus(summary, batch)
+
+	uploadEnd := now
+	if !batch.uploadedAt.IsZero() {
+		uploaded := batch.uploadedAt
+		summary.UploadedAt = &uploaded
+		uploadEnd = uploaded
+	}
+	summary.UploadSeconds = uploadEnd.Sub(batch.receivedAt).Seconds()
+
+	end := now
+	if summary.Status == StatusCompleted || summary.Status == StatusError || summary.Status == StatusCancelled {
+		if finishedAt.IsZero() {
+			// Saving failed before any job was created
+			finishedAt = batch.receivedAt
+		}
+		summary.FinishedAt = &finishedAt
+		end = finishedAt
+	}
+	summary.WallClockSeconds = end.Sub(batch.receivedAt).Seconds()
+	return summary
+}
+
+// batchStatus is uploading until every file is saved, then processing while
+// any job is queued or processing. A finished batch is completed if all of
+// its jobs completed, failed if saving the files or any job failed, and
+// cancelled otherwise.
+func batchStatus(summary *BatchSummary, batch *batchInfo) string {
+	jobs := summary.JobsByStatus
+	switch {
+	case batch.err != "" && jobs[StatusUploading]+jobs[StatusQueued]+jobs[StatusProcessing] == 0:
+		return StatusError
+	case batch.uploadedAt.IsZero() || jobs[StatusUploading] > 0:
+		return StatusUploading
+	case jobs[StatusQueued]+jobs[StatusProcessing] > 0:
+		return StatusProcessing
+	case jobs[StatusError] > 0:
+		return StatusError
+	case jobs[StatusCancelled] > 0:
+		return StatusCancelled
+	default:
+		return StatusCompleted
+	}
+}
+
+// GetBatches returns the current state of the given batches, in order,
+// skipping duplicates and unknown IDs
+func (s *UploadService) GetBatches(batchIDs []string) []BatchSummary {
+	s.fileProgressLock.RLock()
+	defer s.fileProgressLock.RUnlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	summaries := make([]BatchSummary, 0)
+	for _, batchID := range batchIDs {
+		batch, exists := s.batches[batchID]
+		if !exists || seen[batchID] {
+			continue
+		}
+		seen[batchID] = true
+		summaries = append(summaries, *s.summarizeBatch(batchID, batch, now))
+	}
+	return summaries
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"backend/internal/model"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// columnAliases maps normalized header names to the column they describe
+var columnAliases = map[string]string{
+	"studentid":   "student_id",
+	"id":          "student_id",
+	"studentname": "student_name",
+	"name":        "student_name",
+	"subject":     "subject",
+	"grade":       "grade",
+}
+
+// columnMap holds the position of each expected column in a record
+type columnMap struct {
+	StudentID   int
+	StudentName int
+	Subject     int
+	Grade       int
+}
+
+// defaultColumns is the positional layout: student ID, name, subject, grade
+var defaultColumns = columnMap{StudentID: 0, StudentName: 1, Subject: 2, Grade: 3}
+
+// mapColumns resolves column positions from a header row. Headers such as
+// "StudentID", "student_id" and "Student Name" are all recognized. A header
+// with none of the known names falls back to the positional layout; a header
+// with only some of them is rejected.
+func mapColumns(header []string) (columnMap, error) {
+	positions := make(map[string]int)
+	for i, name := range header {
+		if column, ok := columnAliases[normalizeColumnName(name)]; ok {
+			if _, seen := positions[column]; !seen {
+				positions[column] = i
+			}
+		}
+	}
+
+	if len(positions) == 0 {
+		return defaultColumns, nil
+	}
+
+	var missing []string
+	for _, column := range []string{"student_id", "student_name", "subject", "grade"} {
+		if _, ok := positions[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		return columnMap{}, fmt.Errorf("missing required column(s): %s", strings.Join(missing, ", "))
+	}
+
+	return columnMap{
+		StudentID:   positions["student_id"],
+		StudentName: positions["student_name"],
+		Subject:     positions["subject"],
+		Grade:       positions["grade"],
+	}, nil
+}
+
+// normalizeColumnName lowercases a header name and strips separators so that
+// "Student ID", "student_id" and "StudentID" compare equal
+func normalizeColumnName(name string) string {
+	return strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// width is the minimum number of fields a record needs for this mapping
+func (c columnMap) width() int {
+	return max(c.StudentID, c.StudentName, c.Subject, c.Grade) + 1
+}
+
+// studentID returns the student ID field of record, or "" if the record is too short
+func (c columnMap) studentID(record []string) string {
+	if c.StudentID < len(record) {
+		return record[c.StudentID]
+	}
+	return ""
+}
+
+// parseStudent converts a record into a Student. Fields are stored as they
+// are; a short record, or a row failing ParseGrade or validateStudent, is
+// rejected, as the API would reject the same student.
+func (c columnMap) parseStudent(record []string) (model.Student, error) {
+	if len(record) < c.width() {
+		return model.Student{}, fmt.Errorf("expected at least %d columns, got %d", c.width(), len(record))
+	}
+
+	grade, err := ParseGrade(record[c.Grade])
+	if err != nil {
+		return model.Student{}, err
+	}
+	student := model.Student{
+		StudentID:   record[c.StudentID],
+		StudentName: record[c.StudentName],
+		Subject:     record[c.Subject],
+		Grade:       grade,
+	}
+	if verr := validateStudent(student); verr != nil {
+		fieldErr := verr.Errors[0]
+		return model.Student{}, fmt.Errorf("%s %s", fieldErr.Field, fieldErr.Message)
+	}
+
+	return student, nil
+}
+
+// valid reports whether record takes part in duplicate resolution: it would
+// be imported. Other rows are left for the workers to reject.
+func (c columnMap) valid(record []string) bool {
+	_, err := c.parseStudent(record)
+	return err == nil
+}
+
+// openSource opens a file as a RecordSource and consumes its header row.
+// Columns are positional unless opts.MapColumns is set, in which case they
+// are found by name in the header. Files without a header use the positional
+// layout and keep their first record.
+func openSource(filePath string, opts ImportOptions) (RecordSource, columnMap, error) {
+	source, err := openRecordSource(filePath, opts)
+	if err != nil {
+		return nil, columnMap{}, err
+	}
+
+	first, line, err := source.Read()
+	if err == io.EOF {
+		return source, defaultColumns, nil
+	}
+	if err != nil {
+		source.Close()
+		return nil, columnMap{}, fmt.Errorf("failed to read first record: %w", err)
+	}
+
+	hasHeader := looksLikeHeader(first)
+	if opts.Dialect.Header != nil {
+		hasHeader = *opts.Dialect.Header
+	}
+	if !hasHeader {
+		return &pushbackSource{RecordSource: source, record: first, line: line, pending: true}, defaultColumns, nil
+	}
+
+	if !opts.MapColumns {
+		return source, defaultColumns, nil
+	}
+	cols, err := mapColumns(first)
+	if err != nil {
+		source.Close()
+		return nil, columnMap{}, err
+	}
+
+	return source, cols, nil
+}
+
+// pushbackSource returns a record that was already read before continuing with the source
+type pushbackSource struct {
+	RecordSource
+	record  []string
+	line    int
+	pending bool
+}
+
+func (p *pushbackSource) Read() ([]string, int, error) {
+	if p.pending {
+		p.pending = false
+		return p.record, p.line, nil
+	}
+	return p.RecordSource.Read()
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// dialectSniffLines is how many lines are inspected when guessing a delimiter
+const dialectSniffLines = 20
+
+// sniffDelimiters are the delimiters considered when none is given, in order of preference
+var sniffDelimiters = []rune{',', ';', '\t', '|'}
+
+// Dialect describes how a delimited text file is laid out. Zero values mean
+// "use the default"; Delimiter and Header are sniffed from the file when unset.
+type Dialect struct {
+	Delimiter  rune  // field separator; 0 sniffs it from the file
+	Quote      rune  // quote character, '"' or '\''; 0 means '"'
+	Header     *bool // whether the first record is a header; nil sniffs it
+	Comment    rune  // lines starting with this character are ignored; 0 disables comments
+	TrimSpace  bool  // trim leading and trailing spaces from every field
+	LazyQuotes bool  // allow quotes inside unquoted fields and unescaped quotes in quoted fields
+	SkipLines  int   // physical lines to discard before the first record
+}
+
+// ParseChar converts a form value naming a single character, such as a
+// delimiter or comment marker, into a rune. "tab" and "\t" are accepted for
+// tabs; an empty value returns 0 so the default applies.
+func ParseChar(name, value string) (rune, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+
+	runes := []rune(value)
+	if len(runes) != 1 || runes[0] == '\r' || runes[0] == '\n' || runes[0] == utf8.RuneError {
+		return 0, fmt.Errorf("invalid %s %q: must be a single character other than a newline", name, value)
+	}
+	return runes[0], nil
+}
+
+// ParseQuote converts a form value into a quote character. Only double and
+// single quotes are supported.
+func ParseQuote(value string) (rune, error) {
+	switch value {
+	case "", `"`, "double":
+		return '"', nil
+	case "'", "single":
+		return '\'', nil
+	}
+	return 0, fmt.Errorf(`invalid quote %q: must be " or '`, value)
+}
+
+// ParseHeader converts a form value into a header setting: true, false, or
+// nil for "auto"/empty to sniff it
+func ParseHeader(value string) (*bool, error) {
+	if value == "" || strings.EqualFold(value, "auto") {
+		return nil, nil
+	}
+	header, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header %q: must be true, false or auto", value)
+	}
+	return &header, nil
+}
+
+// Validate checks that the dialect settings do not conflict with each other
+func (d Dialect) Validate() error {
+	if d.Delimiter == '"' || d.Delimiter == '\'' || d.Comment == '"' || d.Comment == '\'' {
+		return fmt.Errorf("delimiter and comment character must not be quotes")
+	}
+	if d.Delimiter != 0 && d.Delimiter == d.Comment {
+		return fmt.Errorf("delimiter must differ from the comment character")
+	}
+	if d.SkipLines < 0 {
+		return fmt.Errorf("skip_lines must not be negative")
+	}
+	return nil
+}
+
+func (d Dialect) quote() rune {
+	if d.Quote == 0 {
+		return '"'
+	}
+	return d.Quote
+}
+
+// skipLines discards n physical lines from reader
+func skipLines(reader *bufio.Reader, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sniffDelimiter guesses the field separator from the first lines of text. A
+// candidate that splits every line into the same number of fields wins; ties
+// go to the candidate producing more fields, then to the earlier candidate.
+func sniffDelimiter(text []byte, quote, comment rune) rune {
+	var lines []string
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || (comment != 0 && strings.HasPrefix(line, string(comment))) {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == dialectSniffLines {
+			break
+		}
+	}
+	if len(lines) == 0 {
+		return ','
+	}
+
+	best, bestConsistent, bestCount := ',', 0, 0
+	for _, candidate := range sniffDelimiters {
+		counts := make(map[int]int)
+		for _, line := range lines {
+			counts[countOutsideQuotes(line, candidate, quote)]++
+		}
+
+		// The most common per-line count, and how many lines have it
+		mode, consistent := 0, 0
+		for count, lineCount := range counts {
+			if count > 0 && (lineCount > consistent || (lineCount == consistent && count > mode)) {
+				mode, consistent = count, lineCount
+			}
+		}
+		if consistent > bestConsistent || (consistent == bestConsistent && consistent > 0 && mode > bestCount) {
+			best, bestConsistent, bestCount = candidate, consistent, mode
+		}
+	}
+	return best
+}
+
+// countOutsideQuotes counts occurrences of r in line that are not inside quotes
+func countOutsideQuotes(line string, r, quote rune) int {
+	count, quoted := 0, false
+	for _, c := range line {
+		switch {
+		case c == quote:
+			quoted = !quoted
+		case c == r && !quoted:
+			count++
+		}
+	}
+	return count
+}
+
+// looksLikeHeader guesses whether the first record of a file is a header: it
+// is if it names any known column, and is not if it has a numeric grade in the
+// positional grade column. Anything else is treated as a header, as before
+// headers could be switched off.
+func looksLikeHeader(record []string) bool {
+	for _, name := range record {
+		if _, ok := columnAliases[normalizeColumnName(name)]; ok {
+			return true
+		}
+	}
+	if len(record) > defaultColumns.Grade {
+		if _, err := strconv.Atoi(strings.TrimSpace(record[defaultColumns.Grade])); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteSwapReader swaps single and double quotes, letting encoding/csv (which
+// only understands double quotes) parse files quoted with single quotes. Both
+// are ASCII, so swapping bytes never breaks a UTF-8 sequence.
+type quoteSwapReader struct {
+	reader io.Reader
+}
+
+func (q quoteSwapReader) Read(p []byte) (int, error) {
+	n, err := q.reader.Read(p)
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case '"':
+			p[i] = '\''
+		case '\'':
+			p[i] = '"'
+		}
+	}
+	return n, err
+}
+
+// swapQuotes undoes quoteSwapReader on a parsed field
+func swapQuotes(field string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '"':
+			return '\''
+		case '\'':
+			return '"'
+		}
+		return r
+	}, field)
+}
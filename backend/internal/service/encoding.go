@@ -0,0 +1,131 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// encodingSniffSize is how much of a file is inspected to guess its encoding
+const encodingSniffSize = 64 * 1024
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// ParseEncoding validates a declared character encoding such as "utf-8",
+// "windows-1252", "latin1" or "utf-16le" and returns its canonical name. An
+// empty value selects detection.
+func ParseEncoding(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "auto") {
+		return "", nil
+	}
+
+	enc, err := htmlindex.Get(value)
+	if err != nil {
+		return "", fmt.Errorf("unsupported encoding %q", value)
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		return "", fmt.Errorf("unsupported encoding %q", value)
+	}
+	return name, nil
+}
+
+// decodeText wraps r so that it yields UTF-8 without a byte order mark. If
+// declared is empty the encoding is taken from a BOM when there is one, and
+// otherwise guessed from the first bytes: valid UTF-8 is kept as is, text with
+// NUL bytes in alternate positions is read as UTF-16, and anything else is
+// treated as Windows-1252, the usual encoding of spreadsheet exports.
+func decodeText(r io.Reader, declared string) (io.Reader, error) {
+	buffered := bufio.NewReaderSize(r, encodingSniffSize)
+	head, err := buffered.Peek(encodingSniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	var enc encoding.Encoding
+	if declared != "" {
+		enc, err = htmlindex.Get(declared)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported encoding %q", declared)
+		}
+	} else {
+		enc = detectEncoding(head)
+	}
+
+	switch enc {
+	case unicode.UTF8, encoding.Nop:
+		// Nothing to transcode, but a BOM would end up inside the first header name
+		if bytes.HasPrefix(head, bomUTF8) {
+			buffered.Discard(len(bomUTF8))
+		}
+		return buffered, nil
+	case unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM):
+		// Let the decoder consume a BOM if present, falling back to the declared byte order
+		endianness := unicode.LittleEndian
+		if enc == unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM) {
+			endianness = unicode.BigEndian
+		}
+		enc = unicode.UTF16(endianness, unicode.ExpectBOM)
+		if !bytes.HasPrefix(head, bomUTF16LE) && !bytes.HasPrefix(head, bomUTF16BE) {
+			enc = unicode.UTF16(endianness, unicode.IgnoreBOM)
+		}
+	}
+
+	return transform.NewReader(buffered, enc.NewDecoder()), nil
+}
+
+// detectEncoding guesses the encoding of a file from its first bytes
+func detectEncoding(head []byte) encoding.Encoding {
+	switch {
+	case bytes.HasPrefix(head, bomUTF8):
+		return unicode.UTF8
+	case bytes.HasPrefix(head, bomUTF16LE):
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case bytes.HasPrefix(head, bomUTF16BE):
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+
+	// ASCII text encoded as UTF-16 has a NUL in every other byte
+	if len(head) >= 4 {
+		var evenNULs, oddNULs int
+		for i, b := range head {
+			if b == 0 {
+				if i%2 == 0 {
+					evenNULs++
+				} else {
+					oddNULs++
+				}
+			}
+		}
+		if oddNULs > len(head)/4 && evenNULs == 0 {
+			return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+		}
+		if evenNULs > len(head)/4 && oddNULs == 0 {
+			return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+		}
+	}
+
+	// The sample may end in the middle of a multi-byte character
+	sample := head
+	for i := 0; i < utf8.UTFMax-1 && len(sample) > 0 && !utf8.Valid(sample); i++ {
+		sample = sample[:len(sample)-1]
+	}
+	if utf8.Valid(sample) {
+		return unicode.UTF8
+	}
+	return charmap.Windows1252
+}
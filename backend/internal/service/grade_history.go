@@ -0,0 +1,74 @@
+package service
+
+import (
+	"backend/internal/model"
+	"gorm.io/gorm"
+)
+
+// Sources of grade changes
+const (
+	GradeSourceImport   = "import"
+	GradeSourceAPI      = "api"
+	GradeSourceRollback = "rollback"
+)
+
+// Kinds of grade changes
+const (
+	GradeActionCreate = "create"
+	GradeActionUpdate = "update"
+	GradeActionDelete = "delete"
+)
+
+// GradeHistory returns the recorded grade changes of a student, oldest first.
+// History outlives the student, so a deleted student still has one; only a
+// student that neither exists nor has history is not found.
+func (s *StudentService) GradeHistory(studentID string) ([]model.GradeChange, error) {
+	history := []model.GradeChange{}
+	if err := s.db.Where("student_id = ?", studentID).Order("changed_at, id").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		if _, err := s.GetStudent(studentID); err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// recordImportGradeChanges records the grades an import batch is about to
+// overwrite. It must run in the batch's transaction, before the upsert.
+func recordImportGradeChanges(tx *gorm.DB, jobID string, students []model.Student, ids []string) error {
+	var current []struct {
+		StudentID string
+		Grade     int
+	}
+	if err := tx.Model(&model.Student{}).Select("student_id, grade").Where("student_id IN ?", ids).Scan(&current).Error; err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	stored := make(map[string]int, len(current))
+	for _, row := range current {
+		stored[row.StudentID] = row.Grade
+	}
+	var changes []model.GradeChange
+	for _, student := range students {
+		if oldGrade, ok := stored[student.StudentID]; ok && oldGrade != student.Grade {
+			changes = append(changes, model.GradeChange{
+				StudentID: student.StudentID,
+				Action:    GradeActionUpdate,
+				OldGrade:  oldGrade,
+				NewGrade:  student.Grade,
+				Source:    GradeSourceImport,
+				JobID:     jobID,
+				ChangedAt: student.UpdatedAt,
+			})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(changes, 500).Error
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// progressReplaySize is how many progress events are kept for clients that
+// reconnect; one that falls further behind gets a fresh snapshot instead
+const progressReplaySize = 1024
+
+// progressQueueSize is how many events a subscriber can have waiting before
+// the bus coalesces or drops them
+const progressQueueSize = 256
+
+// ProgressEvent is a progress update with its position in the event sequence.
+// IDs start at 1 and increase by one per event. Progress is a copy of the job's
+// state that nothing else refers to, so it can be read without locking.
+type ProgressEvent struct {
+	ID       uint64
+	Time     time.Time // when the event was broadcast
+	Progress ProgressInfo
+}
+
+// ProgressBusStats counts what happened to progress events since the service started
+type ProgressBusStats struct {
+	Subscribers int // progress streams opened by clients
+	Watchers    int // the service's own subscriptions, such as the webhook sender
+	Published   uint64
+	Coalesced   uint64 // replaced in a full queue by a newer event for the same job
+	Dropped     uint64 // pushed out of a full queue, forcing the subscriber to resync
+}
+
+// progressBus hands each published event to every subscriber's queue and
+// keeps the latest events for replay. Publishing never waits for subscribers.
+type progressBus struct {
+	lock        sync.Mutex
+	subscribers map[*ProgressSubscription]bool // true for watchers
+	events      []ProgressEvent                // replay ring buffer, indexed by (ID-1) % progressReplaySize
+	lastEventID uint64
+	stats       ProgressBusStats
+}
+
+func newProgressBus() *progressBus {
+	return &progressBus{
+		subscribers: make(map[*ProgressSubscription]bool),
+		events:      make([]ProgressEvent, progressReplaySize),
+	}
+}
+
+func (b *progressBus) publish(progress *ProgressInfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastEventID++
+	event := ProgressEvent{ID: b.lastEventID, Time: time.Now(), Progress: progress.clone()}
+	b.events[(event.ID-1)%progressReplaySize] = event
+	b.stats.Published++
+
+	for subscriber := range b.subscribers {
+		subscriber.push(event)
+	}
+}
+
+// ProgressSubscription is a subscriber's queue of progress events. Receive
+// from C, then call Next to collect the queued events.
+type ProgressSubscription struct {
+	C <-chan struct{}
+
+	bus    *progressBus
+	signal chan struct{}
+	queue  []ProgressEvent // guarded by bus.lock
+	gap    bool            // events were dropped since the last Next
+}
+
+// push queues event, making room if the queue is full. It must be called with
+// bus.lock held.
+func (s *ProgressSubscription) push(event ProgressEvent) {
+	if len(s.queue) >= progressQueueSize {
+		// Remove the oldest state that a later one of the same job supersedes,
+		// unless it is final. Failing that, something has to be lost.
+		latest := make(map[string]int) // position of each job's latest state
+		for i, queued := range s.queue {
+			latest[queued.Progress.JobID] = i
+		}
+		latest[event.Progress.JobID] = len(s.queue)
+		superseded := -1
+		for i, queued := range s.queue {
+			if queued.Progress.IsActive() && latest[queued.Progress.JobID] > i {
+				superseded = i
+				break
+			}
+		}
+		if superseded >= 0 {
+			s.queue = append(s.queue[:superseded], s.queue[superseded+1:]...)
+			s.bus.stats.Coalesced++
+		} else {
+			s.queue = s.queue[1:]
+			s.gap = true
+			s.bus.stats.Dropped++
+		}
+	}
+	s.queue = append(s.queue, event)
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+		// Already signalled; the subscriber will collect this event with the others
+	}
+}
+
+// Next returns the queued events in order and empties the queue. ok is false
+// if some were dropped because the subscriber fell behind, in which case it
+// should start over from ProgressSnapshot and skip events it already reflects.
+func (s *ProgressSubscription) Next() (events []ProgressEvent, ok bool) {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	events, ok = s.queue, !s.gap
+	s.queue, s.gap = nil, false
+	return events, ok
+}
+
+// Close ends the subscription
+func (s *ProgressSubscription) Close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	delete(s.bus.subscribers, s)
+	s.bus.countSubscribers()
+}
+
+// countSubscribers updates the subscriber counts. It must be called with lock held.
+func (b *progressBus) countSubscribers() {
+	b.stats.Subscribers, b.stats.Watchers = 0, 0
+	for _, watcher := range b.subscribers {
+		if watcher {
+			b.stats.Watchers++
+		} else {
+			b.stats.Subscribers++
+		}
+	}
+}
+
+// SubscribeProgress starts queueing every progress event for the caller, who
+// must Close the subscription when done
+func (s *UploadService) SubscribeProgress() *ProgressSubscription {
+	return s.subscribeProgress(false)
+}
+
+// subscribeProgress is SubscribeProgress for clients, or with watcher set for
+// the service's own consumers, which are counted apart
+func (s *UploadService) subscribeProgress(watcher bool) *ProgressSubscription {
+	signal := make(chan struct{}, 1)
+	subscription := &ProgressSubscription{C: signal, bus: s.progressBus, signal: signal}
+
+	s.progressBus.lock.Lock()
+	defer s.progressBus.lock.Unlock()
+	s.progressBus.subscribers[subscription] = watcher
+	s.progressBus.countSubscribers()
+	return subscription
+}
+
+// ProgressBusStats returns the event counters of the progress bus
+func (s *UploadService) ProgressBusStats() ProgressBusStats {
+	s.progressBus.lock.Lock()
+	defer s.progressBus.lock.Unlock()
+	return s.progressBus.stats
+}
+
+// ProgressEventsSince returns the buffered events after the one with the given
+// ID. ok is false if some of them have already left the replay buffer, in
+// which case the caller should start over from ProgressSnapshot.
+func (s *UploadService) ProgressEventsSince(id uint64) (events []ProgressEvent, ok bool) {
+	bus := s.progressBus
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	// An ID from the future was issued before a restart
+	if id >= bus.lastEventID {
+		return nil, id == bus.lastEventID
+	}
+	if bus.lastEventID > progressReplaySize && id < bus.lastEventID-progressReplaySize {
+		return nil, false
+	}
+
+	events = make([]ProgressEvent, 0, bus.lastEventID-id)
+	for next := id + 1; next <= bus.lastEventID; next++ {
+		events = append(events, bus.events[(next-1)%progressReplaySize])
+	}
+	return events, true
+}
+
+// ProgressSnapshot returns the current progress of the jobs for which include
+// returns true, and the ID of the last event already reflected in it, so
+// ProgressEventsSince can continue exactly where the snapshot ends
+func (s *UploadService) ProgressSnapshot(include func(*ProgressInfo) bool) ([]ProgressInfo, uint64) {
+	// Events are only broadcast while fileProgressLock is held, so none can slip in between
+	s.fileProgressLock.RLock()
+	defer s.fileProgressLock.RUnlock()
+	s.progressBus.lock.Lock()
+	defer s.progressBus.lock.Unlock()
+
+	snapshot := make([]ProgressInfo, 0)
+	for _, progress := range s.fileProgressMap {
+		if include == nil || include(progress) {
+			snapshot = append(snapshot, progress.clone())
+		}
+	}
+	return snapshot, s.progressBus.lastEventID
+}
+
+// IsActive reports whether a job has yet to complete, fail or be cancelled
+func (p *ProgressInfo) IsActive() bool {
+	return p.Status == StatusUploading || p.Status == StatusQueued || p.Status == StatusProcessing
+}
+
+// clone returns a copy of p that shares no memory with it
+func (p *ProgressInfo) clone() ProgressInfo {
+	copyProgress := *p
+	copyProgress.RowErrors = append([]RowError(nil), p.RowErrors...)
+	return copyProgress
+}
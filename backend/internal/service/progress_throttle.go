@@ -0,0 +1,81 @@
+package service
+
+import "time"
+
+// progressThrottle records the last broadcast of an active job's progress, so
+// that counter updates arriving soon after it can be held back and coalesced
+type progressThrottle struct {
+	at        time.Time
+	processed int
+	pending   bool // a held back update has yet to be broadcast
+	scheduled bool // a flush is due
+}
+
+// trackBroadcast notes that progress is being broadcast. It must be called
+// with fileProgressLock held.
+func (s *UploadService) trackBroadcast(progress *ProgressInfo) {
+	if !progress.IsActive() {
+		delete(s.progressThrottles, progress.JobID)
+		return
+	}
+
+	throttle, exists := s.progressThrottles[progress.JobID]
+	if !exists {
+		throttle = &progressThrottle{}
+		s.progressThrottles[progress.JobID] = throttle
+	}
+	throttle.at = time.Now()
+	throttle.processed = progress.Processed
+	throttle.pending = false
+}
+
+// broadcastThrottled broadcasts a change in a job's counters if progressInterval
+// has passed since the last broadcast, or the job has moved by at least
+// progressMinChange percent. Otherwise the change is broadcast, along with any
+// that follow it, once the interval is over. It must be called with
+// fileProgressLock held.
+func (s *UploadService) broadcastThrottled(progress *ProgressInfo) {
+	throttle, exists := s.progressThrottles[progress.JobID]
+	if !exists || time.Since(throttle.at) >= s.progressInterval {
+		s.BroadcastProgress(progress)
+		return
+	}
+	if progress.TotalRecords > 0 {
+		change := float64(progress.Processed-throttle.processed) / float64(progress.TotalRecords) * 100
+		if change >= s.progressMinChange {
+			s.BroadcastProgress(progress)
+			return
+		}
+	}
+
+	throttle.pending = true
+	if !throttle.scheduled {
+		throttle.scheduled = true
+		s.scheduleProgressFlush(progress.JobID, s.progressInterval-time.Since(throttle.at))
+	}
+}
+
+func (s *UploadService) scheduleProgressFlush(jobID string, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		s.fileProgressLock.Lock()
+		defer s.fileProgressLock.Unlock()
+
+		throttle, exists := s.progressThrottles[jobID]
+		if !exists {
+			// The job has finished, and its final state has been broadcast
+			return
+		}
+		throttle.scheduled = false
+		progress, exists := s.fileProgressMap[jobID]
+		if !throttle.pending || !exists {
+			return
+		}
+		// Another broadcast may have restarted the interval since this was scheduled
+		if wait := s.progressInterval - time.Since(throttle.at); wait > 0 {
+			throttle.scheduled = true
+			s.scheduleProgressFlush(jobID, wait)
+			return
+		}
+		s.BroadcastProgress(progress)
+	})
+}
@@ -0,0 +1,367 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Format identifies how an uploaded file encodes its records
+type Format string
+
+const (
+	FormatAuto   Format = ""       // sniff the format from the file content
+	FormatCSV    Format = "csv"    // comma-separated, or a custom delimiter
+	FormatTSV    Format = "tsv"    // tab-separated
+	FormatXLSX   Format = "xlsx"   // Excel workbook, first or named sheet
+	FormatNDJSON Format = "ndjson" // one JSON object per line
+)
+
+// ParseFormat converts a form value into a Format. An empty value selects content sniffing.
+func ParseFormat(value string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "auto":
+		return FormatAuto, nil
+	case "csv":
+		return FormatCSV, nil
+	case "tsv", "tab":
+		return FormatTSV, nil
+	case "xlsx", "excel":
+		return FormatXLSX, nil
+	case "ndjson", "jsonl", "json-lines":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("invalid format %q: must be one of csv, tsv, xlsx, ndjson", value)
+}
+
+// RecordSource yields the records of an uploaded file one at a time. The
+// first record is the header. Read returns io.EOF after the last record.
+type RecordSource interface {
+	// Read returns the next record and the line (or spreadsheet row) it starts on.
+	// A *RowParseError means only that record is bad and reading may continue;
+	// any other error is fatal.
+	Read() (record []string, line int, err error)
+	Close() error
+}
+
+// RowParseError reports a single record that could not be parsed
+type RowParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowParseError) Unwrap() error {
+	return e.Err
+}
+
+// openRecordSource opens filePath as the format selected in opts, sniffing it when not set
+func openRecordSource(filePath string, opts ImportOptions) (RecordSource, error) {
+	format := opts.Format
+	if format == FormatAuto {
+		detected, err := detectFormat(filePath, opts.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		format = detected
+	}
+
+	switch format {
+	case FormatXLSX:
+		return newXLSXSource(filePath, opts.Sheet, opts.Dialect.SkipLines)
+	case FormatNDJSON:
+		return newNDJSONSource(filePath, opts.Encoding)
+	case FormatTSV:
+		dialect := opts.Dialect
+		dialect.Delimiter = '\t'
+		dialect.LazyQuotes = true // TSV exports rarely quote fields, so stray quotes are data
+		return newDelimitedSource(filePath, dialect, opts.Encoding)
+	default:
+		return newDelimitedSource(filePath, opts.Dialect, opts.Encoding)
+	}
+}
+
+// detectFormat sniffs the format of a file from its first few kilobytes,
+// looking through gzip compression and text encoding
+func detectFormat(filePath, declaredEncoding string) (Format, error) {
+	file, err := openDecompressed(filePath)
+	if err != nil {
+		return FormatAuto, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 4096)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return FormatAuto, err
+	}
+	head = head[:n]
+
+	// XLSX workbooks are zip archives
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		return FormatXLSX, nil
+	}
+
+	text, err := decodeText(bytes.NewReader(head), declaredEncoding)
+	if err != nil {
+		return FormatAuto, err
+	}
+	decoded, _ := io.ReadAll(text)
+
+	trimmed := bytes.TrimLeft(decoded, " \t\r\n")
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return FormatNDJSON, nil
+	}
+
+	// Compare separators on the first line; tabs rarely appear in comma-separated data
+	firstLine, _, _ := bytes.Cut(trimmed, []byte("\n"))
+	if bytes.Count(firstLine, []byte("\t")) > bytes.Count(firstLine, []byte(",")) {
+		return FormatTSV, nil
+	}
+	return FormatCSV, nil
+}
+
+// delimitedSource reads CSV, TSV and other single-character delimited text
+type delimitedSource struct {
+	file       io.ReadCloser
+	reader     *csv.Reader
+	lineOffset int  // lines skipped before the reader started
+	swapQuotes bool // the file is single-quoted and read through a quoteSwapReader
+	trimSpace  bool
+}
+
+func newDelimitedSource(filePath string, dialect Dialect, declaredEncoding string) (*delimitedSource, error) {
+	file, err := openText(filePath, declaredEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReaderSize(file, encodingSniffSize)
+	if err := skipLines(buffered, dialect.SkipLines); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if dialect.Delimiter == 0 {
+		head, _ := buffered.Peek(encodingSniffSize)
+		dialect.Delimiter = sniffDelimiter(head, dialect.quote(), dialect.Comment)
+	}
+
+	source := &delimitedSource{
+		file:       file,
+		lineOffset: dialect.SkipLines,
+		swapQuotes: dialect.quote() == '\'',
+		trimSpace:  dialect.TrimSpace,
+	}
+
+	var input io.Reader = buffered
+	if source.swapQuotes {
+		input = quoteSwapReader{reader: buffered}
+	}
+	reader := csv.NewReader(input)
+	reader.Comma = dialect.Delimiter
+	reader.Comment = dialect.Comment
+	reader.LazyQuotes = dialect.LazyQuotes
+	reader.TrimLeadingSpace = dialect.TrimSpace
+	reader.FieldsPerRecord = -1 // Short rows are reported per row instead of failing the read
+	source.reader = reader
+
+	return source, nil
+}
+
+func (s *delimitedSource) Read() ([]string, int, error) {
+	record, err := s.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			line := parseErr.StartLine + s.lineOffset
+			return nil, line, &RowParseError{Line: line, Err: parseErr.Err}
+		}
+		return nil, 0, err
+	}
+
+	for i, field := range record {
+		if s.swapQuotes {
+			field = swapQuotes(field)
+		}
+		if s.trimSpace {
+			field = strings.TrimSpace(field)
+		}
+		record[i] = field
+	}
+
+	line, _ := s.reader.FieldPos(0)
+	return record, line + s.lineOffset, nil
+}
+
+func (s *delimitedSource) Close() error {
+	return s.file.Close()
+}
+
+// xlsxSource reads the rows of one worksheet, using the row number as the line
+type xlsxSource struct {
+	workbook *excelize.File
+	rows     *excelize.Rows
+	row      int
+	skip     int // leading rows to ignore
+}
+
+func newXLSXSource(filePath, sheet string, skip int) (*xlsxSource, error) {
+	file, err := openDecompressed(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The workbook is read into memory, so the file can be closed straight away
+	workbook, err := excelize.OpenReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open workbook: %w", err)
+	}
+
+	if sheet == "" {
+		sheets := workbook.GetSheetList()
+		if len(sheets) == 0 {
+			workbook.Close()
+			return nil, errors.New("workbook has no sheets")
+		}
+		sheet = sheets[0]
+	}
+
+	rows, err := workbook.Rows(sheet)
+	if err != nil {
+		workbook.Close()
+		return nil, fmt.Errorf("failed to read sheet %q: %w", sheet, err)
+	}
+	return &xlsxSource{workbook: workbook, rows: rows, skip: skip}, nil
+}
+
+func (s *xlsxSource) Read() ([]string, int, error) {
+	for s.rows.Next() {
+		s.row++
+		if s.row <= s.skip {
+			continue
+		}
+		record, err := s.rows.Columns()
+		if err != nil {
+			return nil, s.row, &RowParseError{Line: s.row, Err: err}
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+		return record, s.row, nil
+	}
+	if err := s.rows.Error(); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, io.EOF
+}
+
+func (s *xlsxSource) Close() error {
+	s.rows.Close()
+	return s.workbook.Close()
+}
+
+// ndjsonSource reads one JSON object per line. Keys are matched to columns the
+// same way CSV headers are, so it yields a synthetic header with the canonical
+// column names followed by records in that order.
+type ndjsonSource struct {
+	file       io.ReadCloser
+	reader     *bufio.Reader
+	line       int
+	headerSent bool
+}
+
+// ndjsonColumns is the header an ndjsonSource reports
+var ndjsonColumns = []string{"student_id", "student_name", "subject", "grade"}
+
+func newNDJSONSource(filePath, declaredEncoding string) (*ndjsonSource, error) {
+	file, err := openText(filePath, declaredEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonSource{file: file, reader: bufio.NewReader(file)}, nil
+}
+
+func (s *ndjsonSource) Read() ([]string, int, error) {
+	if !s.headerSent {
+		s.headerSent = true
+		return ndjsonColumns, 0, nil
+	}
+
+	for {
+		text, err := s.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || text == "") {
+			return nil, 0, err
+		}
+		s.line++
+
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return nil, s.line, &RowParseError{Line: s.line, Err: fmt.Errorf("invalid JSON: %w", err)}
+		}
+
+		record := make([]string, len(ndjsonColumns))
+		for key, value := range object {
+			column, ok := columnAliases[normalizeColumnName(key)]
+			if !ok {
+				continue
+			}
+			for i, name := range ndjsonColumns {
+				if name == column && value != nil {
+					record[i] = fmt.Sprint(value)
+				}
+			}
+		}
+		return record, s.line, nil
+	}
+}
+
+func (s *ndjsonSource) Close() error {
+	return s.file.Close()
+}
+
+// openText opens a text file for reading as UTF-8, decompressing gzip content
+// and transcoding from declaredEncoding, or a detected encoding when empty
+func openText(filePath, declaredEncoding string) (io.ReadCloser, error) {
+	file, err := openDecompressed(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := decodeText(file, declaredEncoding)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{text, file}, nil
+}
+
+// isBlankRecord reports whether every field of record is empty
+func isBlankRecord(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
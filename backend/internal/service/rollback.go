@@ -0,0 +1,118 @@
+package service
+
+import (
+	"backend/internal/model"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobRunning  = errors.New("job is still running")
+	ErrJobFinished = errors.New("job has already finished")
+)
+
+// RollbackMode selects how RollbackJob undoes an import
+type RollbackMode string
+
+const (
+	RollbackRestore RollbackMode = "restore" // delete the rows the job inserted and restore the ones it overwrote
+	RollbackDelete  RollbackMode = "delete"  // delete every row the job inserted or overwrote
+)
+
+// ParseRollbackMode converts a query value into a RollbackMode, defaulting to restore
+func ParseRollbackMode(value string) (RollbackMode, error) {
+	switch mode := RollbackMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case "":
+		return RollbackRestore, nil
+	case RollbackRestore, RollbackDelete:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid rollback mode %q: must be one of restore, delete", value)
+}
+
+// RollbackSummary reports what RollbackJob changed, or would change on a dry run
+type RollbackSummary struct {
+	JobID    string
+	Mode     RollbackMode
+	DryRun   bool
+	Deleted  int64 // rows removed
+	Restored int64 // rows set back to their values from before the job
+	Skipped  int64 // overwritten rows left alone because another job or an API edit has changed or removed them since
+}
+
+// RollbackJob undoes an import job. Only rows still stamped with the job are
+// touched, so later imports or API edits of the same students are never reverted. With
+// dryRun set the changes are counted but not made.
+func (s *UploadService) RollbackJob(jobID string, mode RollbackMode, dryRun bool) (*RollbackSummary, error) {
+	if progress := s.GetJobProgress(jobID); progress != nil && progress.IsActive() {
+		return nil, ErrJobRunning
+	}
+
+	summary := &RollbackSummary{JobID: jobID, Mode: mode, DryRun: dryRun}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var backups int64
+		if err := tx.Model(&model.ImportBackup{}).Where("job_id = ?", jobID).Count(&backups).Error; err != nil {
+			return err
+		}
+
+		jobRows := tx.Model(&model.Student{}).Where("import_job_id = ?", jobID)
+		inserted := jobRows.Session(&gorm.Session{}).
+			Where("student_id NOT IN (?)", tx.Model(&model.ImportBackup{}).Select("student_id").Where("job_id = ?", jobID))
+		overwritten := jobRows.Session(&gorm.Session{}).
+			Where("student_id IN (?)", tx.Model(&model.ImportBackup{}).Select("student_id").Where("job_id = ?", jobID))
+
+		if mode == RollbackDelete {
+			if err := jobRows.Session(&gorm.Session{}).Count(&summary.Deleted).Error; err != nil {
+				return err
+			}
+		} else {
+			if err := inserted.Count(&summary.Deleted).Error; err != nil {
+				return err
+			}
+			if err := overwritten.Count(&summary.Restored).Error; err != nil {
+				return err
+			}
+			summary.Skipped = backups - summary.Restored
+		}
+
+		if summary.Deleted == 0 && backups == 0 && s.GetJobProgress(jobID) == nil {
+			return ErrJobNotFound
+		}
+		if dryRun {
+			return nil
+		}
+
+		now := time.Now()
+
+		if mode == RollbackRestore {
+			history := "INSERT INTO grade_changes (student_id, action, old_grade, new_grade, source, job_id, changed_by, changed_at)" +
+				" SELECT students.student_id, ?, students.grade, b.grade, ?, ?, '', ? FROM students" +
+				" JOIN import_backups b ON b.student_id = students.student_id" +
+				" WHERE b.job_id = ? AND students.import_job_id = ? AND students.grade <> b.grade"
+			if err := tx.Exec(history, GradeActionUpdate, GradeSourceRollback, jobID, now, jobID, jobID).Error; err != nil {
+				return err
+			}
+
+			restore := "UPDATE students SET student_name = b.student_name, subject = b.subject, grade = b.grade," +
+				" import_job_id = b.import_job_id, import_batch_id = b.import_batch_id, created_at = b.created_at, updated_at = ?" +
+				" FROM import_backups b WHERE b.job_id = ? AND b.student_id = students.student_id AND students.import_job_id = ?"
+			if err := tx.Exec(restore, now, jobID, jobID).Error; err != nil {
+				return err
+			}
+		}
+		// After a restore the only rows left stamped with the job are the ones it inserted
+		if err := tx.Where("import_job_id = ?", jobID).Delete(&model.Student{}).Error; err != nil {
+			return err
+		}
+		// The job is undone, so its backups can no longer be applied
+		return tx.Where("job_id = ?", jobID).Delete(&model.ImportBackup{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
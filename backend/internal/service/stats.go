@@ -0,0 +1,134 @@
+package service
+
+import (
+	"backend/internal/model"
+	"gorm.io/gorm"
+	"math"
+	"sort"
+)
+
+// DefaultBandWidth is the width of the grade bands in histograms when none is given
+const DefaultBandWidth = 10
+
+// GradeStats summarizes the grades of a group of students. The pointer fields
+// are nil when the group is empty, and StdDev also when it has a single grade.
+type GradeStats struct {
+	Subject   string      `json:"subject,omitempty"`
+	Count     int64       `json:"count"`
+	Mean      *float64    `json:"mean"`
+	Median    *float64    `json:"median"`
+	Min       *int        `json:"min"`
+	Max       *int        `json:"max"`
+	StdDev    *float64    `json:"stddev"`             // sample standard deviation, as in spreadsheets
+	Histogram []GradeBand `json:"histogram" gorm:"-"` // non-empty bands only, lowest first
+}
+
+// GradeBand counts the grades from From to To inclusive
+type GradeBand struct {
+	From  int   `json:"from"`
+	To    int   `json:"to"`
+	Count int64 `json:"count"`
+}
+
+// StatsReport holds the statistics over all matching students and per subject
+type StatsReport struct {
+	BandWidth int          `json:"bandWidth"`
+	Overall   GradeStats   `json:"overall"`
+	Subjects  []GradeStats `json:"subjects"`
+}
+
+// gradeAggregates is the SQL computing the summary columns of GradeStats
+const gradeAggregates = "COUNT(*) AS count, AVG(grade) AS mean, " +
+	"percentile_cont(0.5) WITHIN GROUP (ORDER BY grade) AS median, " +
+	"MIN(grade) AS min, MAX(grade) AS max, stddev_samp(grade) AS std_dev"
+
+// basicGradeAggregates is gradeAggregates for databases without
+// percentile_cont and stddev_samp, such as the SQLite used in tests; median
+// and standard deviation are left out
+const basicGradeAggregates = "COUNT(*) AS count, AVG(grade) AS mean, " +
+	"NULL AS median, MIN(grade) AS min, MAX(grade) AS max, NULL AS std_dev"
+
+// gradeBand is the SQL numbering the band a grade falls in. It is integer
+// floor division, so huge grades are not rounded through floating point.
+const gradeBand = "CASE WHEN grade >= 0 THEN grade / ? ELSE -(-(grade + 1) / ?) - 1 END"
+
+// GradeStats computes grade statistics for the students matching f, overall
+// and per subject, with histograms of bandWidth-wide grade bands. Everything
+// is aggregated in the database.
+func (s *StudentService) GradeStats(f StudentFilter, bandWidth int) (*StatsReport, error) {
+	if bandWidth < 1 {
+		verr := &ValidationError{}
+		verr.Add("band_width", "must be a positive integer")
+		return nil, verr
+	}
+
+	aggregates := gradeAggregates
+	if s.db.Dialector.Name() != "postgres" {
+		aggregates = basicGradeAggregates
+	}
+
+	report := &StatsReport{BandWidth: bandWidth, Subjects: []GradeStats{}}
+	err := s.withFilter(f, func(db *gorm.DB) error {
+		students := func() *gorm.DB {
+			return s.applyStudentFilter(db.Model(&model.Student{}), f)
+		}
+
+		if err := students().Select(aggregates).Scan(&report.Overall).Error; err != nil {
+			return err
+		}
+		if err := students().Select("subject, " + aggregates).Group("subject").Order("subject").Scan(&report.Subjects).Error; err != nil {
+			return err
+		}
+
+		var bands []struct {
+			Subject string
+			Band    int
+			Count   int64
+		}
+		err := students().
+			Select("subject, "+gradeBand+" AS band, COUNT(*) AS count", bandWidth, bandWidth).
+			Group("subject, band").
+			Order("subject, band").
+			Scan(&bands).Error
+		if err != nil {
+			return err
+		}
+
+		bySubject := make(map[string][]GradeBand)
+		overall := make(map[int]int64)
+		for _, band := range bands {
+			bySubject[band.Subject] = append(bySubject[band.Subject], gradeBandOf(band.Band, bandWidth, band.Count))
+			overall[band.Band] += band.Count
+		}
+		report.Overall.Histogram = []GradeBand{}
+		for band, count := range overall {
+			report.Overall.Histogram = append(report.Overall.Histogram, gradeBandOf(band, bandWidth, count))
+		}
+		sort.Slice(report.Overall.Histogram, func(i, j int) bool {
+			return report.Overall.Histogram[i].From < report.Overall.Histogram[j].From
+		})
+		for i := range report.Subjects {
+			report.Subjects[i].Histogram = bySubject[report.Subjects[i].Subject]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// gradeBandOf returns band number band of bandWidth-wide bands. Only bands
+// holding grades are listed, so a stray huge grade costs one band rather than
+// every empty band up to it. The bounds saturate at the int range.
+func gradeBandOf(band, bandWidth int, count int64) GradeBand {
+	from := band * bandWidth
+	if from/bandWidth != band {
+		from = math.MinInt
+	}
+	to := math.MaxInt
+	if from <= math.MaxInt-(bandWidth-1) {
+		to = from + bandWidth - 1
+	}
+	return GradeBand{From: from, To: to, Count: count}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"backend/internal/model"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrStudentNotFound = errors.New("student not found")
+	ErrStudentExists   = errors.New("a student with this ID already exists")
+)
+
+// StudentChanges are the fields of a student to update. Nil fields are left
+// unchanged; the student ID cannot be changed.
+type StudentChanges struct {
+	StudentName *string
+	Subject     *string
+	Grade       *int
+	ChangedBy   string // user recorded in the grade history
+}
+
+// ParseGrade converts a grade the way the importer does: the value must be an
+// integer as it stands, so surrounding spaces make it invalid
+func ParseGrade(value string) (int, error) {
+	grade, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grade %q", value)
+	}
+	return grade, nil
+}
+
+// validateStudent applies the rules every stored student meets, whether it
+// was imported or written through the API, returning nil if it is valid.
+// Fields are checked as they are, never trimmed: only a blank student ID is
+// rejected, and names and subjects may be empty.
+func validateStudent(student model.Student) *ValidationError {
+	if strings.TrimSpace(student.StudentID) == "" {
+		verr := &ValidationError{}
+		verr.Add("student_id", "is empty")
+		return verr
+	}
+	return nil
+}
+
+// GetStudent returns the student with the given ID
+func (s *StudentService) GetStudent(id string) (*model.Student, error) {
+	var student model.Student
+	err := s.db.Where("student_id = ?", id).Take(&student).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrStudentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &student, nil
+}
+
+// CreateStudent validates and inserts a single student, recording its grade
+// in the history as set by changedBy
+func (s *StudentService) CreateStudent(student model.Student, changedBy string) (*model.Student, error) {
+	student = model.Student{
+		StudentID:   student.StudentID,
+		StudentName: student.StudentName,
+		Subject:     student.Subject,
+		Grade:       student.Grade,
+	}
+	if verr := validateStudent(student); verr != nil {
+		return nil, verr
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// ON CONFLICT DO NOTHING reports duplicates without relying on driver-specific errors
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&student)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrStudentExists
+		}
+		return tx.Create(&model.GradeChange{
+			StudentID: student.StudentID,
+			Action:    GradeActionCreate,
+			NewGrade:  student.Grade,
+			Source:    GradeSourceAPI,
+			ChangedBy: changedBy,
+			ChangedAt: student.CreatedAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &student, nil
+}
+
+// UpdateStudent applies changes to the student with the given ID. With
+// replace set every field must be given, as in a PUT. An edited student is no
+// longer stamped with the import that wrote it.
+func (s *StudentService) UpdateStudent(id string, changes StudentChanges, replace bool) (*model.Student, error) {
+	verr := &ValidationError{}
+	updates := make(map[string]interface{})
+	if changes.StudentName != nil {
+		updates["student_name"] = *changes.StudentName
+	} else if replace {
+		verr.Add("student_name", "is required")
+	}
+	if changes.Subject != nil {
+		updates["subject"] = *changes.Subject
+	} else if replace {
+		verr.Add("subject", "is required")
+	}
+	if changes.Grade != nil {
+		updates["grade"] = *changes.Grade
+	} else if replace {
+		verr.Add("grade", "is required")
+	}
+	if err := verr.OrNil(); err != nil {
+		return nil, err
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the row so the old grade recorded in the history is the one overwritten
+		locked := tx
+		if tx.Dialector.Name() == "postgres" {
+			locked = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		var current model.Student
+		err := locked.Where("student_id = ?", id).Take(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrStudentNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		// The row no longer holds what the import wrote, so rolling the job back must leave it alone
+		updates["import_job_id"] = ""
+		updates["import_batch_id"] = ""
+		if err := tx.Model(&model.Student{}).Where("student_id = ?", id).Updates(updates).Error; err != nil {
+			return err
+		}
+		if changes.Grade == nil || *changes.Grade == current.Grade {
+			return nil
+		}
+		return tx.Create(&model.GradeChange{
+			StudentID: id,
+			Action:    GradeActionUpdate,
+			OldGrade:  current.Grade,
+			NewGrade:  *changes.Grade,
+			Source:    GradeSourceAPI,
+			ChangedBy: changes.ChangedBy,
+			ChangedAt: time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetStudent(id)
+}
+
+// DeleteStudent removes the student with the given ID, recording the grade it
+// had in the history as removed by changedBy
+func (s *StudentService) DeleteStudent(id, changedBy string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the row so the grade recorded in the history is the one deleted
+		locked := tx
+		if tx.Dialector.Name() == "postgres" {
+			locked = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		var current model.Student
+		err := locked.Where("student_id = ?", id).Take(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrStudentNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("student_id = ?", id).Delete(&model.Student{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.GradeChange{
+			StudentID: id,
+			Action:    GradeActionDelete,
+			OldGrade:  current.Grade,
+			Source:    GradeSourceAPI,
+			ChangedBy: changedBy,
+			ChangedAt: time.Now(),
+		}).Error
+	})
+}
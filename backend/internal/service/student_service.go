@@ -1,47 +1,615 @@
 package service
 
 import (
+	"backend/internal/database"
 	"backend/internal/model"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"math"
+	"strings"
+	"time"
 )
 
+// sortableColumns is the whitelist of columns students can be sorted by
+var sortableColumns = map[string]bool{
+	"student_id":   true,
+	"student_name": true,
+	"subject":      true,
+	"grade":        true,
+}
+
+// relevanceSort orders search results by how well the name matches q, best first
+const relevanceSort = "relevance"
+
+// searchSimilarityThreshold is the minimum pg_trgm word similarity for a name
+// to match a search. pg_trgm's default of 0.6 misses most typos in short names.
+const searchSimilarityThreshold = 0.3
+
+// FieldError describes one invalid query parameter
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a request is rejected because of its input
+type ValidationError struct {
+	Errors []FieldError `json:"details"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		messages = append(messages, fieldErr.Field+": "+fieldErr.Message)
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+// Add records a problem with field
+func (e *ValidationError) Add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// OrNil returns e if any errors were added, and nil otherwise
+func (e *ValidationError) OrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// SortField is one column of a sort specification
+type SortField struct {
+	Column string
+	Desc   bool
+}
+
+// ParseSortSpec parses a comma-separated sort specification such as
+// "grade:desc,student_name:asc". The direction defaults to ascending. Columns
+// must be in the sortable whitelist and may appear only once.
+func ParseSortSpec(spec string) ([]SortField, error) {
+	verr := &ValidationError{}
+	var fields []SortField
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		column, direction, _ := strings.Cut(part, ":")
+		column = strings.ToLower(strings.TrimSpace(column))
+		field, err := newSortField(column, direction)
+		if err != nil {
+			verr.Add("sort", "%v", err)
+			continue
+		}
+		if seen[column] {
+			verr.Add("sort", "column %q appears more than once", column)
+			continue
+		}
+		seen[column] = true
+		fields = append(fields, field)
+	}
+
+	if err := verr.OrNil(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// newSortField validates a column and direction ("asc", "desc" or empty).
+// Relevance is accepted too and defaults to descending, best matches first.
+func newSortField(column, direction string) (SortField, error) {
+	if !sortableColumns[column] && column != relevanceSort {
+		return SortField{}, fmt.Errorf("unknown sort column %q", column)
+	}
+	switch strings.ToLower(strings.TrimSpace(direction)) {
+	case "":
+		return SortField{Column: column, Desc: column == relevanceSort}, nil
+	case "asc":
+		return SortField{Column: column}, nil
+	case "desc":
+		return SortField{Column: column, Desc: true}, nil
+	}
+	return SortField{}, fmt.Errorf("invalid sort direction %q for %s: must be asc or desc", direction, column)
+}
+
+// LegacySort converts the sort_by and sort_order parameters into a sort specification
+func LegacySort(sortBy, sortOrder string) ([]SortField, error) {
+	field, err := newSortField(strings.ToLower(strings.TrimSpace(sortBy)), sortOrder)
+	if err != nil {
+		verr := &ValidationError{}
+		verr.Add("sort_by", "%v", err)
+		return nil, verr
+	}
+	return []SortField{field}, nil
+}
+
+// CountMode controls how the total of a listing is computed
+type CountMode string
+
+const (
+	CountExact     CountMode = "exact"     // SELECT COUNT(*), accurate but slow on large tables
+	CountEstimated CountMode = "estimated" // the planner's row estimate; exact on databases without one
+	CountNone      CountMode = "none"      // no total
+)
+
+// ParseCountMode converts a query parameter into a CountMode; empty returns fallback
+func ParseCountMode(value string, fallback CountMode) (CountMode, error) {
+	switch mode := CountMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case "":
+		return fallback, nil
+	case CountExact, CountEstimated, CountNone:
+		return mode, nil
+	}
+	verr := &ValidationError{}
+	verr.Add("count", "must be one of exact, estimated, none")
+	return "", verr
+}
+
+// StudentFilter selects students. Zero values and nil pointers mean "no
+// constraint", so a grade bound of 0 is expressed with a non-nil pointer.
+type StudentFilter struct {
+	Search          string   // fuzzy name search; see StudentService.searchCondition
+	StudentName     string   // case-insensitive substring
+	Subjects        []string // any of these subjects
+	StudentID       string   // exact student ID
+	StudentIDPrefix string
+
+	GradeGT  *int // grade > value
+	GradeGTE *int // grade >= value
+	GradeLT  *int // grade < value
+	GradeLTE *int // grade <= value
+
+	ImportJobID   string // rows inserted by this upload job
+	ImportBatchID string // rows inserted by any job of this upload batch
+
+	CreatedAfter  *time.Time // created_at >= value
+	CreatedBefore *time.Time // created_at < value
+	UpdatedAfter  *time.Time // updated_at >= value
+	UpdatedBefore *time.Time // updated_at < value
+}
+
+// StudentQuery describes a page of the students listing
+type StudentQuery struct {
+	Page   int
+	Limit  int
+	Sort   []SortField // defaults to relevance when searching in page mode, otherwise student_name ascending
+	Filter StudentFilter
+
+	// Keyset pagination: when UseCursor is set, Page is ignored and the page
+	// starts after the row encoded in Cursor (or at the beginning if empty)
+	UseCursor bool
+	Cursor    string
+	Count     CountMode
+}
+
+// StudentPage is one page of the students listing
+type StudentPage struct {
+	Students       []model.Student
+	Total          int64 // -1 when not counted
+	TotalEstimated bool
+	TotalPages     int
+	NextCursor     string // empty on the last page, and in page-number mode
+	SearchMode     string // "fuzzy" or "substring" when Filter.Search is set
+}
+
+// pageCursor is the decoded form of an opaque cursor: the sort key values of
+// the last row of a page, and the sort they belong to
+type pageCursor struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
 type StudentService struct {
-	db *gorm.DB
+	db          *gorm.DB
+	fuzzySearch bool // pg_trgm search is set up; otherwise searches are substring matches
 }
 
 func NewStudentService(db *gorm.DB) *StudentService {
-	return &StudentService{db: db}
+	return &StudentService{db: db, fuzzySearch: database.SearchAvailable(db)}
+}
+
+func (s *StudentService) ListStudents(q StudentQuery) (*StudentPage, error) {
+	var page *StudentPage
+	err := s.withFilter(q.Filter, func(db *gorm.DB) error {
+		var err error
+		page, err = s.listStudents(db, q)
+		return err
+	})
+	return page, err
+}
+
+// ExportStudents calls fn for every student matching f, in the given sort
+// order, reading them one at a time from a database cursor so exports of any
+// size use constant memory. It stops at the first error fn returns.
+func (s *StudentService) ExportStudents(f StudentFilter, sort []SortField, fn func(student *model.Student) error) error {
+	sort, err := normalizeSort(sort, f.Search != "")
+	if err != nil {
+		return err
+	}
+
+	return s.withFilter(f, func(db *gorm.DB) error {
+		dbQuery := s.applyStudentFilter(db.Model(&model.Student{}), f).Order(s.orderByClause(sort, f.Search))
+		rows, err := dbQuery.Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var student model.Student
+			if err := db.ScanRows(rows, &student); err != nil {
+				return err
+			}
+			if err := fn(&student); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
 }
 
-func (s *StudentService) ListStudents(page, limit int, sortBy, sortOrder, studentName, subject string, gradeMin, gradeMax int) ([]model.Student, int64, int, error) {
-	var students []model.Student
-	dbQuery := s.db.Model(&model.Student{})
+// withFilter runs fn with a connection prepared for querying with f. A fuzzy
+// search needs its similarity threshold, which is a session setting, so fn
+// then runs in a transaction that scopes it.
+func (s *StudentService) withFilter(f StudentFilter, fn func(db *gorm.DB) error) error {
+	if f.Search == "" || !s.fuzzySearch {
+		return fn(s.db)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', ?, true)",
+			fmt.Sprint(searchSimilarityThreshold)).Error; err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
 
-	// Apply filters
-	if studentName != "" {
-		dbQuery = dbQuery.Where("student_name ILIKE ?", "%"+studentName+"%")
+func (s *StudentService) listStudents(db *gorm.DB, q StudentQuery) (*StudentPage, error) {
+	sort, err := normalizeSort(q.Sort, q.Filter.Search != "" && !q.UseCursor)
+	if err != nil {
+		return nil, err
 	}
-	if subject != "" {
-		dbQuery = dbQuery.Where("subject = ?", subject)
+
+	dbQuery := s.applyStudentFilter(db.Model(&model.Student{}), q.Filter)
+
+	page := &StudentPage{Total: -1}
+	if q.Filter.Search != "" {
+		page.SearchMode = "substring"
+		if s.fuzzySearch {
+			page.SearchMode = "fuzzy"
+		}
 	}
-	if gradeMin > 0 {
-		dbQuery = dbQuery.Where("grade >= ?", gradeMin)
+	if q.Count != CountNone {
+		total, estimated, err := s.countStudents(dbQuery, q.Count)
+		if err != nil {
+			return nil, err
+		}
+		page.Total, page.TotalEstimated = total, estimated
+		page.TotalPages = int(math.Ceil(float64(total) / float64(q.Limit)))
 	}
-	if gradeMax > 0 {
-		dbQuery = dbQuery.Where("grade <= ?", gradeMax)
+
+	orderBy := s.orderByClause(sort, q.Filter.Search)
+	if !q.UseCursor {
+		// Pagination
+		if err := dbQuery.Order(orderBy).Offset((q.Page - 1) * q.Limit).Limit(q.Limit).Find(&page.Students).Error; err != nil {
+			return nil, err
+		}
+		return page, nil
 	}
 
-	// Apply sorting
-	orderClause := sortBy + " " + sortOrder
-	dbQuery = dbQuery.Order(orderClause)
+	if q.Cursor != "" {
+		values, err := decodeCursor(q.Cursor, sort)
+		if err != nil {
+			return nil, err
+		}
+		condition, args := keysetCondition(sort, values)
+		dbQuery = dbQuery.Where(condition, args...)
+	}
+
+	// Fetch one extra row to find out whether there is a next page
+	if err := dbQuery.Order(orderBy).Limit(q.Limit + 1).Find(&page.Students).Error; err != nil {
+		return nil, err
+	}
+	if len(page.Students) > q.Limit {
+		page.Students = page.Students[:q.Limit]
+		page.NextCursor = encodeCursor(sort, page.Students[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+// likeEscaper escapes the LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// substringMatch is a case-insensitive LIKE on names that, unlike ILIKE, also
+// works on SQLite. Neither form can use the trigram index, which is built on
+// the normalized name.
+const substringMatch = `LOWER(student_name) LIKE LOWER(?) ESCAPE '\'`
+
+// applyStudentFilter narrows dbQuery to the students matching f
+func (s *StudentService) applyStudentFilter(dbQuery *gorm.DB, f StudentFilter) *gorm.DB {
+	if f.Search != "" {
+		condition, args := s.searchCondition(f.Search)
+		dbQuery = dbQuery.Where(condition, args...)
+	}
+	if f.StudentName != "" {
+		dbQuery = dbQuery.Where(substringMatch, "%"+likeEscaper.Replace(f.StudentName)+"%")
+	}
+	if len(f.Subjects) > 0 {
+		dbQuery = dbQuery.Where("subject IN ?", f.Subjects)
+	}
+	if f.StudentID != "" {
+		dbQuery = dbQuery.Where("student_id = ?", f.StudentID)
+	}
+	if f.StudentIDPrefix != "" {
+		dbQuery = dbQuery.Where(`student_id LIKE ? ESCAPE '\'`, likeEscaper.Replace(f.StudentIDPrefix)+"%")
+	}
+	if f.GradeGT != nil {
+		dbQuery = dbQuery.Where("grade > ?", *f.GradeGT)
+	}
+	if f.GradeGTE != nil {
+		dbQuery = dbQuery.Where("grade >= ?", *f.GradeGTE)
+	}
+	if f.GradeLT != nil {
+		dbQuery = dbQuery.Where("grade < ?", *f.GradeLT)
+	}
+	if f.GradeLTE != nil {
+		dbQuery = dbQuery.Where("grade <= ?", *f.GradeLTE)
+	}
+	if f.ImportJobID != "" {
+		dbQuery = dbQuery.Where("import_job_id = ?", f.ImportJobID)
+	}
+	if f.ImportBatchID != "" {
+		dbQuery = dbQuery.Where("import_batch_id = ?", f.ImportBatchID)
+	}
+	if f.CreatedAfter != nil {
+		dbQuery = dbQuery.Where("created_at >= ?", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		dbQuery = dbQuery.Where("created_at < ?", *f.CreatedBefore)
+	}
+	if f.UpdatedAfter != nil {
+		dbQuery = dbQuery.Where("updated_at >= ?", *f.UpdatedAfter)
+	}
+	if f.UpdatedBefore != nil {
+		dbQuery = dbQuery.Where("updated_at < ?", *f.UpdatedBefore)
+	}
+	return dbQuery
+}
+
+// searchCondition matches names against a search. With pg_trgm both sides are
+// normalized (lower case, accents removed) and a name matches if it contains
+// the search or a word in it is similar enough to tolerate typos; both use the
+// trigram index. Without it, the search is a case-insensitive substring.
+func (s *StudentService) searchCondition(search string) (string, []interface{}) {
+	pattern := "%" + likeEscaper.Replace(search) + "%"
+	if !s.fuzzySearch {
+		return substringMatch, []interface{}{pattern}
+	}
+	name := database.SearchFunction + "(student_name)"
+	return "(" + name + " LIKE " + database.SearchFunction + `(?) ESCAPE '\' OR ` +
+			database.SearchFunction + "(?) <% " + name + ")",
+		[]interface{}{pattern, search}
+}
+
+// relevanceExpression ranks names by how well they match a search, higher is
+// better. Without pg_trgm, names containing the search earlier rank higher.
+func (s *StudentService) relevanceExpression(search string) clause.Expr {
+	if !s.fuzzySearch {
+		// SQLite has no POSITION(... IN ...), PostgreSQL no INSTR
+		position := "INSTR(LOWER(student_name), LOWER(?))"
+		if s.db.Dialector.Name() == "postgres" {
+			position = "STRPOS(LOWER(student_name), LOWER(?))"
+		}
+		return clause.Expr{SQL: "-" + position, Vars: []interface{}{search}}
+	}
+	return clause.Expr{
+		SQL:  "word_similarity(" + database.SearchFunction + "(?), " + database.SearchFunction + "(student_name))",
+		Vars: []interface{}{search},
+	}
+}
+
+// countStudents returns the number of rows dbQuery matches. In estimated mode
+// on PostgreSQL the planner's estimate is used, which avoids scanning the table.
+func (s *StudentService) countStudents(dbQuery *gorm.DB, mode CountMode) (int64, bool, error) {
+	if mode == CountEstimated && s.db.Dialector.Name() == "postgres" {
+		stmt := dbQuery.Session(&gorm.Session{DryRun: true}).Find(&[]model.Student{}).Statement
+
+		var plan string
+		if err := s.db.Raw("EXPLAIN (FORMAT JSON) "+stmt.SQL.String(), stmt.Vars...).Row().Scan(&plan); err != nil {
+			return 0, false, err
+		}
+		var explained []struct {
+			Plan struct {
+				Rows float64 `json:"Plan Rows"`
+			} `json:"Plan"`
+		}
+		if err := json.Unmarshal([]byte(plan), &explained); err == nil && len(explained) > 0 {
+			return int64(explained[0].Plan.Rows), true, nil
+		}
+	}
 
-	// Pagination
 	var totalCount int64
-	dbQuery.Count(&totalCount)
-	dbQuery.Offset((page - 1) * limit).Limit(limit).Find(&students)
+	if err := dbQuery.Session(&gorm.Session{}).Count(&totalCount).Error; err != nil {
+		return 0, false, err
+	}
+	return totalCount, false, nil
+}
+
+// normalizeSort validates a sort specification against the whitelist, applies
+// the default, and appends student_id as a tie-breaker so the order is total.
+// Both stable pages and keyset cursors rely on that. Relevance is only allowed
+// (and is the default) when ranked is set.
+func normalizeSort(sort []SortField, ranked bool) ([]SortField, error) {
+	if len(sort) == 0 {
+		sort = []SortField{{Column: "student_name"}}
+		if ranked {
+			sort = []SortField{{Column: relevanceSort, Desc: true}, {Column: "student_name"}}
+		}
+	}
+
+	normalized := make([]SortField, 0, len(sort)+1)
+	hasStudentID := false
+	for _, field := range sort {
+		if field.Column == relevanceSort && !ranked {
+			verr := &ValidationError{}
+			verr.Add("sort", "relevance order requires q and page pagination")
+			return nil, verr
+		}
+		if !sortableColumns[field.Column] && field.Column != relevanceSort {
+			verr := &ValidationError{}
+			verr.Add("sort", "unknown sort column %q", field.Column)
+			return nil, verr
+		}
+		hasStudentID = hasStudentID || field.Column == "student_id"
+		normalized = append(normalized, field)
+	}
+	if !hasStudentID {
+		normalized = append(normalized, SortField{Column: "student_id"})
+	}
+	return normalized, nil
+}
+
+// orderByClause builds the ORDER BY for a normalized sort specification from
+// whitelisted column names only, never from raw input. Relevance is ranked
+// against search.
+func (s *StudentService) orderByClause(sort []SortField, search string) clause.OrderBy {
+	var orderBy clause.OrderBy
+	ranked := false
+	for _, field := range sort {
+		ranked = ranked || field.Column == relevanceSort
+		orderBy.Columns = append(orderBy.Columns, clause.OrderByColumn{Column: clause.Column{Name: field.Column}, Desc: field.Desc})
+	}
+	if !ranked {
+		return orderBy
+	}
+
+	// Relevance is an expression rather than a column, so the whole clause is built as one
+	terms := make([]string, 0, len(sort))
+	vars := make([]interface{}, 0, len(sort))
+	for _, field := range sort {
+		direction := " ASC"
+		if field.Desc {
+			direction = " DESC"
+		}
+		terms = append(terms, "?"+direction)
+		if field.Column == relevanceSort {
+			vars = append(vars, s.relevanceExpression(search))
+		} else {
+			vars = append(vars, clause.Column{Name: field.Column})
+		}
+	}
+	orderBy.Expression = clause.Expr{SQL: strings.Join(terms, ", "), Vars: vars}
+	return orderBy
+}
+
+// sortSignature identifies a sort specification, so a cursor cannot be reused with a different order
+func sortSignature(sort []SortField) string {
+	parts := make([]string, 0, len(sort))
+	for _, field := range sort {
+		direction := "asc"
+		if field.Desc {
+			direction = "desc"
+		}
+		parts = append(parts, field.Column+":"+direction)
+	}
+	return strings.Join(parts, ",")
+}
+
+// sortValue returns the value of a sortable column for student
+func sortValue(student model.Student, column string) interface{} {
+	switch column {
+	case "student_id":
+		return student.StudentID
+	case "student_name":
+		return student.StudentName
+	case "subject":
+		return student.Subject
+	case "grade":
+		return student.Grade
+	}
+	return nil
+}
+
+// encodeCursor builds the opaque cursor pointing just after student
+func encodeCursor(sort []SortField, student model.Student) string {
+	cursor := pageCursor{Sort: sortSignature(sort)}
+	for _, field := range sort {
+		cursor.Values = append(cursor.Values, sortValue(student, field.Column))
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor validates an opaque cursor against the sort it is used with and returns its key values
+func decodeCursor(encoded string, sort []SortField) ([]interface{}, error) {
+	verr := &ValidationError{}
 
-	totalPages := int(math.Ceil(float64(totalCount) / float64(limit)))
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	var cursor pageCursor
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		verr.Add("cursor", "malformed cursor")
+		return nil, verr
+	}
+	if cursor.Sort != sortSignature(sort) {
+		verr.Add("cursor", "cursor was issued for sort %q", cursor.Sort)
+		return nil, verr
+	}
+	if len(cursor.Values) != len(sort) {
+		verr.Add("cursor", "malformed cursor")
+		return nil, verr
+	}
 
-	return students, totalCount, totalPages, nil
+	// JSON numbers decode as float64; grades are compared as integers
+	for i, field := range sort {
+		switch value := cursor.Values[i].(type) {
+		case float64:
+			if field.Column != "grade" {
+				verr.Add("cursor", "malformed cursor")
+				return nil, verr
+			}
+			cursor.Values[i] = int(value)
+		case string:
+			if field.Column == "grade" {
+				verr.Add("cursor", "malformed cursor")
+				return nil, verr
+			}
+		default:
+			verr.Add("cursor", "malformed cursor")
+			return nil, verr
+		}
+	}
+	return cursor.Values, nil
+}
+
+// keysetCondition builds the WHERE condition selecting rows after the key
+// values in sort order. With mixed directions a row tuple comparison cannot be
+// used, so it expands to (a > ?) OR (a = ? AND b < ?) OR ...
+func keysetCondition(sort []SortField, values []interface{}) (string, []interface{}) {
+	var disjuncts []string
+	var args []interface{}
+	for i, field := range sort {
+		var conjuncts []string
+		for j := 0; j < i; j++ {
+			conjuncts = append(conjuncts, sort[j].Column+" = ?")
+			args = append(args, values[j])
+		}
+		operator := ">"
+		if field.Desc {
+			operator = "<"
+		}
+		conjuncts = append(conjuncts, field.Column+" "+operator+" ?")
+		args = append(args, values[i])
+		disjuncts = append(disjuncts, "("+strings.Join(conjuncts, " AND ")+")")
+	}
+	return "(" + strings.Join(disjuncts, " OR ") + ")", args
 }
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"backend/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsCollectors returns metrics that read the current state of the
+// service when scraped. Register them once per process.
+func (s *UploadService) MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "active_jobs",
+			Help:      "Import jobs being processed.",
+		}, func() float64 { return float64(s.countJobs(StatusProcessing)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "queue_depth",
+			Help:      "Import jobs saved and waiting for a worker slot.",
+		}, func() float64 { return float64(s.countJobs(StatusQueued)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "progress_subscribers",
+			Help:      "Open progress streams (SSE and WebSocket), not counting the webhook sender.",
+		}, func() float64 { return float64(s.ProgressBusStats().Subscribers) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "progress_events_published_total",
+			Help:      "Progress events broadcast to subscribers.",
+		}, func() float64 { return float64(s.ProgressBusStats().Published) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "progress_events_dropped_total",
+			Help:      "Progress events lost by subscribers that fell behind, forcing them to resync.",
+		}, func() float64 { return float64(s.ProgressBusStats().Dropped) }),
+	}
+}
+
+func (s *UploadService) countJobs(status string) int {
+	s.fileProgressLock.RLock()
+	defer s.fileProgressLock.RUnlock()
+
+	count := 0
+	for _, progress := range s.fileProgressMap {
+		if progress.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// observeJobFinished records a job that has just reached its final status
+func observeJobFinished(progress *ProgressInfo) {
+	metrics.JobsFinished.WithLabelValues(progress.Status).Inc()
+	metrics.JobDuration.WithLabelValues(progress.Status).Observe(progress.EndTime.Sub(progress.StartTime).Seconds())
+}
+
+// observeBatchInsert records the outcome of one saveBatch transaction
+func observeBatchInsert(timings JobTimings, rows int64, err error) {
+	if err != nil {
+		metrics.BatchInsertDuration.WithLabelValues("error").Observe((timings.DBWrite + timings.Commit).Seconds())
+		return
+	}
+	metrics.BatchInsertDuration.WithLabelValues("ok").Observe((timings.DBWrite + timings.Commit).Seconds())
+	metrics.RowsInserted.Add(float64(rows))
+}
@@ -1,36 +1,227 @@
 package service
 
 import (
+	"backend/internal/config"
+	"backend/internal/metrics"
 	"backend/internal/model"
-	"encoding/csv"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"gorm.io/gorm"
 	"io"
 	"log"
 	//"log"
-	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// maxRowErrors caps how many row errors are kept per file so a badly broken
+// file cannot grow the progress map without bound
+const maxRowErrors = 100
+
+// Job statuses
+const (
+	StatusUploading  = "uploading"  // the file is being saved
+	StatusQueued     = "queued"     // saved and waiting to be processed
+	StatusProcessing = "processing" // rows are being imported
+	StatusCompleted  = "completed"
+	StatusError      = "error"
+	StatusCancelled  = "cancelled" // stopped by CancelJob; rows saved before that are kept
+)
+
 type ProgressInfo struct {
+	JobID        string
+	BatchID      string
 	FileName     string
+	ParentFile   string // archive the file was extracted from, if any
 	TotalRecords int
 	Processed    int
-	Status       string // "processing", "completed", "error"
+	Rejected     int
+	Duplicates   int
+	Status       string // one of the Status constants
 	Error        string
-	StartTime    time.Time
+	RowErrors    []RowError
+	StartTime    time.Time // when the job was created, then when processing started
 	EndTime      time.Time
+	Bytes        int64 // size of the data, after decompression
+	Workers      int   // chosen by calculateWorkers from Bytes
+	Timings      JobTimings
+}
+
+// JobTimings breaks down where a job spent its time. Upload and QueueWait are
+// wall-clock time before processing. The other phases are summed over the
+// reader and the workers, which run concurrently, so together they can exceed
+// the processing time; comparing them shows which one limits throughput.
+type JobTimings struct {
+	Upload    time.Duration // receiving the request and saving the file, as the batch's UploadSeconds; for files extracted from an archive, that of the archive
+	QueueWait time.Duration // from being queued until a worker slot was free and processing started
+	Parse     time.Duration // reading and decoding records, including the pre-scan
+	Validate  time.Duration // converting and validating rows
+	DBWrite   time.Duration // executing inserts, updates and backups
+	Commit    time.Duration // committing them
+}
+
+func (t *JobTimings) add(other JobTimings) {
+	t.Upload += other.Upload
+	t.QueueWait += other.QueueWait
+	t.Parse += other.Parse
+	t.Validate += other.Validate
+	t.DBWrite += other.DBWrite
+	t.Commit += other.Commit
+}
+
+// RowError describes a problem with a single row, identified by its line in the source file
+type RowError struct {
+	Line      int
+	StudentID string
+	Message   string
+}
+
+// DuplicatePolicy decides which row is kept when a student ID appears more than once in a file
+type DuplicatePolicy string
+
+const (
+	DuplicateFirstWins DuplicatePolicy = "first" // keep the earliest row, skip the rest
+	DuplicateLastWins  DuplicatePolicy = "last"  // keep the latest row, skip the earlier ones
+	DuplicateError     DuplicatePolicy = "error" // reject the whole file
+)
+
+// ParseDuplicatePolicy converts a form value into a DuplicatePolicy, defaulting to first wins
+func ParseDuplicatePolicy(value string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "":
+		return DuplicateFirstWins, nil
+	case DuplicateFirstWins, DuplicateLastWins, DuplicateError:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid duplicate policy %q: must be one of first, last, error", value)
+}
+
+// ConflictPolicy decides what happens to a row whose student ID is already stored
+type ConflictPolicy string
+
+const (
+	ConflictSkip   ConflictPolicy = "skip"   // keep the stored row
+	ConflictUpdate ConflictPolicy = "update" // overwrite it, keeping a backup so the job can be rolled back
+)
+
+// ParseConflictPolicy converts a form value into a ConflictPolicy, defaulting to skip
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "":
+		return ConflictSkip, nil
+	case ConflictSkip, ConflictUpdate:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q: must be one of skip, update", value)
+}
+
+// ImportOptions holds the per-upload settings for processing a file
+type ImportOptions struct {
+	DuplicatePolicy DuplicatePolicy
+	OnConflict      ConflictPolicy // what to do with student IDs that are already stored
+	Format          Format         // FormatAuto sniffs the format from the content
+	Dialect         Dialect        // layout of delimited text; unset fields are sniffed or defaulted
+	Sheet           string         // worksheet for FormatXLSX; empty means the first sheet
+	Encoding        string         // character encoding of text formats; empty means detect
+	MapColumns      bool           // find columns by their header names instead of by position
+}
+
+// DefaultImportOptions returns the options used when an upload does not specify any
+func DefaultImportOptions() ImportOptions {
+	return ImportOptions{DuplicatePolicy: DuplicateFirstWins, OnConflict: ConflictSkip}
+}
+
+// cancellableSource stops reading once ctx is cancelled
+type cancellableSource struct {
+	RecordSource
+	ctx context.Context
+}
+
+func (c cancellableSource) Read() ([]string, int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.RecordSource.Read()
+}
+
+// timedSource adds the time spent reading records to elapsed
+type timedSource struct {
+	RecordSource
+	elapsed *time.Duration
+}
+
+func (t timedSource) Read() ([]string, int, error) {
+	start := time.Now()
+	record, line, err := t.RecordSource.Read()
+	*t.elapsed += time.Since(start)
+	return record, line, err
+}
+
+// csvRow is a single record tagged with the line it starts on in the source file
+type csvRow struct {
+	Line   int
+	Fields []string
+}
+
+// lineSpan records the first and last line a student ID was seen on
+type lineSpan struct {
+	First int
+	Last  int
+}
+
+// ImportSummary is the outcome of a dry run: what an import of the file would do
+type ImportSummary struct {
+	FileName     string
+	TotalRecords int
+	ValidRows    int // rows that pass validation and duplicate resolution
+	Rejected     int // rows that fail parsing or validation
+	Duplicates   int // rows skipped by the duplicate policy
+	ExistingInDB int // valid rows whose student ID is already stored
+	WouldInsert  int
+	WouldUpdate  int // existing rows that would be overwritten, with OnConflict set to update
+	SampleRows   []model.Student
+	Errors       []RowError
+}
+
+// recordIndex is the result of the pre-scan of a file
+type recordIndex struct {
+	Total          int
+	IDs            map[string]lineSpan
+	DuplicateCount int
+	Duplicates     []RowError // the first maxRowErrors duplicate rows
+}
+
+// NewID returns a random identifier for jobs and batches
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return hex.EncodeToString(b)
 }
 
 type UploadService struct {
-	db                *gorm.DB
-	fileProgressMap   map[string]*ProgressInfo
-	fileProgressLock  sync.RWMutex
-	progressListeners map[chan *ProgressInfo]bool // Track SSE listeners
-	listenerLock      sync.RWMutex
+	db               *gorm.DB
+	fileProgressMap  map[string]*ProgressInfo
+	fileProgressLock sync.RWMutex
+	jobCancels       map[string]context.CancelFunc // running jobs, guarded by fileProgressLock
+	batches          map[string]*batchInfo         // guarded by fileProgressLock
+	progressBus      *progressBus
+
+	progressThrottles map[string]*progressThrottle // active jobs, guarded by fileProgressLock
+	progressInterval  time.Duration
+	progressMinChange float64 // percent
+
+	jobRetention time.Duration // how long finished jobs are kept; 0 keeps them forever
+	lastEviction time.Time     // guarded by fileProgressLock
+
+	prescanSemaphore chan struct{} // limits concurrent pre-scans, which may load whole workbooks
 
 	////////////////////////////////////
 	workerSemaphore      chan struct{} // Semaphore to limit total workers
@@ -43,60 +234,86 @@ func NewUploadService(db *gorm.DB) *UploadService {
 	return &UploadService{
 		db:                   db,
 		fileProgressMap:      make(map[string]*ProgressInfo),
-		progressListeners:    make(map[chan *ProgressInfo]bool),
+		jobCancels:           make(map[string]context.CancelFunc),
+		batches:              make(map[string]*batchInfo),
+		progressBus:          newProgressBus(),
+		progressThrottles:    make(map[string]*progressThrottle),
+		progressInterval:     config.ProgressInterval,
+		progressMinChange:    config.ProgressMinChange,
+		jobRetention:         config.JobRetention,
+		prescanSemaphore:     make(chan struct{}, max(2, runtime.NumCPU()/2)),
 		workerSemaphore:      make(chan struct{}, maxWorkers),
 		maxConcurrentWorkers: maxWorkers,
 	}
 }
 
-func (s *UploadService) RegisterProgressListener(ch chan *ProgressInfo) {
-	s.listenerLock.Lock()
-	defer s.listenerLock.Unlock()
-	s.progressListeners[ch] = true
-}
-
-// UnregisterProgressListener removes a client from receiving progress updates
-func (s *UploadService) UnregisterProgressListener(ch chan *ProgressInfo) {
-	s.listenerLock.Lock()
-	defer s.listenerLock.Unlock()
-	delete(s.progressListeners, ch)
-}
-
-// BroadcastProgress sends progress updates to all registered listeners
+// BroadcastProgress publishes a copy of progress as the next event. It must be
+// called with fileProgressLock held, which keeps events in the same order as
+// the changes they describe; it never waits for subscribers.
 func (s *UploadService) BroadcastProgress(progress *ProgressInfo) {
-	s.listenerLock.RLock()
-	defer s.listenerLock.RUnlock()
-
-	for listener := range s.progressListeners {
-		select {
-		case listener <- progress:
-		default:
-			// Skip if the listener is not ready
-		}
+	if _, wasActive := s.progressThrottles[progress.JobID]; wasActive && !progress.IsActive() {
+		observeJobFinished(progress)
 	}
+	s.trackBroadcast(progress)
+	s.progressBus.publish(progress)
 }
 
-func (s *UploadService) updateProgress(fileName string, processed int) {
+func (s *UploadService) updateProgress(jobID string, processed int) {
 	s.fileProgressLock.Lock()
 	defer s.fileProgressLock.Unlock()
 
-	if progress, exists := s.fileProgressMap[fileName]; exists {
+	metrics.RowsProcessed.Add(float64(processed))
+	if progress, exists := s.fileProgressMap[jobID]; exists {
 		progress.Processed += processed
 		// Ensure that Processed does not exceed TotalRecords
 		if progress.Processed > progress.TotalRecords {
 			progress.Processed = progress.TotalRecords
 		}
-		s.BroadcastProgress(progress)
+		s.broadcastThrottled(progress)
+	}
+}
+
+// addTimings adds time a job spent in each phase. It is not broadcast by
+// itself; the next progress update carries it.
+func (s *UploadService) addTimings(jobID string, timings JobTimings) {
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+
+	if progress, exists := s.fileProgressMap[jobID]; exists {
+		progress.Timings.add(timings)
+	}
+}
+
+// recordSkipped counts a row that will not be inserted and keeps its error for reporting
+func (s *UploadService) recordSkipped(jobID string, rowErr RowError, duplicate bool) {
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+
+	metrics.RowsProcessed.Inc()
+	if !duplicate {
+		metrics.RowsRejected.Inc()
+	}
+
+	if progress, exists := s.fileProgressMap[jobID]; exists {
+		progress.Processed++
+		if duplicate {
+			progress.Duplicates++
+		} else {
+			progress.Rejected++
+		}
+		if len(progress.RowErrors) < maxRowErrors {
+			progress.RowErrors = append(progress.RowErrors, rowErr)
+		}
 	}
 }
 
 // Update progress with error and broadcast to listeners
-func (s *UploadService) updateProgressError(fileName string, errorMsg string) {
+func (s *UploadService) updateProgressError(jobID string, errorMsg string) {
 	s.fileProgressLock.Lock()
 	defer s.fileProgressLock.Unlock()
 
-	if progress, exists := s.fileProgressMap[fileName]; exists {
-		progress.Status = "error"
+	if progress, exists := s.fileProgressMap[jobID]; exists {
+		progress.Status = StatusError
 		progress.Error = errorMsg
 		progress.EndTime = time.Now()
 		s.BroadcastProgress(progress)
@@ -105,13 +322,34 @@ func (s *UploadService) updateProgressError(fileName string, errorMsg string) {
 
 ////////////////////////////////////////////////////////
 
+// GetFileProgress returns the progress of the most recent job for fileName
 func (s *UploadService) GetFileProgress(fileName string) *ProgressInfo {
 	s.fileProgressLock.RLock()
 	defer s.fileProgressLock.RUnlock()
 
-	if progress, exists := s.fileProgressMap[fileName]; exists {
+	var latest *ProgressInfo
+	for _, progress := range s.fileProgressMap {
+		if progress.FileName == fileName && (latest == nil || progress.StartTime.After(latest.StartTime)) {
+			latest = progress
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+
+	// Return a copy to avoid race conditions
+	copyProgress := latest.clone()
+	return &copyProgress
+}
+
+// GetJobProgress returns the progress of a single job, or nil if it is unknown
+func (s *UploadService) GetJobProgress(jobID string) *ProgressInfo {
+	s.fileProgressLock.RLock()
+	defer s.fileProgressLock.RUnlock()
+
+	if progress, exists := s.fileProgressMap[jobID]; exists {
 		// Return a copy to avoid race conditions
-		copyProgress := *progress
+		copyProgress := progress.clone()
 		return &copyProgress
 	}
 
@@ -125,61 +363,269 @@ func (s *UploadService) GetAllFileProgress() []*ProgressInfo {
 	result := make([]*ProgressInfo, 0, len(s.fileProgressMap))
 	for _, progress := range s.fileProgressMap {
 		// Create a copy to avoid race conditions
-		copyProgress := *progress
+		copyProgress := progress.clone()
 		result = append(result, &copyProgress)
 	}
 
 	return result
 }
 
+// ProcessCSV processes a file with the default import options
 func (s *UploadService) ProcessCSV(filePath string) error {
-	fileName := filepath.Base(filePath)
+	return s.ProcessFile(filePath, DefaultImportOptions())
+}
+
+// ProcessFile creates a job for the file at filePath and processes it
+func (s *UploadService) ProcessFile(filePath string, opts ImportOptions) error {
+	jobID := s.CreateJob(filepath.Base(filePath), "", "")
+	return s.ProcessJob(jobID, filePath, opts)
+}
+
+// CreateJob registers a queued job for fileName and returns its ID. batchID
+// links the job to the upload it arrived in, and parentFile names the archive
+// it was extracted from; both may be empty.
+func (s *UploadService) CreateJob(fileName, batchID, parentFile string) string {
+	return s.createJob(fileName, batchID, parentFile, StatusQueued)
+}
+
+// CreateUploadingJob creates a job for a file that is still being saved. Call
+// JobUploaded once it is, or FailJob if saving fails. Its upload time counts
+// from when the batch's request was received.
+func (s *UploadService) CreateUploadingJob(fileName, batchID string) string {
+	return s.createJob(fileName, batchID, "", StatusUploading)
+}
+
+func (s *UploadService) createJob(fileName, batchID, parentFile, status string) string {
+	jobID := NewID()
+
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+	s.evictFinished(time.Now())
+	progress := &ProgressInfo{
+		JobID:      jobID,
+		BatchID:    batchID,
+		FileName:   fileName,
+		ParentFile: parentFile,
+		Status:     status,
+		StartTime:  time.Now(),
+	}
+	s.fileProgressMap[jobID] = progress
+	if batch, exists := s.batches[batchID]; exists {
+		batch.jobIDs = append(batch.jobIDs, jobID)
+		if status == StatusUploading {
+			progress.StartTime = batch.receivedAt
+		}
+	}
+	s.BroadcastProgress(progress)
+
+	return jobID
+}
+
+// evictFinished forgets jobs that finished more than jobRetention ago, and
+// batches older than that whose jobs have all been forgotten, so the maps do
+// not grow without bound. It runs at most once per minute, or per
+// jobRetention if that is shorter, and must be called with fileProgressLock held.
+func (s *UploadService) evictFinished(now time.Time) {
+	if s.jobRetention <= 0 || now.Sub(s.lastEviction) < min(time.Minute, s.jobRetention) {
+		return
+	}
+	s.lastEviction = now
+	cutoff := now.Add(-s.jobRetention)
+
+	for jobID, progress := range s.fileProgressMap {
+		if !progress.IsActive() && progress.EndTime.Before(cutoff) {
+			delete(s.fileProgressMap, jobID)
+		}
+	}
+	for batchID, batch := range s.batches {
+		if batch.receivedAt.After(cutoff) {
+			continue
+		}
+		remaining := false
+		for _, jobID := range batch.jobIDs {
+			if _, exists := s.fileProgressMap[jobID]; exists {
+				remaining = true
+				break
+			}
+		}
+		if !remaining {
+			delete(s.batches, batchID)
+		}
+	}
+}
+
+// JobUploaded moves a job created with CreateUploadingJob to the queue
+func (s *UploadService) JobUploaded(jobID string) {
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+
+	if progress, exists := s.fileProgressMap[jobID]; exists && progress.Status == StatusUploading {
+		progress.Status = StatusQueued
+		progress.Timings.Upload = time.Since(progress.StartTime)
+		s.BroadcastProgress(progress)
+	}
+}
+
+// ArchiveUploaded queues the data files extracted from an archive saved under
+// a job created with CreateUploadingJob. The archive's job becomes the job of
+// the first file, and each other file gets a job with the same upload time.
+// It returns the job IDs in the order of fileNames, which must not be empty,
+// or nil if the job was cancelled while uploading.
+func (s *UploadService) ArchiveUploaded(jobID string, fileNames []string) []string {
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+
+	progress, exists := s.fileProgressMap[jobID]
+	if !exists || progress.Status != StatusUploading {
+		return nil
+	}
+	archive := progress.FileName
+	upload := time.Since(progress.StartTime)
+	progress.FileName = fileNames[0]
+	progress.ParentFile = archive
+	progress.Status = StatusQueued
+	progress.Timings.Upload = upload
+	s.BroadcastProgress(progress)
+
+	jobIDs := []string{jobID}
+	for _, fileName := range fileNames[1:] {
+		entry := &ProgressInfo{
+			JobID:      NewID(),
+			BatchID:    progress.BatchID,
+			FileName:   fileName,
+			ParentFile: archive,
+			Status:     StatusQueued,
+			StartTime:  progress.StartTime,
+			Timings:    JobTimings{Upload: upload},
+		}
+		s.fileProgressMap[entry.JobID] = entry
+		if batch, exists := s.batches[progress.BatchID]; exists {
+			batch.jobIDs = append(batch.jobIDs, entry.JobID)
+		}
+		s.BroadcastProgress(entry)
+		jobIDs = append(jobIDs, entry.JobID)
+	}
+	return jobIDs
+}
+
+// FailJob marks a job as failed before it could be processed
+func (s *UploadService) FailJob(jobID, errorMsg string) {
+	s.updateProgressError(jobID, errorMsg)
+}
+
+// CancelJob stops a queued or processing job. Rows already saved are kept and
+// can be removed with RollbackJob.
+func (s *UploadService) CancelJob(jobID string) error {
+	s.fileProgressLock.Lock()
+	defer s.fileProgressLock.Unlock()
+
+	progress, exists := s.fileProgressMap[jobID]
+	if !exists {
+		return ErrJobNotFound
+	}
+	if !progress.IsActive() {
+		return ErrJobFinished
+	}
+
+	if cancel, running := s.jobCancels[jobID]; running {
+		// ProcessJob notices, stops reading and reports the cancellation
+		cancel()
+		return nil
+	}
+	progress.Status = StatusCancelled
+	progress.EndTime = time.Now()
+	s.BroadcastProgress(progress)
+	return nil
+}
+
+// ProcessJob parses the file at filePath and inserts its rows, resolving
+// duplicate student IDs deterministically according to opts.DuplicatePolicy.
+// The job stays queued until a worker slot is free.
+func (s *UploadService) ProcessJob(jobID, filePath string, opts ImportOptions) error {
+	// The slot goes to the first worker; until then it is released on return
+	s.workerSemaphore <- struct{}{}
+	slotHeld := true
+	defer func() {
+		if slotHeld {
+			<-s.workerSemaphore
+		}
+	}()
 	startTime := time.Now()
 
 	// Initialize progress tracking
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	s.fileProgressLock.Lock()
-	s.fileProgressMap[fileName] = &ProgressInfo{
-		FileName:     fileName,
-		TotalRecords: 0,
-		Processed:    0,
-		Status:       "processing",
-		StartTime:    startTime,
+	progress, exists := s.fileProgressMap[jobID]
+	if !exists {
+		s.fileProgressLock.Unlock()
+		return fmt.Errorf("unknown job %s", jobID)
 	}
+	if progress.Status == StatusCancelled {
+		s.fileProgressLock.Unlock()
+		return nil
+	}
+	progress.Status = StatusProcessing
+	progress.Timings.QueueWait = startTime.Sub(progress.StartTime) - progress.Timings.Upload
+	progress.StartTime = startTime
+	fileName := progress.FileName
+	batchID := progress.BatchID
+	s.jobCancels[jobID] = cancel
+	s.BroadcastProgress(progress)
 	s.fileProgressLock.Unlock()
 
-	// Get file info for size
-	fileInfo, err := os.Stat(filePath)
+	defer func() {
+		s.fileProgressLock.Lock()
+		delete(s.jobCancels, jobID)
+		s.fileProgressLock.Unlock()
+	}()
+
+	// Get the (decompressed) data size
+	size, err := dataSize(filePath)
 	if err != nil {
-		s.updateProgressError(fileName, "Failed to get file info: "+err.Error())
+		s.updateProgressError(jobID, "Failed to get file info: "+err.Error())
 		return err
 	}
 
 	// Calculate number of workers based on file size
-	numWorkers := calculateWorkers(fileInfo.Size())
-	log.Printf("Using %d workers for file %s (size: %d bytes)\n", numWorkers, fileName, fileInfo.Size())
+	numWorkers := calculateWorkers(size)
+	log.Printf("Using %d workers for file %s (size: %d bytes)\n", numWorkers, fileName, size)
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		s.updateProgressError(fileName, "Failed to open file: "+err.Error())
-		return err
-	}
-	defer file.Close()
+	s.fileProgressLock.Lock()
+	s.fileProgressMap[jobID].Bytes = size
+	s.fileProgressMap[jobID].Workers = numWorkers
+	s.fileProgressLock.Unlock()
 
-	// Count total records
-	totalRecords, err := s.countRecords(filePath)
+	// Scan the file once to count records and find where each student ID occurs
+	indexStart := time.Now()
+	index, err := s.indexRecords(filePath, opts)
 	if err != nil {
-		s.updateProgressError(fileName, "Failed to count records: "+err.Error())
+		s.updateProgressError(jobID, "Failed to count records: "+err.Error())
 		return err
 	}
 
 	s.fileProgressLock.Lock()
-	s.fileProgressMap[fileName].TotalRecords = totalRecords
+	s.fileProgressMap[jobID].TotalRecords = index.Total
+	s.fileProgressMap[jobID].Timings.Parse += time.Since(indexStart)
 	s.fileProgressLock.Unlock()
 
-	// Reopen the file for actual processing
-	file.Seek(0, 0)
-	reader := csv.NewReader(file)
-	reader.Read() // Skip header row
+	if opts.DuplicatePolicy == DuplicateError && index.DuplicateCount > 0 {
+		s.fileProgressLock.Lock()
+		s.fileProgressMap[jobID].RowErrors = index.Duplicates
+		s.fileProgressLock.Unlock()
+
+		err := fmt.Errorf("found %d duplicate student ID rows, first at line %d", index.DuplicateCount, index.Duplicates[0].Line)
+		s.updateProgressError(jobID, err.Error())
+		return err
+	}
+
+	source, cols, err := openSource(filePath, opts)
+	if err != nil {
+		s.updateProgressError(jobID, "Failed to open file: "+err.Error())
+		return err
+	}
+	defer source.Close()
 
 	// Buffer size based on number of workers
 	bufferSize := 1000
@@ -187,51 +633,214 @@ func (s *UploadService) ProcessCSV(filePath string) error {
 		bufferSize = numWorkers * 100
 	}
 
-	studentCh := make(chan []string, bufferSize)
+	studentCh := make(chan csvRow, bufferSize)
 	var wg sync.WaitGroup
-	existingIDs := sync.Map{}
+
+	// The first batch that cannot be saved stops reading and fails the job
+	var saveErr error
+	var saveErrOnce sync.Once
+	failSave := func(err error) {
+		saveErrOnce.Do(func() {
+			saveErr = err
+			cancel()
+		})
+	}
 
 	// Launch workers
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
-		go s.worker(fileName, studentCh, &existingIDs, &wg)
+		go s.worker(ctx, jobID, batchID, cols, opts.OnConflict, studentCh, failSave, i == 0, &wg)
 	}
+	slotHeld = false
 
-	// Read records and send them to workers
+	// Read records in file order and send the ones selected by the duplicate policy to workers
+	var readErr error
+	var readTime time.Duration
 	go func() {
-		for {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				log.Println("Error reading CSV record:", err)
-				continue
-			}
-			studentCh <- record
-		}
-		close(studentCh) // Close the channel after all records are read
+		defer close(studentCh) // Close the channel after all records are read
+		readErr = scanRows(timedSource{cancellableSource{source, ctx}, &readTime}, cols, index, opts.DuplicatePolicy,
+			func(row csvRow) { studentCh <- row },
+			func(rowErr RowError, duplicate bool) { s.recordSkipped(jobID, rowErr, duplicate) })
 	}()
 
 	// Wait for all workers to finish
 	wg.Wait()
+	s.addTimings(jobID, JobTimings{Parse: readTime})
+
+	if saveErr != nil {
+		s.updateProgressError(jobID, "Failed to save records: "+saveErr.Error())
+		return saveErr
+	}
+	if errors.Is(readErr, context.Canceled) {
+		s.fileProgressLock.Lock()
+		if progress, exists := s.fileProgressMap[jobID]; exists {
+			progress.Status = StatusCancelled
+			progress.EndTime = time.Now()
+			s.BroadcastProgress(progress)
+		}
+		s.fileProgressLock.Unlock()
+		log.Printf("Processing cancelled for %s\n", fileName)
+		return nil
+	}
+	if readErr != nil {
+		s.updateProgressError(jobID, "Failed to read file: "+readErr.Error())
+		return readErr
+	}
 
 	// Update progress as completed
+	var timings JobTimings
 	s.fileProgressLock.Lock()
-	if progress, exists := s.fileProgressMap[fileName]; exists {
-		progress.Status = "completed"
+	if progress, exists := s.fileProgressMap[jobID]; exists {
+		progress.Status = StatusCompleted
 		progress.EndTime = time.Now()
 		progress.Processed = progress.TotalRecords // Ensure processed equals total records
+		timings = progress.Timings
 		s.BroadcastProgress(progress)
 	}
 	s.fileProgressLock.Unlock()
 
 	// Log processing completion
-	log.Printf("Processing completed for %s in %v\n", fileName, time.Since(startTime))
+	log.Printf("Processing completed for %s in %v (queue wait %v, parse %v, validate %v, DB write %v, commit %v)\n",
+		fileName, time.Since(startTime), timings.QueueWait, timings.Parse, timings.Validate, timings.DBWrite, timings.Commit)
 
 	return nil
 }
 
+// PreviewFile runs the same parsing, validation and duplicate resolution as
+// ProcessFile, and checks valid rows against the students table, but writes
+// nothing. Up to sampleSize valid rows and errors are returned in the summary.
+func (s *UploadService) PreviewFile(filePath string, opts ImportOptions, sampleSize int) (*ImportSummary, error) {
+	index, err := s.indexRecords(filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ImportSummary{
+		FileName:     filepath.Base(filePath),
+		TotalRecords: index.Total,
+		SampleRows:   []model.Student{},
+		Errors:       []RowError{},
+	}
+	addError := func(rowErr RowError) {
+		if len(summary.Errors) < sampleSize {
+			summary.Errors = append(summary.Errors, rowErr)
+		}
+	}
+
+	if opts.DuplicatePolicy == DuplicateError && index.DuplicateCount > 0 {
+		// The real import would reject the file before reading any row
+		summary.Duplicates = index.DuplicateCount
+		for _, rowErr := range index.Duplicates {
+			addError(rowErr)
+		}
+		return summary, nil
+	}
+
+	source, cols, err := openSource(filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	// Valid IDs are checked against the database in batches, like saveBatch inserts them
+	var pendingIDs []string
+	var dbErr error
+	checkExisting := func() {
+		if len(pendingIDs) == 0 || dbErr != nil {
+			return
+		}
+		var existing int64
+		dbErr = s.db.Model(&model.Student{}).Where("student_id IN ?", pendingIDs).Count(&existing).Error
+		summary.ExistingInDB += int(existing)
+		pendingIDs = pendingIDs[:0]
+	}
+
+	readErr := scanRows(source, cols, index, opts.DuplicatePolicy,
+		func(row csvRow) {
+			student, err := cols.parseStudent(row.Fields)
+			if err != nil {
+				summary.Rejected++
+				addError(RowError{Line: row.Line, StudentID: cols.studentID(row.Fields), Message: err.Error()})
+				return
+			}
+			summary.ValidRows++
+			if len(summary.SampleRows) < sampleSize {
+				summary.SampleRows = append(summary.SampleRows, student)
+			}
+			pendingIDs = append(pendingIDs, student.StudentID)
+			if len(pendingIDs) >= 1000 {
+				checkExisting()
+			}
+		},
+		func(rowErr RowError, duplicate bool) {
+			if duplicate {
+				summary.Duplicates++
+			} else {
+				summary.Rejected++
+			}
+			addError(rowErr)
+		})
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read file: %w", readErr)
+	}
+	checkExisting()
+	if dbErr != nil {
+		return nil, fmt.Errorf("failed to check existing students: %w", dbErr)
+	}
+
+	summary.WouldInsert = summary.ValidRows - summary.ExistingInDB
+	if opts.OnConflict == ConflictUpdate {
+		summary.WouldUpdate = summary.ExistingInDB
+	}
+	return summary, nil
+}
+
+// scanRows reads the remaining records in file order, passing the rows selected
+// by the duplicate policy to keep and everything else to skip. Duplicates are
+// resolved here, against the pre-scan index, so the outcome never depends on
+// how rows are later scheduled across workers.
+func scanRows(source RecordSource, cols columnMap, index *recordIndex, policy DuplicatePolicy, keep func(csvRow), skip func(RowError, bool)) error {
+	for {
+		record, line, err := source.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var rowErr *RowParseError
+			if !errors.As(err, &rowErr) {
+				return err
+			}
+			skip(RowError{Line: rowErr.Line, Message: rowErr.Err.Error()}, false)
+			continue
+		}
+
+		studentID := cols.studentID(record)
+		span, exists := index.IDs[studentID]
+		if exists && !keepRow(policy, span, line) && cols.valid(record) {
+			skip(RowError{
+				Line:      line,
+				StudentID: studentID,
+				Message:   fmt.Sprintf("duplicate student ID (kept line %d)", keptLine(policy, span)),
+			}, true)
+			continue
+		}
+		keep(csvRow{Line: line, Fields: record})
+	}
+}
+
+// keepRow reports whether the row on line should be inserted under policy
+func keepRow(policy DuplicatePolicy, span lineSpan, line int) bool {
+	return keptLine(policy, span) == line
+}
+
+// keptLine returns the line whose row survives duplicate resolution under policy
+func keptLine(policy DuplicatePolicy, span lineSpan) int {
+	if policy == DuplicateLastWins {
+		return span.Last
+	}
+	return span.First
+}
+
 // calculateWorkers determines the appropriate number of workers based on file size
 func calculateWorkers(fileSize int64) int {
 	// Base calculations on available CPUs
@@ -261,109 +870,205 @@ func calculateWorkers(fileSize int64) int {
 	return cpus
 }
 
-func (s *UploadService) worker(fileName string, studentCh chan []string, existingIDs *sync.Map, wg *sync.WaitGroup) {
-	s.workerSemaphore <- struct{}{}
+// worker validates rows from studentCh and saves them in batches, passing
+// any error saving a batch to fail. Once ctx is done it only drains studentCh.
+// It waits for a worker slot unless hasSlot says it was handed one.
+func (s *UploadService) worker(ctx context.Context, jobID, batchID string, cols columnMap, onConflict ConflictPolicy, studentCh chan csvRow, fail func(error), hasSlot bool, wg *sync.WaitGroup) {
+	if !hasSlot {
+		s.workerSemaphore <- struct{}{}
+	}
 	defer func() {
 		// Release semaphore
 		<-s.workerSemaphore
 		wg.Done() // Only call wg.Done() once here
 	}()
 
-	// Remove this duplicate defer wg.Done()
-
 	var students []model.Student
-	processedCount := 0
+	pending := 0           // rows processed since the last progress update
+	var timings JobTimings // time spent since the last progress update
+	save := func() {
+		batchTimings, err := s.saveBatch(students, onConflict)
+		timings.add(batchTimings)
+		if err != nil {
+			fail(err)
+		}
+		students = nil
+	}
 
-	for record := range studentCh {
-		studentID := record[0]
-		if _, exists := existingIDs.Load(studentID); exists {
-			log.Printf("Skipping duplicate student ID: %s\n", studentID)
+	for row := range studentCh {
+		if ctx.Err() != nil {
+			// The job was cancelled or has failed; keep the reader from blocking
 			continue
 		}
-
-		grade, err := strconv.Atoi(record[3])
+		validateStart := time.Now()
+		student, err := cols.parseStudent(row.Fields)
+		timings.Validate += time.Since(validateStart)
 		if err != nil {
-			log.Println("Error converting grade to integer:", err)
+			s.recordSkipped(jobID, RowError{Line: row.Line, StudentID: cols.studentID(row.Fields), Message: err.Error()}, false)
 			continue
 		}
 
-		students = append(students, model.Student{
-			StudentID:   studentID,
-			StudentName: record[1],
-			Subject:     record[2],
-			Grade:       grade,
-		})
-
-		existingIDs.Store(studentID, true)
-		processedCount++
+		student.ImportJobID = jobID
+		student.ImportBatchID = batchID
+		students = append(students, student)
+		pending++
 
 		// Update progress periodically
-		if processedCount%100 == 0 {
-			s.updateProgress(fileName, processedCount)
+		if pending == 100 {
+			s.addTimings(jobID, timings)
+			s.updateProgress(jobID, pending)
+			pending, timings = 0, JobTimings{}
 		}
 
 		if len(students) >= 1000 {
-			s.saveBatch(students)
-			students = nil
+			save()
 		}
 	}
 
-	if len(students) > 0 {
-		s.saveBatch(students)
+	if len(students) > 0 && ctx.Err() == nil {
+		save()
 	}
 
 	// Final progress update for this worker
-	s.updateProgress(fileName, processedCount)
+	s.addTimings(jobID, timings)
+	s.updateProgress(jobID, pending)
 }
 
-func (s *UploadService) countRecords(filePath string) (int, error) {
-	file, err := os.Open(filePath)
+// indexRecords scans the file once, counting records and recording the first
+// and last line each student ID appears on among the valid rows
+func (s *UploadService) indexRecords(filePath string, opts ImportOptions) (*recordIndex, error) {
+	s.prescanSemaphore <- struct{}{}
+	defer func() { <-s.prescanSemaphore }()
+
+	source, cols, err := openSource(filePath, opts)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer file.Close()
+	defer source.Close()
 
-	reader := csv.NewReader(file)
-	reader.Read() // Skip header
-
-	count := 0
+	index := &recordIndex{IDs: make(map[string]lineSpan)}
 	for {
-		_, err := reader.Read()
+		record, line, err := source.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return count, err
+			// Malformed rows are counted but reported when the file is processed
+			var rowErr *RowParseError
+			if errors.As(err, &rowErr) {
+				index.Total++
+				continue
+			}
+			return index, err
+		}
+		index.Total++
+
+		// Only valid rows take part in duplicate resolution, so an invalid row
+		// or a blank ID never displaces a valid row
+		if !cols.valid(record) {
+			continue
 		}
-		count++
+		studentID := cols.studentID(record)
+		span, exists := index.IDs[studentID]
+		if !exists {
+			index.IDs[studentID] = lineSpan{First: line, Last: line}
+			continue
+		}
+		index.DuplicateCount++
+		if len(index.Duplicates) < maxRowErrors {
+			index.Duplicates = append(index.Duplicates, RowError{
+				Line:      line,
+				StudentID: studentID,
+				Message:   fmt.Sprintf("duplicate of line %d", span.First),
+			})
+		}
+		span.Last = line
+		index.IDs[studentID] = span
 	}
 
-	return count, nil
+	return index, nil
 }
 
-func (s *UploadService) saveBatch(students []model.Student) {
+// saveBatch inserts students. Stored student IDs are skipped, or with
+// ConflictUpdate overwritten after their current values are backed up for
+// RollbackJob; a student is backed up once per job, before its first change.
+// It returns the time spent writing and committing.
+func (s *UploadService) saveBatch(students []model.Student, onConflict ConflictPolicy) (JobTimings, error) {
 	if len(students) == 0 {
-		return
+		return JobTimings{}, nil
 	}
 
 	var values []interface{}
-	query := "INSERT INTO students (student_id, student_name, subject, grade) VALUES "
+	query := "INSERT INTO students (student_id, student_name, subject, grade, import_job_id, import_batch_id, created_at, updated_at) VALUES "
 
+	now := time.Now()
+	for i := range students {
+		students[i].UpdatedAt = now
+	}
 	for i, student := range students {
 		if i > 0 {
 			query += ","
 		}
-		query += "(?, ?, ?, ?)"
-		values = append(values, student.StudentID, student.StudentName, student.Subject, student.Grade)
+		query += "(?, ?, ?, ?, ?, ?, ?, ?)"
+		values = append(values, student.StudentID, student.StudentName, student.Subject, student.Grade,
+			student.ImportJobID, student.ImportBatchID, now, now)
 	}
 
-	query += " ON CONFLICT (student_id) DO NOTHING"
+	if onConflict != ConflictUpdate {
+		query += " ON CONFLICT (student_id) DO NOTHING"
+		var inserted int64
+		timings, err := s.timedTransaction(func(tx *gorm.DB) error {
+			result := tx.Exec(query, values...)
+			inserted = result.RowsAffected
+			return result.Error
+		})
+		observeBatchInsert(timings, inserted, err)
+		return timings, err
+	}
 
-	err := s.db.Exec(query, values...).Error
+	query += " ON CONFLICT (student_id) DO UPDATE SET student_name = EXCLUDED.student_name, subject = EXCLUDED.subject," +
+		" grade = EXCLUDED.grade, import_job_id = EXCLUDED.import_job_id, import_batch_id = EXCLUDED.import_batch_id," +
+		" updated_at = EXCLUDED.updated_at"
 
-	if err != nil {
-		//log.Println("Error inserting batch into database:", err)
-	} else {
-		//log.Printf("Inserted %d students into database\n", len(students))
+	ids := make([]string, len(students))
+	for i, student := range students {
+		ids[i] = student.StudentID
+	}
+	var written int64
+	timings, err := s.timedTransaction(func(tx *gorm.DB) error {
+		backup := "INSERT INTO import_backups (job_id, student_id, student_name, subject, grade, import_job_id, import_batch_id, created_at, updated_at) " +
+			"SELECT ?, student_id, student_name, subject, grade, import_job_id, import_batch_id, created_at, updated_at " +
+			"FROM students WHERE student_id IN ? ON CONFLICT (job_id, student_id) DO NOTHING"
+		if err := tx.Exec(backup, students[0].ImportJobID, ids).Error; err != nil {
+			return err
+		}
+		if err := recordImportGradeChanges(tx, students[0].ImportJobID, students, ids); err != nil {
+			return err
+		}
+		result := tx.Exec(query, values...)
+		written = result.RowsAffected
+		return result.Error
+	})
+	observeBatchInsert(timings, written, err)
+	return timings, err
+}
+
+// timedTransaction runs write in a transaction, timing its statements and the
+// commit separately
+func (s *UploadService) timedTransaction(write func(tx *gorm.DB) error) (timings JobTimings, err error) {
+	start := time.Now()
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return timings, tx.Error
+	}
+	if err := write(tx); err != nil {
+		tx.Rollback()
+		timings.DBWrite = time.Since(start)
+		return timings, err
 	}
+	commitStart := time.Now()
+	timings.DBWrite = commitStart.Sub(start)
+	err = tx.Commit().Error
+	timings.Commit = time.Since(commitStart)
+	return timings, err
 }
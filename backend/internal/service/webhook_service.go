@@ -0,0 +1,334 @@
+package service
+
+import (
+	"backend/internal/model"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook event types, named as the matching progress stream events
+const (
+	WebhookJobCompleted = "job.completed"
+	WebhookJobFailed    = "job.failed"
+	WebhookJobCancelled = "job.cancelled"
+)
+
+// webhookEvents maps the final job statuses to the events they send
+var webhookEvents = map[string]string{
+	StatusCompleted: WebhookJobCompleted,
+	StatusError:     WebhookJobFailed,
+	StatusCancelled: WebhookJobCancelled,
+}
+
+// Webhook request headers. The signature is the hex HMAC-SHA256 of the
+// timestamp, a dot and the body, keyed with the webhook's secret, so
+// receivers can check both where a request came from and that it is fresh.
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp" // Unix seconds
+	WebhookSignatureHeader = "X-Webhook-Signature" // "sha256=" followed by the signature
+)
+
+// WebhookPayload is the JSON body sent to webhooks
+type WebhookPayload struct {
+	ID        string     `json:"id"` // the same when a delivery is retried
+	Event     string     `json:"event"`
+	CreatedAt time.Time  `json:"created_at"`
+	Job       WebhookJob `json:"job"`
+}
+
+// WebhookJob describes the job a webhook event is about
+type WebhookJob struct {
+	JobID        string    `json:"job_id"`
+	BatchID      string    `json:"batch_id"`
+	FileName     string    `json:"file_name"`
+	ParentFile   string    `json:"parent_file"`
+	Status       string    `json:"status"`
+	TotalRecords int       `json:"total_records"`
+	Processed    int       `json:"processed"`
+	Rejected     int       `json:"rejected"`
+	Duplicates   int       `json:"duplicates"`
+	Error        string    `json:"error"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+// WebhookService manages webhooks and sends them events when import jobs
+// complete, fail or are cancelled. Failed deliveries are retried after each
+// of RetryDelays in turn; every attempt is logged in webhook_deliveries.
+type WebhookService struct {
+	db          *gorm.DB
+	Client      *http.Client
+	RetryDelays []time.Duration
+
+	notifiedLock sync.Mutex
+	notified     map[string]bool // jobs whose final state has been sent, while uploads still holds them
+	lastPrune    time.Time       // guarded by notifiedLock
+}
+
+func NewWebhookService(db *gorm.DB) *WebhookService {
+	return &WebhookService{
+		db:          db,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		RetryDelays: []time.Duration{time.Second, 10 * time.Second, time.Minute, 5 * time.Minute},
+		notified:    make(map[string]bool),
+	}
+}
+
+// CreateWebhook registers a webhook for url. If secret is empty, one is
+// generated. events lists the event types to send; empty means all of them.
+func (s *WebhookService) CreateWebhook(rawURL, secret string, events []string) (*model.Webhook, error) {
+	verr := &ValidationError{}
+	if parsed, err := url.Parse(rawURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		verr.Add("url", "must be an absolute http or https URL")
+	}
+	for _, event := range events {
+		if event != WebhookJobCompleted && event != WebhookJobFailed && event != WebhookJobCancelled {
+			verr.Add("events", "unknown event type %q; must be one of %s, %s, %s", event, WebhookJobCompleted, WebhookJobFailed, WebhookJobCancelled)
+		}
+	}
+	if err := verr.OrNil(); err != nil {
+		return nil, err
+	}
+
+	if secret == "" {
+		secret = NewID()
+	}
+	webhook := &model.Webhook{URL: rawURL, Secret: secret, Events: events}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	if err := s.db.Create(webhook).Error; err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// ListWebhooks returns every webhook, oldest first
+func (s *WebhookService) ListWebhooks() ([]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+	err := s.db.Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+// DeleteWebhook removes a webhook and its delivery log. Deliveries already
+// under way still finish.
+func (s *WebhookService) DeleteWebhook(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&model.Webhook{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrWebhookNotFound
+		}
+		return tx.Where("webhook_id = ?", id).Delete(&model.WebhookDelivery{}).Error
+	})
+}
+
+// WebhookDeliveries returns the latest limit delivery attempts of a webhook, newest first
+func (s *WebhookService) WebhookDeliveries(id uint, limit int) ([]model.WebhookDelivery, error) {
+	var count int64
+	if err := s.db.Model(&model.Webhook{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrWebhookNotFound
+	}
+
+	deliveries := []model.WebhookDelivery{}
+	err := s.db.Where("webhook_id = ?", id).Order("id DESC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Watch sends webhook events for the jobs of uploads as they finish. It runs
+// until the process exits.
+func (s *WebhookService) Watch(uploads *UploadService) {
+	subscription := uploads.subscribeProgress(true)
+	defer subscription.Close()
+
+	for range subscription.C {
+		events, ok := subscription.Next()
+		if !ok {
+			// Events were dropped: look for finished jobs among all of them
+			snapshot, _ := uploads.ProgressSnapshot(func(progress *ProgressInfo) bool { return !progress.IsActive() })
+			events = make([]ProgressEvent, len(snapshot))
+			for i, progress := range snapshot {
+				events[i] = ProgressEvent{Progress: progress}
+			}
+		}
+		for _, event := range events {
+			if !event.Progress.IsActive() {
+				s.Notify(event.Progress)
+			}
+		}
+		s.pruneNotified(uploads, time.Now())
+	}
+}
+
+// pruneNotified forgets the jobs that uploads has evicted. Only jobs it still
+// holds can reappear in a snapshot, so only those need guarding against a
+// second notification. It runs at most once per minute.
+func (s *WebhookService) pruneNotified(uploads *UploadService, now time.Time) {
+	s.notifiedLock.Lock()
+	defer s.notifiedLock.Unlock()
+
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+	for jobID := range s.notified {
+		if uploads.GetJobProgress(jobID) == nil {
+			delete(s.notified, jobID)
+		}
+	}
+}
+
+// Notify sends the event for a finished job to the webhooks that want it,
+// unless that has already been done. Deliveries run in the background.
+func (s *WebhookService) Notify(progress ProgressInfo) {
+	event, final := webhookEvents[progress.Status]
+	if !final {
+		return
+	}
+	s.notifiedLock.Lock()
+	if s.notified[progress.JobID] {
+		s.notifiedLock.Unlock()
+		return
+	}
+	s.notified[progress.JobID] = true
+	s.notifiedLock.Unlock()
+
+	webhooks, err := s.ListWebhooks()
+	if err != nil {
+		log.Printf("Failed to load webhooks for job %s: %v", progress.JobID, err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if !wantsEvent(webhook, event) {
+			continue
+		}
+		payload := WebhookPayload{
+			ID:        NewID(),
+			Event:     event,
+			CreatedAt: time.Now().UTC(),
+			Job: WebhookJob{
+				JobID:        progress.JobID,
+				BatchID:      progress.BatchID,
+				FileName:     progress.FileName,
+				ParentFile:   progress.ParentFile,
+				Status:       progress.Status,
+				TotalRecords: progress.TotalRecords,
+				Processed:    progress.Processed,
+				Rejected:     progress.Rejected,
+				Duplicates:   progress.Duplicates,
+				Error:        progress.Error,
+				StartedAt:    progress.StartTime,
+				FinishedAt:   progress.EndTime,
+			},
+		}
+		go s.deliver(webhook, payload)
+	}
+}
+
+func wantsEvent(webhook model.Webhook, event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, wanted := range webhook.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends payload to webhook, retrying after network errors, 429s and 5xx responses
+func (s *WebhookService) deliver(webhook model.Webhook, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %v", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		status, err := s.send(webhook, payload, body)
+		delivery := model.WebhookDelivery{
+			WebhookID:  webhook.ID,
+			DeliveryID: payload.ID,
+			Event:      payload.Event,
+			JobID:      payload.Job.JobID,
+			Attempt:    attempt,
+			StatusCode: status,
+			DurationMs: time.Since(start).Milliseconds(),
+			Payload:    string(body),
+		}
+		if err == nil && (status < 200 || status > 299) {
+			err = fmt.Errorf("unexpected response status %d", status)
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if logErr := s.db.Create(&delivery).Error; logErr != nil {
+			log.Printf("Failed to log webhook delivery %s: %v", payload.ID, logErr)
+		}
+
+		if err == nil {
+			return
+		}
+		retryable := status == 0 || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt > len(s.RetryDelays) {
+			log.Printf("Webhook %d gave up on %s for job %s after %d attempts: %v", webhook.ID, payload.Event, payload.Job.JobID, attempt, err)
+			return
+		}
+		time.Sleep(s.RetryDelays[attempt-1])
+	}
+}
+
+// send makes one signed request, returning the response status
+func (s *WebhookService) send(webhook model.Webhook, payload WebhookPayload, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, payload.Event)
+	req.Header.Set(WebhookDeliveryHeader, payload.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the signature of a webhook request body sent at timestamp
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,129 @@
+package handler_test
+
+import (
+	"backend/internal/model"
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// setupTestDB opens an in-memory database shared by every connection of the
+// pool, since import workers write concurrently
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.Student{}, &model.ImportBackup{}, &model.GradeChange{}))
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// inTempDir runs the rest of the test in a temporary working directory, so
+// the uploads directory the upload handler writes to is removed afterwards
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// sseEvent is one event read from a server-sent event stream
+type sseEvent struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// sseStream reads the events of a server-sent event stream as they arrive
+type sseStream struct {
+	t      *testing.T
+	resp   *http.Response
+	events chan sseEvent
+	cancel context.CancelFunc
+}
+
+// openSSE requests an event stream from url with the given headers
+func openSSE(t *testing.T, url string, header http.Header) *sseStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		require.NoError(t, err)
+	}
+
+	stream := &sseStream{t: t, resp: resp, events: make(chan sseEvent, 100), cancel: cancel}
+	t.Cleanup(stream.Close)
+	go stream.read()
+	return stream
+}
+
+func (s *sseStream) read() {
+	defer close(s.events)
+	scanner := bufio.NewScanner(s.resp.Body)
+	var event sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// Lines that only set the retry delay end in an empty event
+			if event.Type != "" || event.Data != "" {
+				s.events <- event
+			}
+			event = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			event.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// next waits for the next event, failing the test if none arrives
+func (s *sseStream) next() sseEvent {
+	s.t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			s.t.Fatal("stream ended")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		s.t.Fatal("timeout waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// assertEnded checks that the server closed the stream after the events read so far
+func (s *sseStream) assertEnded() {
+	s.t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if ok {
+			s.t.Errorf("unexpected %s event after the end of the stream", event.Type)
+		}
+	case <-time.After(2 * time.Second):
+		s.t.Error("stream was not closed")
+	}
+}
+
+// Close disconnects from the stream
+func (s *sseStream) Close() {
+	s.cancel()
+	s.resp.Body.Close()
+}
@@ -3,254 +3,285 @@ package handler_test
 import (
 	"backend/internal/handler"
 	"backend/internal/service"
-	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	//"strings"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
-type MockProgressService struct {
-	mock.Mock
-}
-
-func (m *MockProgressService) GetFileProgress(fileName string) *service.ProgressInfo {
-	args := m.Called(fileName)
-	if args.Get(0) == nil {
-		return nil
-	}
-	return args.Get(0).(*service.ProgressInfo)
-}
-
-func (m *MockProgressService) GetAllFileProgress() []*service.ProgressInfo {
-	args := m.Called()
-	return args.Get(0).([]*service.ProgressInfo)
-}
-
-func (m *MockProgressService) RegisterProgressListener(ch chan *service.ProgressInfo) {
-	m.Called(ch)
-}
-
-func (m *MockProgressService) UnregisterProgressListener(ch chan *service.ProgressInfo) {
-	m.Called(ch)
-}
-
 func TestGetFileProgress(t *testing.T) {
-	mockService := new(MockProgressService)
-
-	// Test with existing file
-	progress := &service.ProgressInfo{
-		FileName:     "test.csv",
-		TotalRecords: 100,
-		Processed:    50,
-		Status:       "processing",
-	}
-
-	mockService.On("GetFileProgress", "test.csv").Return(progress)
+	uploadService := service.NewUploadService(setupTestDB(t))
+	jobID := uploadService.CreateJob("test.csv", "", "")
 
-	handler := handler.NewProgressHandler(mockService)
-
-	// Create request
-	req := httptest.NewRequest("GET", "/progress?fileName=test.csv", nil)
-	w := httptest.NewRecorder()
+	progressHandler := handler.NewProgressHandler(uploadService, nil)
 
 	// Create router to parse query parameters
 	router := mux.NewRouter()
-	router.HandleFunc("/progress", handler.GetFileProgress)
-	router.ServeHTTP(w, req)
+	router.HandleFunc("/progress", progressHandler.GetFileProgress)
 
-	// Check response
-	resp := w.Result()
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// Test with existing file
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/progress?fileName=test.csv", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
 
-	// Parse response body
 	var response service.ProgressInfo
-	json.NewDecoder(resp.Body).Decode(&response)
-
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, jobID, response.JobID)
 	assert.Equal(t, "test.csv", response.FileName)
-	assert.Equal(t, 100, response.TotalRecords)
-	assert.Equal(t, 50, response.Processed)
-	assert.Equal(t, "processing", response.Status)
-
-	// Test with non-existent file
-	mockService.On("GetFileProgress", "nonexistent.csv").Return(nil)
+	assert.Equal(t, service.StatusQueued, response.Status)
 
-	req = httptest.NewRequest("GET", "/progress?fileName=nonexistent.csv", nil)
+	// Test by job ID
 	w = httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/progress?jobId="+jobID, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
 
-	resp = w.Result()
-	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	// Test with non-existent file
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/progress?fileName=nonexistent.csv", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
 
 	// Test without filename parameter
-	req = httptest.NewRequest("GET", "/progress", nil)
 	w = httptest.NewRecorder()
-	router.ServeHTTP(w, req)
-
-	resp = w.Result()
-	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/progress", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
 func TestGetAllProgress(t *testing.T) {
-	mockService := new(MockProgressService)
-
-	// Set up test data
-	progress1 := &service.ProgressInfo{
-		FileName:     "file1.csv",
-		TotalRecords: 100,
-		Processed:    75,
-		Status:       "processing",
-	}
-
-	progress2 := &service.ProgressInfo{
-		FileName:     "file2.csv",
-		TotalRecords: 200,
-		Processed:    200,
-		Status:       "completed",
-	}
+	uploadService := service.NewUploadService(setupTestDB(t))
+	uploadService.CreateJob("file1.csv", "", "")
+	require.NoError(t, uploadService.CancelJob(uploadService.CreateJob("file2.csv", "", "")))
 
-	progressList := []*service.ProgressInfo{progress1, progress2}
+	progressHandler := handler.NewProgressHandler(uploadService, nil)
 
-	mockService.On("GetAllFileProgress").Return(progressList)
-
-	handler := NewProgressHandler(mockService)
-
-	// Create request
-	req := httptest.NewRequest("GET", "/progress/all", nil)
 	w := httptest.NewRecorder()
+	progressHandler.GetAllProgress(w, httptest.NewRequest("GET", "/progress/all", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
 
-	// Call handler
-	handler.GetAllProgress(w, req)
-
-	// Check response
-	resp := w.Result()
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
-
-	// Parse response body
 	var response []*service.ProgressInfo
-	json.NewDecoder(resp.Body).Decode(&response)
-
-	assert.Len(t, response, 2)
-	assert.Equal(t, "file1.csv", response[0].FileName)
-	assert.Equal(t, "file2.csv", response[1].FileName)
-	assert.Equal(t, "processing", response[0].Status)
-	assert.Equal(t, "completed", response[1].Status)
-
-	// Verify mock was called
-	mockService.AssertExpectations(t)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	statuses := make(map[string]string)
+	for _, progress := range response {
+		statuses[progress.FileName] = progress.Status
+	}
+	assert.Equal(t, map[string]string{"file1.csv": service.StatusQueued, "file2.csv": service.StatusCancelled}, statuses)
 }
 
 func TestSSEProgress(t *testing.T) {
-	mockService := new(MockProgressService)
-
-	// Expect register and unregister calls
-	mockService.On("RegisterProgressListener", mock.AnythingOfType("chan *service.ProgressInfo")).Return()
-	mockService.On("UnregisterProgressListener", mock.AnythingOfType("chan *service.ProgressInfo")).Return()
+	uploadService := service.NewUploadService(setupTestDB(t))
+	server := httptest.NewServer(http.HandlerFunc(handler.NewProgressHandler(uploadService, nil).SSEProgress))
+	defer server.Close()
+
+	stream := openSSE(t, server.URL, nil)
+	assert.Equal(t, "text/event-stream", stream.resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", stream.resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "keep-alive", stream.resp.Header.Get("Connection"))
+
+	// The client is subscribed once the headers arrive, so the event is not missed
+	jobID := uploadService.CreateJob("test.csv", "", "")
+	event := stream.next()
+	assert.Equal(t, "1", event.ID)
+	assert.Equal(t, "job.queued", event.Type)
+
+	var data map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(event.Data), &data))
+	assert.Equal(t, jobID, data["job_id"])
+	assert.Equal(t, "test.csv", data["file_name"])
+
+	// Disconnecting unsubscribes
+	stream.Close()
+	require.Eventually(t, func() bool { return uploadService.ProgressBusStats().Subscribers == 0 }, time.Second, 10*time.Millisecond)
+}
 
-	handler := NewProgressHandler(mockService)
+// progressServer serves the progress stream of uploadService
+func progressServer(t *testing.T, uploadService *service.UploadService) string {
+	server := httptest.NewServer(http.HandlerFunc(handler.NewProgressHandler(uploadService, nil).SSEProgress))
+	t.Cleanup(server.Close)
+	return server.URL
+}
 
-	// Create a context that we can cancel
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// eventJob returns the job ID in the payload of a job event
+func eventJob(t *testing.T, event sseEvent) string {
+	var data struct {
+		JobID string `json:"job_id"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(event.Data), &data))
+	return data.JobID
+}
 
-	// Create request with the cancellable context
-	req := httptest.NewRequest("GET", "/progress/sse", nil).WithContext(ctx)
+func TestSSEProgressReplaysMissedEvents(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	url := progressServer(t, uploadService)
+	first := uploadService.CreateJob("first.csv", "", "")
+
+	// A new client starts with the active jobs
+	stream := openSSE(t, url, nil)
+	event := stream.next()
+	assert.Equal(t, sseEvent{ID: "1", Type: "job.queued", Data: event.Data}, event)
+	assert.Equal(t, first, eventJob(t, event))
+	stream.Close()
+
+	// Events published while disconnected are replayed from the header or the parameter
+	second := uploadService.CreateJob("second.csv", "", "")
+	require.NoError(t, uploadService.CancelJob(first))
+	for name, open := range map[string]func() *sseStream{
+		"header":    func() *sseStream { return openSSE(t, url, http.Header{"Last-Event-ID": {"1"}}) },
+		"parameter": func() *sseStream { return openSSE(t, url+"?last_event_id=1", nil) },
+	} {
+		stream := open()
+		event := stream.next()
+		assert.Equal(t, "2", event.ID, name)
+		assert.Equal(t, "job.queued", event.Type, name)
+		assert.Equal(t, second, eventJob(t, event), name)
+		event = stream.next()
+		assert.Equal(t, "3", event.ID, name)
+		assert.Equal(t, "job.cancelled", event.Type, name)
+		assert.Equal(t, first, eventJob(t, event), name)
+		stream.Close()
+	}
+}
 
-	// Create recorder
-	w := httptest.NewRecorder()
+func TestSSEProgressSnapshotWhenReplayIsUnavailable(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	url := progressServer(t, uploadService)
 
-	// Start the handler in a goroutine because it will block
-	go func() {
-		handler.SSEProgress(w, req)
-	}()
+	// More events than the replay buffer holds, so the first ones are gone
+	const jobs = 600
+	for i := 0; i < jobs; i++ {
+		require.NoError(t, uploadService.CancelJob(uploadService.CreateJob("grades.csv", "", "")))
+	}
 
-	// Give it a moment to start
-	time.Sleep(50 * time.Millisecond)
+	// IDs that are too old, from before a restart or not IDs at all get every
+	// job, finished ones included, and only the last event has an ID
+	for _, lastID := range []string{"1", "5000", "abc"} {
+		stream := openSSE(t, url, http.Header{"Last-Event-ID": {lastID}})
+		for i := 0; i < jobs; i++ {
+			event := stream.next()
+			assert.Equal(t, "job.cancelled", event.Type)
+			if i < jobs-1 {
+				assert.Empty(t, event.ID)
+			} else {
+				assert.Equal(t, "1200", event.ID, lastID)
+			}
+		}
+		stream.Close()
+	}
+}
 
-	// Cancel the context to simulate client disconnection
-	cancel()
+func TestSSEProgressFilters(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	url := progressServer(t, uploadService)
 
-	// Wait for handler to finish
-	time.Sleep(50 * time.Millisecond)
+	batchID := uploadService.CreateBatch(time.Now())
+	first := uploadService.CreateJob("first.csv", batchID, "")
+	second := uploadService.CreateJob("second.csv", batchID, "")
+	uploadService.BatchUploaded(batchID)
+	other := uploadService.CreateJob("other.csv", "", "")
 
-	// Check headers
-	resp := w.Result()
-	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
-	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
-	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	// Unknown jobs and batches have no stream
+	resp, err := http.Get(url + "?job=missing&batch=missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 
-	// Verify that register and unregister were called
-	mockService.AssertExpectations(t)
+	// The stream starts with the subscribed jobs and the state of their batch
+	stream := openSSE(t, url+"?batch="+batchID, nil)
+	assert.ElementsMatch(t, []string{first, second}, []string{eventJob(t, stream.next()), eventJob(t, stream.next())})
+	assert.Equal(t, "batch.progress", stream.next().Type)
+
+	// Other jobs are filtered out
+	require.NoError(t, uploadService.CancelJob(other))
+	require.NoError(t, uploadService.CancelJob(first))
+	event := stream.next()
+	assert.Equal(t, "job.cancelled", event.Type)
+	assert.Equal(t, first, eventJob(t, event))
+	assert.Equal(t, "batch.progress", stream.next().Type)
+
+	// Once every subscribed job has finished the stream ends
+	require.NoError(t, uploadService.CancelJob(second))
+	event = stream.next()
+	assert.Equal(t, second, eventJob(t, event))
+	lastID := event.ID
+	assert.Equal(t, "batch.cancelled", stream.next().Type)
+	assert.Equal(t, sseEvent{Type: "stream.end", Data: "{}"}, stream.next())
+	stream.assertEnded()
+
+	// Reconnecting after the end tells the browser to stop
+	req, err := http.NewRequest("GET", url+"?batch="+batchID, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", lastID)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// Jobs can be listed repeated or comma-separated, and finished ones are still sent
+	stream = openSSE(t, url+"?job="+first+","+other+"&job="+second, nil)
+	var jobs []string
+	for i := 0; i < 3; i++ {
+		event := stream.next()
+		assert.Equal(t, "job.cancelled", event.Type)
+		jobs = append(jobs, eventJob(t, event))
+	}
+	assert.ElementsMatch(t, []string{first, second, other}, jobs)
+	assert.Equal(t, "batch.cancelled", stream.next().Type)
+	assert.Equal(t, "stream.end", stream.next().Type)
+	stream.assertEnded()
 }
 
-// Additional test to check actual data sending
-func TestSSEProgressDataSending(t *testing.T) {
-	mockService := new(MockProgressService)
-
-	// Create a channel we can control
-	progressChan := make(chan *service.ProgressInfo, 1)
-
-	// Setup mock to use our channel
-	mockService.On("RegisterProgressListener", mock.AnythingOfType("chan *service.ProgressInfo")).
-		Run(func(args mock.Arguments) {
-			// Get the channel passed to RegisterProgressListener
-			ch := args.Get(0).(chan *service.ProgressInfo)
-			// Copy our progress to that channel
-			go func() {
-				for p := range progressChan {
-					ch <- p
-				}
-			}()
-		}).
-		Return()
-
-	mockService.On("UnregisterProgressListener", mock.AnythingOfType("chan *service.ProgressInfo")).Return()
-
-	handler := NewProgressHandler(mockService)
-
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-	defer cancel()
-
-	// Create request
-	req := httptest.NewRequest("GET", "/progress/sse", nil).WithContext(ctx)
-	w := httptest.NewRecorder()
+func TestSSEProgressEventPayload(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	stream := openSSE(t, progressServer(t, uploadService), nil)
 
-	// Start handler in goroutine
-	go handler.SSEProgress(w, req)
+	path := filepath.Join(t.TempDir(), "grades.csv")
+	require.NoError(t, os.WriteFile(path, []byte("student_id,student_name,subject,grade\nS1,Alice,Math,95\nS2,Bob,Art,high\n"), 0o644))
+	require.NoError(t, uploadService.ProcessFile(path, service.DefaultImportOptions()))
 
-	// Send a progress update
-	progress := &service.ProgressInfo{
-		FileName:     "test.csv",
-		TotalRecords: 100,
-		Processed:    50,
-		Status:       "processing",
+	var events []sseEvent
+	for len(events) == 0 || events[len(events)-1].Type != "job.completed" {
+		events = append(events, stream.next())
 	}
+	assert.Equal(t, "job.queued", events[0].Type)
+	assert.Equal(t, "job.progress", events[1].Type)
+
+	var queued, completed map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(events[0].Data), &queued))
+	require.NoError(t, json.Unmarshal([]byte(events[len(events)-1].Data), &completed))
+
+	assert.ElementsMatch(t, []string{
+		"job_id", "batch_id", "file_name", "parent_file", "status", "total_records", "processed", "rejected",
+		"duplicates", "percentage", "rows_per_second", "eta_seconds", "error", "row_errors", "started_at",
+		"finished_at", "bytes", "workers", "bytes_per_second", "timings",
+	}, mapKeys(completed))
+	assert.ElementsMatch(t, []string{
+		"upload_seconds", "queue_wait_seconds", "parse_seconds", "validate_seconds", "db_write_seconds", "commit_seconds",
+	}, mapKeys(completed["timings"].(map[string]interface{})))
+
+	assert.Equal(t, "queued", queued["status"])
+	assert.Nil(t, queued["finished_at"])
+	assert.Nil(t, queued["eta_seconds"])
+	assert.Equal(t, []interface{}{}, queued["row_errors"])
+
+	assert.Equal(t, "completed", completed["status"])
+	assert.Equal(t, "grades.csv", completed["file_name"])
+	assert.Equal(t, float64(2), completed["total_records"])
+	assert.Equal(t, float64(2), completed["processed"])
+	assert.Equal(t, float64(1), completed["rejected"])
+	assert.Equal(t, float64(100), completed["percentage"])
+	assert.NotNil(t, completed["finished_at"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"line": float64(3), "student_id": "S2", "message": `invalid grade "high"`}}, completed["row_errors"])
+}
 
-	progressChan <- progress
-
-	// Wait for processing
-	time.Sleep(100 * time.Millisecond)
-
-	// Check response body
-	responseBody := w.Body.String()
-
-	// Should contain the progress data as an SSE event
-	expectedData, _ := json.Marshal(progress)
-	expectedEvent := "data: " + string(expectedData) + "\n\n"
-
-	assert.Contains(t, responseBody, expectedEvent)
-
-	// Close our test channel and cancel context
-	close(progressChan)
-	cancel()
-
-	// Verify mock expectations
-	mockService.AssertExpectations(t)
+func mapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
 }
@@ -0,0 +1,176 @@
+package handler_test
+
+import (
+	"backend/internal/handler"
+	"backend/internal/service"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wsMessage is a message from the progress WebSocket
+type wsMessage struct {
+	Type  string          `json:"type"`
+	ID    uint64          `json:"id"`
+	Data  json.RawMessage `json:"data"`
+	JobID string          `json:"job_id"`
+	Error string          `json:"error"`
+}
+
+// wsServer serves the progress WebSocket of uploadService, accepting
+// connections from http://allowed.example besides its own origin
+func wsServer(t *testing.T, uploadService *service.UploadService) string {
+	progressHandler := handler.NewProgressHandler(uploadService, []string{"http://allowed.example"})
+	server := httptest.NewServer(http.HandlerFunc(progressHandler.WSProgress))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWS waits for the next message, failing the test if none arrives
+func readWS(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var message wsMessage
+	require.NoError(t, conn.ReadJSON(&message))
+	return message
+}
+
+// messageJob returns the job ID in the payload of a job event
+func messageJob(t *testing.T, message wsMessage) string {
+	var data struct {
+		JobID string `json:"job_id"`
+	}
+	require.NoError(t, json.Unmarshal(message.Data, &data))
+	return data.JobID
+}
+
+func TestWSProgressOrigins(t *testing.T) {
+	url := wsServer(t, service.NewUploadService(setupTestDB(t)))
+	host := strings.TrimPrefix(url, "ws://")
+
+	for origin, allowed := range map[string]bool{
+		"":                        true,
+		"http://allowed.example":  true,
+		"http://" + host:          true,
+		"http://evil.example":     false,
+		"https://allowed.example": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if allowed {
+			assert.NoError(t, err, origin)
+		} else {
+			assert.Error(t, err, origin)
+			require.NotNil(t, resp, origin)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestWSProgressSubscriptions(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	url := wsServer(t, uploadService)
+
+	// Until the first subscribe every job is sent
+	conn := dialWS(t, url)
+	first := uploadService.CreateJob("first.csv", "", "")
+	message := readWS(t, conn)
+	assert.Equal(t, "job.queued", message.Type)
+	assert.Equal(t, uint64(1), message.ID)
+	assert.Equal(t, first, messageJob(t, message))
+
+	// Subscribing sends the state of the added jobs, then only their events
+	second := uploadService.CreateJob("second.csv", "", "")
+	third := uploadService.CreateJob("third.csv", "", "")
+	assert.Equal(t, second, messageJob(t, readWS(t, conn)))
+	assert.Equal(t, third, messageJob(t, readWS(t, conn)))
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "job_ids": []string{second, third}}))
+	assert.ElementsMatch(t, []string{second, third}, []string{messageJob(t, readWS(t, conn)), messageJob(t, readWS(t, conn))})
+
+	// Commands are handled in order, so the cancellations come after the unsubscribe
+	require.NoError(t, uploadService.CancelJob(first))
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "unsubscribe", "job_ids": []string{third}}))
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "cancel", "job_id": third}))
+	assert.Equal(t, wsMessage{Type: "cancel.accepted", JobID: third}, readWS(t, conn))
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "cancel", "job_id": second}))
+	assert.Equal(t, wsMessage{Type: "cancel.accepted", JobID: second}, readWS(t, conn))
+	message = readWS(t, conn)
+	assert.Equal(t, "job.cancelled", message.Type)
+	assert.Equal(t, second, messageJob(t, message), "unsubscribed jobs are not sent")
+}
+
+func TestWSProgressFilterParameters(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	url := wsServer(t, uploadService)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?job=missing", nil)
+	assert.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	jobID := uploadService.CreateJob("grades.csv", "", "")
+	other := uploadService.CreateJob("other.csv", "", "")
+	conn := dialWS(t, url+"?job="+jobID)
+	message := readWS(t, conn)
+	assert.Equal(t, "job.queued", message.Type)
+	assert.Equal(t, jobID, messageJob(t, message))
+
+	require.NoError(t, uploadService.CancelJob(other))
+	require.NoError(t, uploadService.CancelJob(jobID))
+	assert.Equal(t, jobID, messageJob(t, readWS(t, conn)))
+}
+
+func TestWSProgressCommands(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB(t))
+	jobID := uploadService.CreateJob("grades.csv", "", "")
+	conn := dialWS(t, wsServer(t, uploadService)+"?job="+jobID)
+	assert.Equal(t, "job.queued", readWS(t, conn).Type)
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "cancel", "job_id": jobID}))
+	assert.Equal(t, wsMessage{Type: "cancel.accepted", JobID: jobID}, readWS(t, conn))
+	message := readWS(t, conn)
+	assert.Equal(t, "job.cancelled", message.Type)
+	assert.Equal(t, jobID, messageJob(t, message))
+
+	replies := []struct {
+		command string
+		reply   wsMessage
+	}{
+		{`{"type":"cancel","job_id":"` + jobID + `"}`, wsMessage{Type: "error", JobID: jobID, Error: "job has already finished"}},
+		{`{"type":"cancel","job_id":"missing"}`, wsMessage{Type: "error", JobID: "missing", Error: "job not found"}},
+		{`{"type":"pause"}`, wsMessage{Type: "error", Error: "unknown command type pause"}},
+	}
+	for _, tt := range replies {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(tt.command)))
+		assert.Equal(t, tt.reply, readWS(t, conn), tt.command)
+	}
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	message = readWS(t, conn)
+	assert.Equal(t, "error", message.Type)
+	assert.Contains(t, message.Error, "invalid command")
+
+	// Closing the connection unsubscribes
+	conn.Close()
+	require.Eventually(t, func() bool { return uploadService.ProgressBusStats().Subscribers == 0 }, time.Second, 10*time.Millisecond)
+}
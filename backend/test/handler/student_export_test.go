@@ -0,0 +1,136 @@
+package handler_test
+
+import (
+	"backend/internal/handler"
+	"backend/internal/model"
+	"backend/internal/service"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+)
+
+func exportHandler(t *testing.T) (*handler.StudentHandler, *gorm.DB) {
+	db := setupTestDB(t)
+	for _, student := range []model.Student{
+		{StudentID: "S1", StudentName: "Alice", Subject: "Math", Grade: 90, CreatedAt: date("2024-01-01"), UpdatedAt: date("2024-01-02")},
+		{StudentID: "S2", StudentName: "Bob, Jr", Subject: "Art", Grade: 85, CreatedAt: date("2024-02-01"), UpdatedAt: date("2024-02-01")},
+		{StudentID: "S3", StudentName: "Carol", Subject: "Math", Grade: 70, CreatedAt: date("2024-03-01"), UpdatedAt: date("2024-03-01")},
+	} {
+		require.NoError(t, db.Create(&student).Error)
+	}
+	return handler.NewStudentHandler(service.NewStudentService(db)), db
+}
+
+func export(studentHandler *handler.StudentHandler, query string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	studentHandler.ExportStudents(rr, httptest.NewRequest("GET", "/students/export?"+query, nil))
+	return rr
+}
+
+func TestExportStudentsCSV(t *testing.T) {
+	studentHandler, _ := exportHandler(t)
+
+	rr := export(studentHandler, "subject=Math&sort=grade:desc")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="students.csv"`, rr.Header().Get("Content-Disposition"))
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"student_id", "student_name", "subject", "grade", "created_at", "updated_at"},
+		{"S1", "Alice", "Math", "90", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"},
+		{"S3", "Carol", "Math", "70", "2024-03-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+	}, records)
+
+	// Values with the delimiter are quoted
+	rr = export(studentHandler, "student_id=S2")
+	assert.Contains(t, rr.Body.String(), `S2,"Bob, Jr",Art,85`)
+}
+
+func TestExportStudentsEmptyCSVHasHeader(t *testing.T) {
+	studentHandler, _ := exportHandler(t)
+
+	rr := export(studentHandler, "subject=History")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `attachment; filename="students.csv"`, rr.Header().Get("Content-Disposition"))
+	assert.Equal(t, "student_id,student_name,subject,grade,created_at,updated_at\n", rr.Body.String())
+}
+
+func TestExportStudentsCSVWritesHeaderOnce(t *testing.T) {
+	studentHandler, db := exportHandler(t)
+	for i := 0; i < 1200; i++ {
+		require.NoError(t, db.Create(&model.Student{StudentID: fmt.Sprintf("B%04d", i), StudentName: "Bulk", Subject: "Bulk", Grade: 50}).Error)
+	}
+
+	rr := export(studentHandler, "subject=Bulk")
+	require.Equal(t, http.StatusOK, rr.Code)
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 1201)
+	assert.Equal(t, "student_id", records[0][0])
+	assert.Equal(t, "B1199", records[1200][0])
+}
+
+func TestExportStudentsNDJSON(t *testing.T) {
+	studentHandler, _ := exportHandler(t)
+
+	rr := export(studentHandler, "format=ndjson&sort=student_id:desc")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="students.ndjson"`, rr.Header().Get("Content-Disposition"))
+
+	var ids []string
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var student model.Student
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &student))
+		ids = append(ids, student.StudentID)
+	}
+	assert.Equal(t, []string{"S3", "S2", "S1"}, ids)
+
+	// An empty export is still a download
+	rr = export(studentHandler, "format=ndjson&subject=History")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `attachment; filename="students.ndjson"`, rr.Header().Get("Content-Disposition"))
+	assert.Empty(t, rr.Body.String())
+}
+
+func TestExportStudentsXLSX(t *testing.T) {
+	studentHandler, _ := exportHandler(t)
+
+	rr := export(studentHandler, "format=xlsx&grade_gte=85")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `attachment; filename="students.xlsx"`, rr.Header().Get("Content-Disposition"))
+
+	file, err := excelize.OpenReader(rr.Body)
+	require.NoError(t, err)
+	defer file.Close()
+	rows, err := file.GetRows("Sheet1")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"student_id", "student_name", "subject", "grade", "created_at", "updated_at"},
+		{"S1", "Alice", "Math", "90", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"},
+		{"S2", "Bob, Jr", "Art", "85", "2024-02-01T00:00:00Z", "2024-02-01T00:00:00Z"},
+	}, rows)
+}
+
+func TestExportStudentsRejectsInvalidParameters(t *testing.T) {
+	studentHandler, _ := exportHandler(t)
+
+	for _, query := range []string{"format=pdf", "grade_gt=high", "sort=password"} {
+		rr := export(studentHandler, query)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.Empty(t, rr.Header().Get("Content-Disposition"), query)
+		assert.Contains(t, rr.Body.String(), "invalid request", query)
+	}
+}
@@ -0,0 +1,144 @@
+package handler_test
+
+import (
+	"backend/internal/handler"
+	"backend/internal/model"
+	"backend/internal/service"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func date(value string) time.Time {
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestListStudentsFilters(t *testing.T) {
+	db := setupTestDB(t)
+	students := []model.Student{
+		{StudentID: "S1", StudentName: "Alice", Subject: "Math", Grade: 90, ImportJobID: "j1", ImportBatchID: "b1", CreatedAt: date("2024-01-01"), UpdatedAt: date("2024-01-01")},
+		{StudentID: "S2", StudentName: "Bob", Subject: "Art", Grade: 85, ImportJobID: "j2", ImportBatchID: "b1", CreatedAt: date("2024-02-01"), UpdatedAt: date("2024-02-01")},
+		{StudentID: "S3", StudentName: "Carol", Subject: "Math", Grade: 70, CreatedAt: date("2024-03-01"), UpdatedAt: date("2024-06-01")},
+		{StudentID: "S4", StudentName: "Dan", Subject: "History", Grade: 100, ImportJobID: "j3", ImportBatchID: "b2", CreatedAt: date("2024-04-01"), UpdatedAt: date("2024-04-01")},
+		{StudentID: "X_1", StudentName: "100% Eve", Subject: "Art", Grade: 60, CreatedAt: date("2024-05-01"), UpdatedAt: date("2024-05-01")},
+		{StudentID: "XY1", StudentName: "Fay", Subject: "Art", Grade: 60, CreatedAt: date("2024-05-01"), UpdatedAt: date("2024-05-01")},
+	}
+	for _, student := range students {
+		require.NoError(t, db.Create(&student).Error)
+	}
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(db))
+
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"subject=Math,Art", []string{"S1", "S2", "S3", "XY1", "X_1"}},
+		{"subject=Math&subject=History", []string{"S1", "S3", "S4"}},
+		{"student_id=S2", []string{"S2"}},
+		{"student_id_prefix=X_", []string{"X_1"}},
+		{"student_name=O", []string{"S2", "S3"}},
+		{"student_name=%25", []string{"X_1"}},
+		{"grade_gt=85", []string{"S1", "S4"}},
+		{"grade_gt=85&grade_lt=100", []string{"S1"}},
+		{"grade_gte=85&grade_lte=90", []string{"S1", "S2"}},
+		{"grade_min=85&grade_max=90", []string{"S1", "S2"}},
+		{"grade_min=85&grade_gte=85", []string{"S1", "S2", "S4"}},
+		{"job_id=j1", []string{"S1"}},
+		{"batch_id=b1", []string{"S1", "S2"}},
+		{"created_after=2024-02-01&created_before=2024-04-01", []string{"S2", "S3"}},
+		{"created_after=2024-04-01T00:00:00Z", []string{"S4", "XY1", "X_1"}},
+		{"updated_after=2024-05-15", []string{"S3"}},
+		{"updated_before=2024-01-02", []string{"S1"}},
+		{"subject=Math&grade_lt=80&created_after=2024-01-15", []string{"S3"}},
+		{"subject=Art&student_id_prefix=X&grade_lte=60", []string{"XY1", "X_1"}},
+		{"subject=Art&batch_id=b2", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			studentHandler.ListStudents(rr, httptest.NewRequest("GET", "/students?sort=student_id&"+tt.query, nil))
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+			var response struct {
+				Data  []model.Student `json:"data"`
+				Total int64           `json:"total"`
+			}
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+			ids := []string{}
+			for _, student := range response.Data {
+				ids = append(ids, student.StudentID)
+			}
+			assert.Equal(t, tt.ids, ids)
+			assert.Equal(t, int64(len(tt.ids)), response.Total)
+		})
+	}
+}
+
+func TestListStudentsRejectsInvalidFilters(t *testing.T) {
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(setupTestDB(t)))
+
+	tests := []struct {
+		query  string
+		fields []string
+	}{
+		{"grade_gt=high", []string{"grade_gt"}},
+		{"grade_min=80&grade_gte=85", []string{"grade_min"}},
+		{"created_after=yesterday", []string{"created_after"}},
+		{"updated_before=2024-13-01", []string{"updated_before"}},
+		{"grade_lt=x&created_before=y&page=0", []string{"page", "grade_lt", "created_before"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			studentHandler.ListStudents(rr, httptest.NewRequest("GET", "/students?"+tt.query, nil))
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+
+			var response struct {
+				Error   string               `json:"error"`
+				Details []service.FieldError `json:"details"`
+			}
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+			assert.Equal(t, "invalid request", response.Error)
+			var fields []string
+			for _, detail := range response.Details {
+				fields = append(fields, detail.Field)
+			}
+			assert.ElementsMatch(t, tt.fields, fields)
+		})
+	}
+}
+
+func TestListStudentsSearch(t *testing.T) {
+	db := setupTestDB(t)
+	for _, student := range []model.Student{
+		{StudentID: "S1", StudentName: "Bob Malice", Subject: "Art", Grade: 80},
+		{StudentID: "S2", StudentName: "Alice", Subject: "Math", Grade: 90},
+		{StudentID: "S3", StudentName: "Carol", Subject: "Math", Grade: 70},
+	} {
+		require.NoError(t, db.Create(&student).Error)
+	}
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(db))
+
+	rr := httptest.NewRecorder()
+	studentHandler.ListStudents(rr, httptest.NewRequest("GET", "/students?q=alice", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var response struct {
+		Data       []model.Student `json:"data"`
+		SearchMode string          `json:"searchMode"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, "substring", response.SearchMode)
+	require.Len(t, response.Data, 2)
+	assert.Equal(t, "S2", response.Data[0].StudentID, "the earlier match ranks first")
+	assert.Equal(t, "S1", response.Data[1].StudentID)
+}
@@ -5,8 +5,7 @@ import (
 	"backend/internal/model"
 	"backend/internal/service"
 	"encoding/json"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -14,15 +13,15 @@ import (
 
 func TestListStudents(t *testing.T) {
 	// Setup
-	db := setupTestDB()
+	db := setupTestDB(t)
 	studentService := service.NewStudentService(db)
 	studentHandler := handler.NewStudentHandler(studentService)
 
 	// Insert test data
 	students := []model.Student{
-		{StudentName: "John Doe", Subject: "Math", Grade: 90},
-		{StudentName: "Jane Doe", Subject: "Science", Grade: 85},
-		{StudentName: "Alice", Subject: "Math", Grade: 95},
+		{StudentID: "S1", StudentName: "John Doe", Subject: "Math", Grade: 90},
+		{StudentID: "S2", StudentName: "Jane Doe", Subject: "Science", Grade: 85},
+		{StudentID: "S3", StudentName: "Alice", Subject: "Math", Grade: 95},
 	}
 	for _, student := range students {
 		db.Create(&student)
@@ -76,11 +75,85 @@ func TestListStudents(t *testing.T) {
 	}
 }
 
-func setupTestDB() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect to database")
+func TestListStudentsLimitAndCursor(t *testing.T) {
+	db := setupTestDB(t)
+	for i := 1; i <= 120; i++ {
+		db.Create(&model.Student{StudentID: fmt.Sprintf("S%03d", i), StudentName: "Name", Subject: "Math", Grade: i % 100})
+	}
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(db))
+
+	list := func(query string) (int, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		studentHandler.ListStudents(rr, httptest.NewRequest("GET", "/students?"+query, nil))
+		var response map[string]interface{}
+		json.NewDecoder(rr.Body).Decode(&response)
+		return rr.Code, response
+	}
+
+	// Oversized limits are lowered to the maximum page size
+	code, response := list("limit=100000000")
+	if code != http.StatusOK || response["limit"] != float64(100) || len(response["data"].([]interface{})) != 100 {
+		t.Errorf("limit=100000000: status %v, limit %v, %d rows", code, response["limit"], len(response["data"].([]interface{})))
+	}
+	for _, query := range []string{"limit=0", "limit=-5", "limit=ten", "pagination=sideways", "cursor=bogus"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: status %v, want 400", query, code)
+		}
+	}
+
+	// The cursor from one page leads to the next, without a total unless asked for
+	var ids []string
+	query := "cursor=&limit=50&sort=student_id"
+	for {
+		code, response := list(query)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status %v", query, code)
+		}
+		if _, ok := response["total"]; ok {
+			t.Errorf("%s: total is included without count", query)
+		}
+		for _, row := range response["data"].([]interface{}) {
+			ids = append(ids, row.(map[string]interface{})["StudentID"].(string))
+		}
+		next, _ := response["nextCursor"].(string)
+		if next == "" {
+			break
+		}
+		query = "limit=50&sort=student_id&cursor=" + next
+	}
+	if len(ids) != 120 || ids[0] != "S001" || ids[119] != "S120" {
+		t.Errorf("cursor walk listed %d students from %v to %v", len(ids), ids[0], ids[len(ids)-1])
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	db := setupTestDB(t)
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(db))
+	for _, student := range []model.Student{
+		{StudentID: "S1", StudentName: "John Doe", Subject: "Math", Grade: 90},
+		{StudentID: "S2", StudentName: "Jane Doe", Subject: "Science", Grade: 2000000000},
+	} {
+		db.Create(&student)
+	}
+
+	rr := httptest.NewRecorder()
+	studentHandler.GetStats(rr, httptest.NewRequest("GET", "/stats?band_width=1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var report service.StatsReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.BandWidth != 1 || len(report.Overall.Histogram) != 2 || len(report.Subjects) != 2 {
+		t.Errorf("Expected two one-grade bands over two subjects, got %+v", report)
+	}
+
+	for _, query := range []string{"band_width=0", "band_width=wide", "grade_gt=high"} {
+		rr := httptest.NewRecorder()
+		studentHandler.GetStats(rr, httptest.NewRequest("GET", "/stats?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, rr.Code)
+		}
 	}
-	db.AutoMigrate(&model.Student{})
-	return db
 }
@@ -0,0 +1,138 @@
+package handler_test
+
+import (
+	"backend/internal/handler"
+	"backend/internal/model"
+	"backend/internal/service"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// studentRouter routes the single-student endpoints as cmd/main.go does
+func studentRouter(t *testing.T) http.Handler {
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(setupTestDB(t)))
+	r := mux.NewRouter()
+	r.HandleFunc("/students", studentHandler.CreateStudent).Methods("POST")
+	r.HandleFunc("/students/{id}", studentHandler.GetStudent).Methods("GET")
+	r.HandleFunc("/students/{id}", studentHandler.ReplaceStudent).Methods("PUT")
+	r.HandleFunc("/students/{id}", studentHandler.PatchStudent).Methods("PATCH")
+	r.HandleFunc("/students/{id}", studentHandler.DeleteStudent).Methods("DELETE")
+	return r
+}
+
+func send(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rr
+}
+
+// errorFields returns the fields named in a validation error response
+func errorFields(t *testing.T, rr *httptest.ResponseRecorder) []string {
+	var response struct {
+		Details []service.FieldError `json:"details"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	var fields []string
+	for _, detail := range response.Details {
+		fields = append(fields, detail.Field)
+	}
+	return fields
+}
+
+func TestCreateStudent(t *testing.T) {
+	router := studentRouter(t)
+
+	rr := send(router, "POST", "/students", `{"student_id":"S1","student_name":"Alice","subject":"Math","grade":95}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, "/students/S1", rr.Header().Get("Location"))
+
+	rr = send(router, "POST", "/students", `{"student_id":"S1","student_name":"Bob","subject":"Art","grade":80}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Fields are stored as given, like imported cells, and the grade may be a numeric string
+	rr = send(router, "POST", "/students", `{"student_id":"S2","student_name":" Bob ","subject":"","grade":"80"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var student model.Student
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&student))
+	assert.Equal(t, model.Student{StudentID: "S2", StudentName: " Bob ", Subject: "", Grade: 80}, model.Student{
+		StudentID: student.StudentID, StudentName: student.StudentName, Subject: student.Subject, Grade: student.Grade,
+	})
+}
+
+func TestCreateStudentValidation(t *testing.T) {
+	router := studentRouter(t)
+
+	tests := []struct {
+		body   string
+		status int
+		fields []string
+	}{
+		// Rows the importer would reject are rejected the same way
+		{`{"student_id":" ","student_name":"Alice","subject":"Math","grade":95}`, http.StatusUnprocessableEntity, []string{"student_id"}},
+		{`{"student_name":"Alice","subject":"Math","grade":95}`, http.StatusUnprocessableEntity, []string{"student_id"}},
+		{`{"student_id":"S1","student_name":"Alice","subject":"Math","grade":9.5}`, http.StatusUnprocessableEntity, []string{"grade"}},
+		{`{"student_id":"S1","student_name":"Alice","subject":"Math"}`, http.StatusUnprocessableEntity, []string{"grade"}},
+		// Bodies that cannot be read are bad requests
+		{`{"student_id":"S1","grade":`, http.StatusBadRequest, []string{"body"}},
+		{`{"student_id":"S1","grade":95,"email":"a@b"}`, http.StatusBadRequest, []string{"body"}},
+		{`{"student_id":"S1","grade":"high"}`, http.StatusBadRequest, []string{"body"}},
+	}
+	for _, tt := range tests {
+		rr := send(router, "POST", "/students", tt.body)
+		assert.Equal(t, tt.status, rr.Code, tt.body)
+		assert.Equal(t, tt.fields, errorFields(t, rr), tt.body)
+	}
+}
+
+func TestUpdateStudent(t *testing.T) {
+	router := studentRouter(t)
+	require.Equal(t, http.StatusCreated, send(router, "POST", "/students", `{"student_id":"S1","student_name":"Alice","subject":"Math","grade":95}`).Code)
+
+	rr := send(router, "PATCH", "/students/S1", `{"grade":90}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var student model.Student
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&student))
+	assert.Equal(t, "Alice", student.StudentName)
+	assert.Equal(t, 90, student.Grade)
+
+	rr = send(router, "PUT", "/students/S1", `{"student_name":"","subject":"Art","grade":70}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&student))
+	assert.Equal(t, "", student.StudentName, "an empty name is accepted, as on import")
+	assert.Equal(t, "Art", student.Subject)
+
+	rr = send(router, "PUT", "/students/S1", `{"grade":70}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, []string{"student_name", "subject"}, errorFields(t, rr))
+
+	rr = send(router, "PATCH", "/students/S1", `{"student_id":"S1 "}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, []string{"student_id"}, errorFields(t, rr))
+
+	rr = send(router, "PATCH", "/students/S9", `{"grade":90}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = send(router, "PUT", "/students/S9", `{"student_name":"Nobody","subject":"Art","grade":70}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestGetAndDeleteStudent(t *testing.T) {
+	router := studentRouter(t)
+	require.Equal(t, http.StatusCreated, send(router, "POST", "/students", `{"student_id":"S2","student_name":"Bob","subject":"Art","grade":80}`).Code)
+
+	rr := send(router, "GET", "/students/S2", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var student model.Student
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&student))
+	assert.Equal(t, "Bob", student.StudentName)
+
+	assert.Equal(t, http.StatusNoContent, send(router, "DELETE", "/students/S2", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(router, "GET", "/students/S2", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(router, "DELETE", "/students/S2", "").Code)
+}
@@ -1,147 +1,225 @@
 package handler_test
 
 import (
+	"archive/zip"
 	"backend/internal/handler"
+	"backend/internal/model"
 	"backend/internal/service"
 	"bytes"
-	"io/ioutil"
+	"encoding/json"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	//"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
-	//"gorm.io/driver/sqlite"
-	//"gorm.io/gorm"
+	"github.com/stretchr/testify/require"
 )
 
-type MockUploadService struct {
-	mock.Mock
-}
-
-func (m *MockUploadService) ProcessCSV(filePath string) error {
-	args := m.Called(filePath)
-	return args.Error(0)
-}
-
-func (m *MockUploadService) GetFileProgress(fileName string) *service.ProgressInfo {
-	args := m.Called(fileName)
-	if args.Get(0) == nil {
-		return nil
+// multipartUpload builds a POST /upload request with a files part for each
+// name and content pair, and any extra form fields
+func multipartUpload(t *testing.T, files [][2]string, fields map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, file := range files {
+		part, err := writer.CreateFormFile("files", file[0])
+		require.NoError(t, err)
+		_, err = part.Write([]byte(file[1]))
+		require.NoError(t, err)
 	}
-	return args.Get(0).(*service.ProgressInfo)
-}
+	for name, value := range fields {
+		require.NoError(t, writer.WriteField(name, value))
+	}
+	require.NoError(t, writer.Close())
 
-func (m *MockUploadService) GetAllFileProgress() []*service.ProgressInfo {
-	args := m.Called()
-	return args.Get(0).([]*service.ProgressInfo)
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
 }
 
-func (m *MockUploadService) RegisterProgressListener(ch chan *service.ProgressInfo) {
-	m.Called(ch)
+// uploadResponse is the body of a successful upload
+type uploadResponse struct {
+	BatchID string `json:"batchId"`
+	Jobs    []struct {
+		JobID      string `json:"jobId"`
+		FileName   string `json:"fileName"`
+		ParentFile string `json:"parentFile"`
+	} `json:"jobs"`
 }
 
-func (m *MockUploadService) UnregisterProgressListener(ch chan *service.ProgressInfo) {
-	m.Called(ch)
+// waitForBatch waits until every job of a batch has finished
+func waitForBatch(t *testing.T, uploadService *service.UploadService, batchID string) service.BatchSummary {
+	var batch service.BatchSummary
+	require.Eventually(t, func() bool {
+		summary, err := uploadService.GetBatch(batchID)
+		require.NoError(t, err)
+		batch = *summary
+		return batch.Status == service.StatusCompleted || batch.Status == service.StatusError
+	}, 5*time.Second, 10*time.Millisecond)
+	return batch
 }
 
 func TestUploadCSV(t *testing.T) {
-	// Setup mock service
-	mockService := new(MockUploadService)
-	mockService.On("ProcessCSV", mock.AnythingOfType("string")).Return(nil)
-
-	handler := handler.NewUploadHandler(mockService)
+	inTempDir(t)
+	uploadService := service.NewUploadService(setupTestDB(t))
+	uploadHandler := handler.NewUploadHandler(uploadService)
 
-	// Create a test file
-	csvContent := "StudentID,StudentName,Subject,Grade\nS001,Alice,Math,95"
-
-	// Create multipart request
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("files", "test.csv")
-	if err != nil {
-		t.Fatal(err)
-	}
-	part.Write([]byte(csvContent))
-	writer.Close()
-
-	// Create the HTTP request
-	req := httptest.NewRequest("POST", "/upload", body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	// Record the response
 	w := httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, multipartUpload(t, [][2]string{{"test.csv", "StudentID,StudentName,Subject,Grade\nS001,Alice,Math,95"}}, nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
 
-	// Call the handler
-	handler.UploadCSV(w, req)
+	var response uploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Jobs, 1)
+	assert.Equal(t, "test.csv", response.Jobs[0].FileName)
 
-	// Check the response
-	resp := w.Result()
-	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
-
-	// Check that the mock was called
-	mockService.AssertCalled(t, "ProcessCSV", mock.AnythingOfType("string"))
+	batch := waitForBatch(t, uploadService, response.BatchID)
+	assert.Equal(t, service.StatusCompleted, batch.Status)
+	assert.Equal(t, 1, batch.Processed)
 
 	// Check that the uploads directory was created
-	_, err = os.Stat("uploads")
+	_, err := os.Stat("uploads")
 	assert.NoError(t, err)
-
-	// Clean up
-	os.RemoveAll("uploads")
 }
 
 func TestUploadCSV_NoFiles(t *testing.T) {
-	mockService := new(MockUploadService)
-	handler := handler.NewUploadHandler(mockService)
-
-	// Create multipart request with no files
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	writer.Close()
-
-	req := httptest.NewRequest("POST", "/upload", body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	inTempDir(t)
+	uploadHandler := handler.NewUploadHandler(service.NewUploadService(setupTestDB(t)))
 
 	w := httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, multipartUpload(t, nil, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "No files uploaded")
+}
 
-	handler.UploadCSV(w, req)
+func TestUploadCSV_MalformedBody(t *testing.T) {
+	inTempDir(t)
+	uploadHandler := handler.NewUploadHandler(service.NewUploadService(setupTestDB(t)))
 
-	resp := w.Result()
-	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	// A body that is not valid multipart data cannot be parsed
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(make([]byte, 1024)))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=missing")
 
-	respBody, _ := ioutil.ReadAll(resp.Body)
-	assert.Contains(t, string(respBody), "No files uploaded")
+	w := httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
 }
 
-func TestUploadCSV_FileTooLarge(t *testing.T) {
-	mockService := new(MockUploadService)
-	handler := handler.NewUploadHandler(mockService)
-
-	// Create a large file that exceeds the limit
-	largeData := make([]byte, 101*1024*1024) // 101 MB
+func TestUploadCSV_SameFileNames(t *testing.T) {
+	inTempDir(t)
+	db := setupTestDB(t)
+	uploadService := service.NewUploadService(db)
+	uploadHandler := handler.NewUploadHandler(uploadService)
 
-	// Create multipart request
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	// Two parts with the same name, as when files from different folders are picked
+	files := [][2]string{
+		{"grades.csv", "student_id,student_name,subject,grade\nS1,Alice,Math,95\n"},
+		{"grades.csv", "student_id,student_name,subject,grade\nS2,Bob,Art,80\n"},
+	}
 
-	part, err := writer.CreateFormFile("files", "large.csv")
-	if err != nil {
-		t.Fatal(err)
+	w := httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, multipartUpload(t, files, map[string]string{"dry_run": "true"}))
+	require.Equal(t, http.StatusOK, w.Code)
+	var preview struct {
+		Files []struct {
+			FileName   string
+			SampleRows []model.Student
+		} `json:"files"`
 	}
-	part.Write(largeData)
-	writer.Close()
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&preview))
+	require.Len(t, preview.Files, 2)
+	previewed := []string{preview.Files[0].SampleRows[0].StudentID, preview.Files[1].SampleRows[0].StudentID}
+	assert.ElementsMatch(t, []string{"S1", "S2"}, previewed, "each part is previewed from its own content")
+
+	w = httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, multipartUpload(t, files, nil))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var response uploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	batch := waitForBatch(t, uploadService, response.BatchID)
+	assert.Equal(t, service.StatusCompleted, batch.Status)
+
+	var ids []string
+	require.NoError(t, db.Model(&model.Student{}).Order("student_id").Pluck("student_id", &ids).Error)
+	assert.Equal(t, []string{"S1", "S2"}, ids, "neither part overwrote the other")
+}
 
-	req := httptest.NewRequest("POST", "/upload", body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+func TestUploadCSV_DryRun(t *testing.T) {
+	inTempDir(t)
+	db := setupTestDB(t)
+	uploadHandler := handler.NewUploadHandler(service.NewUploadService(db))
 
+	content := "student_id,student_name,subject,grade\nS1,Alice,Math,95\nS2,Bob,Art,high\n"
 	w := httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, multipartUpload(t, [][2]string{{"grades.csv", content}}, map[string]string{"dry_run": "true"}))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var preview struct {
+		DryRun bool `json:"dry_run"`
+		Files  []struct {
+			FileName  string
+			ValidRows int
+			Rejected  int
+			Error     string
+		} `json:"files"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&preview))
+	assert.True(t, preview.DryRun)
+	require.Len(t, preview.Files, 1)
+	assert.Equal(t, "grades.csv", preview.Files[0].FileName)
+	assert.Empty(t, preview.Files[0].Error)
+	assert.Equal(t, 1, preview.Files[0].ValidRows)
+	assert.Equal(t, 1, preview.Files[0].Rejected)
+
+	var count int64
+	db.Model(&model.Student{}).Count(&count)
+	assert.Zero(t, count, "a dry run writes nothing")
+}
 
-	handler.UploadCSV(w, req)
+func TestUploadCSV_ArchiveUploadTiming(t *testing.T) {
+	inTempDir(t)
+	uploadService := service.NewUploadService(setupTestDB(t))
+	uploadHandler := handler.NewUploadHandler(uploadService)
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
+
+	archive := &bytes.Buffer{}
+	writer := zip.NewWriter(archive)
+	for _, name := range []string{"math.csv", "art.csv"} {
+		entry, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = entry.Write([]byte("student_id,student_name,subject,grade\n" + name + ",Alice,Math,95\n"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
 
-	resp := w.Result()
-	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	w := httptest.NewRecorder()
+	uploadHandler.UploadCSV(w, multipartUpload(t, [][2]string{{"grades.zip", archive.String()}}, nil))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var response uploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Jobs, 2)
+	waitForBatch(t, uploadService, response.BatchID)
+
+	// The archive is reported as uploading from the start, like any other file
+	events, ok := subscription.Next()
+	require.True(t, ok)
+	require.NotEmpty(t, events)
+	first := events[0]
+	assert.Equal(t, service.StatusUploading, first.Progress.Status)
+	assert.Equal(t, "grades.zip", first.Progress.FileName)
+	assert.Equal(t, response.Jobs[0].JobID, first.Progress.JobID, "the archive's job goes to its first file")
+
+	for _, job := range response.Jobs {
+		assert.Equal(t, "grades.zip", job.ParentFile)
+		progress := uploadService.GetJobProgress(job.JobID)
+		require.NotNil(t, progress, job.FileName)
+		assert.Equal(t, service.StatusCompleted, progress.Status, job.FileName)
+		assert.Positive(t, progress.Timings.Upload, "%s has the archive's upload time", job.FileName)
+		assert.GreaterOrEqual(t, progress.Timings.QueueWait, time.Duration(0), job.FileName)
+	}
+	assert.Equal(t, uploadService.GetJobProgress(response.Jobs[0].JobID).Timings.Upload,
+		uploadService.GetJobProgress(response.Jobs[1].JobID).Timings.Upload)
 }
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"archive/zip"
+	"backend/internal/config"
+	"backend/internal/model"
+	"backend/internal/service"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeZip creates a zip archive holding entries files, each a small CSV
+func writeZip(t *testing.T, entries int) string {
+	path := filepath.Join(t.TempDir(), "upload.zip")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for i := 0; i < entries; i++ {
+		entry, err := archive.Create(fmt.Sprintf("part-%d.csv", i))
+		require.NoError(t, err)
+		fmt.Fprintf(entry, "student_id,student_name,subject,grade\nS%d,Name,Math,90\n", i)
+	}
+	require.NoError(t, archive.Close())
+	return path
+}
+
+func TestExtractArchiveLimitsEntryCount(t *testing.T) {
+	entries, err := service.ExtractArchive(writeZip(t, 1000), t.TempDir())
+	require.NoError(t, err)
+	assert.Len(t, entries, 1000)
+
+	_, err = service.ExtractArchive(writeZip(t, 1001), t.TempDir())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "more than the limit of 1000")
+}
+
+func TestExtractArchiveLimitsTotalSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bomb.zip")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	archive := zip.NewWriter(file)
+
+	// Three entries that each claim 1.5GB: under the per-entry limit, over the total
+	data := []byte("student_id,student_name,subject,grade\n")
+	for i := 0; i < 3; i++ {
+		entry, err := archive.CreateRaw(&zip.FileHeader{
+			Name:               fmt.Sprintf("part-%d.csv", i),
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(data),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: 3 << 29,
+		})
+		require.NoError(t, err)
+		_, err = entry.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, file.Close())
+
+	destDir := filepath.Join(t.TempDir(), "out")
+	_, err = service.ExtractArchive(path, destDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "archive expands to more than")
+
+	_, statErr := os.Stat(destDir)
+	assert.True(t, os.IsNotExist(statErr), "nothing is extracted from a rejected archive")
+}
+
+func TestFinishedJobsAndBatchesAreEvicted(t *testing.T) {
+	retention := config.JobRetention
+	config.JobRetention = 20 * time.Millisecond
+	defer func() { config.JobRetention = retention }()
+
+	uploadService := service.NewUploadService(setupImportDB(t))
+
+	batchID := uploadService.CreateBatch(time.Now())
+	finished := uploadService.CreateJob("finished.csv", batchID, "")
+	uploadService.BatchUploaded(batchID)
+	require.NoError(t, uploadService.CancelJob(finished))
+	queued := uploadService.CreateJob("queued.csv", "", "")
+
+	time.Sleep(50 * time.Millisecond)
+	uploadService.CreateJob("next.csv", "", "")
+
+	assert.Nil(t, uploadService.GetJobProgress(finished), "finished job is forgotten")
+	assert.NotNil(t, uploadService.GetJobProgress(queued), "active job is kept")
+	_, err := uploadService.GetBatch(batchID)
+	assert.ErrorIs(t, err, service.ErrBatchNotFound)
+}
+
+func TestExtractArchiveDecompressesGzipMembers(t *testing.T) {
+	csv := []byte("student_id,student_name,subject,grade\nS1,Alice,Math,95\n")
+	path := filepath.Join(t.TempDir(), "upload.zip")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	archive := zip.NewWriter(file)
+	for name, content := range map[string][]byte{
+		"grades.csv.gz": gzipData(t, csv),
+		"twice.csv.gz":  gzipData(t, gzipData(t, csv)),
+		"not-really.gz": []byte("plain text"),
+	} {
+		entry, err := archive.Create(name)
+		require.NoError(t, err)
+		_, err = entry.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, file.Close())
+
+	// Stored decompressed, so the size limits count the data that is imported
+	entries, err := service.ExtractArchive(path, t.TempDir())
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		extracted, err := os.ReadFile(entry.Path)
+		require.NoError(t, err)
+		if entry.Name == "not-really.gz" {
+			assert.Equal(t, "plain text", string(extracted))
+			continue
+		}
+		assert.Equal(t, string(csv), string(extracted), entry.Name)
+		assert.Equal(t, ".csv", filepath.Ext(entry.Path))
+	}
+}
+
+func TestExtractArchiveRejectsCorruptGzipMembers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.zip")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	archive := zip.NewWriter(file)
+	entry, err := archive.Create("grades.csv.gz")
+	require.NoError(t, err)
+	_, err = entry.Write([]byte{0x1f, 0x8b, 0x00})
+	require.NoError(t, err)
+	require.NoError(t, archive.Close())
+	require.NoError(t, file.Close())
+
+	_, err = service.ExtractArchive(path, t.TempDir())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid gzip data")
+}
+
+func gzipData(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func TestImportReadsGzipUploads(t *testing.T) {
+	content := gzipData(t, []byte("student_id\tstudent_name\tsubject\tgrade\nS1\tAlice\tMath\t95\n"))
+	rows, _ := previewRows(t, "grades.tsv.gz", content, service.DefaultImportOptions())
+	assert.Equal(t, []model.Student{alice}, rows)
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"backend/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// importWithPolicy imports content under policy and returns the job's final progress
+func importWithPolicy(t *testing.T, uploadService *service.UploadService, name, content string, policy service.DuplicatePolicy) (*service.ProgressInfo, error) {
+	opts := service.DefaultImportOptions()
+	opts.DuplicatePolicy = policy
+	err := uploadService.ProcessFile(writeTestFile(t, name, content), opts)
+	progress := uploadService.GetFileProgress(name)
+	require.NotNil(t, progress)
+	return progress, err
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	content := "student_id,student_name,subject,grade\nS1,Alice,Math,90\nS2,Bob,Art,70\nS1,Alice,Math,80\n"
+
+	tests := []struct {
+		policy    service.DuplicatePolicy
+		grade     int
+		rowErrors []service.RowError
+	}{
+		{service.DuplicateFirstWins, 90, []service.RowError{{Line: 4, StudentID: "S1", Message: "duplicate student ID (kept line 2)"}}},
+		{service.DuplicateLastWins, 80, []service.RowError{{Line: 2, StudentID: "S1", Message: "duplicate student ID (kept line 4)"}}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			db := setupImportDB(t)
+			progress, err := importWithPolicy(t, service.NewUploadService(db), "grades.csv", content, tt.policy)
+			require.NoError(t, err)
+
+			assert.Equal(t, service.StatusCompleted, progress.Status)
+			assert.Equal(t, 1, progress.Duplicates)
+			assert.Equal(t, 0, progress.Rejected)
+			assert.Equal(t, tt.rowErrors, progress.RowErrors)
+			assert.Equal(t, tt.grade, findStudent(t, db, "S1").Grade)
+			assert.Equal(t, 70, findStudent(t, db, "S2").Grade)
+		})
+	}
+}
+
+func TestDuplicateErrorRejectsFile(t *testing.T) {
+	db := setupImportDB(t)
+	content := "student_id,student_name,subject,grade\nS1,Alice,Math,90\nS1,Alice,Math,80\nS2,Bob,Art,70\nS1,Alice,Math,85\n"
+	progress, err := importWithPolicy(t, service.NewUploadService(db), "grades.csv", content, service.DuplicateError)
+	require.Error(t, err)
+	assert.Equal(t, "found 2 duplicate student ID rows, first at line 3", err.Error())
+
+	assert.Equal(t, service.StatusError, progress.Status)
+	assert.Equal(t, []service.RowError{
+		{Line: 3, StudentID: "S1", Message: "duplicate of line 2"},
+		{Line: 5, StudentID: "S1", Message: "duplicate of line 2"},
+	}, progress.RowErrors)
+
+	var count int64
+	db.Table("students").Count(&count)
+	assert.Zero(t, count, "nothing is imported from a rejected file")
+}
+
+func TestInvalidRowsDoNotTakePartInDuplicates(t *testing.T) {
+	tests := []struct {
+		policy  service.DuplicatePolicy
+		content string
+		grade   int
+		invalid int // line of the rejected row
+	}{
+		{service.DuplicateFirstWins, "student_id,student_name,subject,grade\nS1,Alice,Math,high\nS1,Alice,Math,80\n", 80, 2},
+		{service.DuplicateLastWins, "student_id,student_name,subject,grade\nS1,Alice,Math,90\nS1,Alice,Math,high\n", 90, 3},
+		{service.DuplicateError, "student_id,student_name,subject,grade\nS1,Alice,Math,high\nS1,Alice,Math,80\n", 80, 2},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			db := setupImportDB(t)
+			progress, err := importWithPolicy(t, service.NewUploadService(db), "grades.csv", tt.content, tt.policy)
+			require.NoError(t, err)
+
+			assert.Equal(t, 0, progress.Duplicates)
+			assert.Equal(t, 1, progress.Rejected)
+			require.Len(t, progress.RowErrors, 1)
+			assert.Equal(t, tt.invalid, progress.RowErrors[0].Line)
+			assert.Equal(t, `invalid grade "high"`, progress.RowErrors[0].Message)
+			assert.Equal(t, tt.grade, findStudent(t, db, "S1").Grade)
+		})
+	}
+}
+
+func TestBlankIDsAreNotDuplicates(t *testing.T) {
+	db := setupImportDB(t)
+	content := "student_id,student_name,subject,grade\n,Alice,Math,90\nS1,Bob,Art,70\n,Carol,Art,80\n"
+	progress, err := importWithPolicy(t, service.NewUploadService(db), "grades.csv", content, service.DuplicateError)
+	require.NoError(t, err, "empty cells do not reject the file")
+
+	assert.Equal(t, 0, progress.Duplicates)
+	assert.Equal(t, 70, findStudent(t, db, "S1").Grade)
+
+	// A blank ID is rejected as the API rejects it
+	assert.Equal(t, 2, progress.Rejected)
+	assert.ElementsMatch(t, []service.RowError{
+		{Line: 2, Message: "student_id is empty"},
+		{Line: 4, Message: "student_id is empty"},
+	}, progress.RowErrors)
+}
+
+func TestPreviewResolvesDuplicatesLikeImport(t *testing.T) {
+	uploadService := service.NewUploadService(setupImportDB(t))
+	content := "student_id,student_name,subject,grade\nS1,Alice,Math,high\nS1,Alice,Math,80\nS1,Alice,Math,85\n"
+
+	summary, err := uploadService.PreviewFile(writeTestFile(t, "grades.csv", content), service.DefaultImportOptions(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.ValidRows)
+	assert.Equal(t, 1, summary.Rejected)
+	assert.Equal(t, 1, summary.Duplicates)
+	require.Len(t, summary.SampleRows, 1)
+	assert.Equal(t, 80, summary.SampleRows[0].Grade)
+	assert.Equal(t, []service.RowError{
+		{Line: 2, StudentID: "S1", Message: `invalid grade "high"`},
+		{Line: 4, StudentID: "S1", Message: "duplicate student ID (kept line 3)"},
+	}, summary.Errors)
+}
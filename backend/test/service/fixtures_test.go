@@ -0,0 +1,75 @@
+package service
+
+import (
+	"backend/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// setupTestDB opens a private in-memory database on a single connection
+func setupTestDB() *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		panic("failed to connect to database")
+	}
+	// Every connection to :memory: is a separate database
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic("failed to get database instance")
+	}
+	sqlDB.SetMaxOpenConns(1)
+	db.AutoMigrate(&model.Student{}, &model.ImportBackup{}, &model.GradeChange{})
+	return db
+}
+
+// setupImportDB opens an in-memory database shared by every connection of the
+// pool, since import workers write concurrently
+func setupImportDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.Student{}, &model.ImportBackup{}, &model.GradeChange{}))
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// setupWebhookDB is setupImportDB with the webhook tables
+func setupWebhookDB(t *testing.T) *gorm.DB {
+	db := setupImportDB(t)
+	require.NoError(t, db.AutoMigrate(&model.Webhook{}, &model.WebhookDelivery{}))
+	return db
+}
+
+func seedStudents(db *gorm.DB) {
+	students := []model.Student{
+		{StudentID: "S1", StudentName: "John Doe", Subject: "Math", Grade: 90},
+		{StudentID: "S2", StudentName: "Jane Doe", Subject: "Science", Grade: 85},
+		{StudentID: "S3", StudentName: "Alice", Subject: "Math", Grade: 95},
+	}
+	for _, student := range students {
+		db.Create(&student)
+	}
+}
+
+// writeTestFile writes content to a file named name in a temporary directory
+func writeTestFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func findStudent(t *testing.T, db *gorm.DB, id string) model.Student {
+	var student model.Student
+	require.NoError(t, db.Where("student_id = ?", id).Take(&student).Error)
+	return student
+}
+
+func intPtr(value int) *int {
+	return &value
+}
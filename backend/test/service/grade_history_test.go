@@ -0,0 +1,51 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGradeHistoryRecordsCreateUpdateAndDelete(t *testing.T) {
+	db := setupImportDB(t)
+	studentService := service.NewStudentService(db)
+
+	_, err := studentService.CreateStudent(model.Student{StudentID: "S1", StudentName: "Alice", Subject: "Math", Grade: 70}, "registrar")
+	require.NoError(t, err)
+	grade := 85
+	_, err = studentService.UpdateStudent("S1", service.StudentChanges{Grade: &grade, ChangedBy: "teacher"}, false)
+	require.NoError(t, err)
+	require.NoError(t, studentService.DeleteStudent("S1", "admin"))
+
+	history, err := studentService.GradeHistory("S1")
+	require.NoError(t, err, "history outlives the student")
+	require.Len(t, history, 3)
+
+	assert.Equal(t, service.GradeActionCreate, history[0].Action)
+	assert.Equal(t, 70, history[0].NewGrade)
+	assert.Equal(t, "registrar", history[0].ChangedBy)
+
+	assert.Equal(t, service.GradeActionUpdate, history[1].Action)
+	assert.Equal(t, 70, history[1].OldGrade)
+	assert.Equal(t, 85, history[1].NewGrade)
+	assert.Equal(t, "teacher", history[1].ChangedBy)
+
+	assert.Equal(t, service.GradeActionDelete, history[2].Action)
+	assert.Equal(t, 85, history[2].OldGrade)
+	assert.Equal(t, "admin", history[2].ChangedBy)
+	for _, change := range history {
+		assert.Equal(t, service.GradeSourceAPI, change.Source)
+	}
+
+	assert.ErrorIs(t, studentService.DeleteStudent("S1", "admin"), service.ErrStudentNotFound)
+	_, err = studentService.CreateStudent(model.Student{StudentID: "S2", StudentName: "Bob", Subject: "Art", Grade: 60}, "")
+	require.NoError(t, err)
+	_, err = studentService.CreateStudent(model.Student{StudentID: "S2", StudentName: "Bob", Subject: "Art", Grade: 90}, "")
+	assert.ErrorIs(t, err, service.ErrStudentExists)
+	history, err = studentService.GradeHistory("S2")
+	require.NoError(t, err)
+	assert.Len(t, history, 1, "a rejected duplicate records nothing")
+}
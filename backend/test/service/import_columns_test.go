@@ -0,0 +1,83 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportReadsColumnsByPosition(t *testing.T) {
+	db := setupImportDB(t)
+	uploadService := service.NewUploadService(db)
+
+	// Header names are ignored: the columns are ID, name, subject, grade in that order
+	path := writeTestFile(t, "scores.csv", "ID,Name,Course,Score\nS001,Alice,Math,95\nS002,,Science,87\n")
+	require.NoError(t, uploadService.ProcessFile(path, service.DefaultImportOptions()))
+
+	progress := uploadService.GetFileProgress("scores.csv")
+	require.NotNil(t, progress)
+	assert.Equal(t, service.StatusCompleted, progress.Status)
+	assert.Equal(t, 2, progress.TotalRecords)
+	assert.Equal(t, 0, progress.Rejected)
+
+	alice := findStudent(t, db, "S001")
+	assert.Equal(t, "Alice", alice.StudentName)
+	assert.Equal(t, "Math", alice.Subject)
+	assert.Equal(t, 95, alice.Grade)
+	assert.Equal(t, "", findStudent(t, db, "S002").StudentName)
+}
+
+func TestImportMapsColumnsByHeader(t *testing.T) {
+	db := setupImportDB(t)
+	uploadService := service.NewUploadService(db)
+
+	opts := service.DefaultImportOptions()
+	opts.MapColumns = true
+	path := writeTestFile(t, "reordered.csv", "Grade,Subject,Student Name,student_id\n95,Math,Alice,S001\n")
+	require.NoError(t, uploadService.ProcessFile(path, opts))
+
+	alice := findStudent(t, db, "S001")
+	assert.Equal(t, "Alice", alice.StudentName)
+	assert.Equal(t, "Math", alice.Subject)
+	assert.Equal(t, 95, alice.Grade)
+}
+
+func TestImportMapColumnsRejectsIncompleteHeader(t *testing.T) {
+	db := setupImportDB(t)
+	uploadService := service.NewUploadService(db)
+
+	opts := service.DefaultImportOptions()
+	opts.MapColumns = true
+	path := writeTestFile(t, "partial.csv", "ID,Name,Course,Score\nS001,Alice,Math,95\n")
+	err := uploadService.ProcessFile(path, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing required column(s): subject, grade")
+
+	progress := uploadService.GetFileProgress("partial.csv")
+	require.NotNil(t, progress)
+	assert.Equal(t, service.StatusError, progress.Status)
+}
+
+func TestPreviewMatchesImportColumns(t *testing.T) {
+	db := setupImportDB(t)
+	uploadService := service.NewUploadService(db)
+
+	path := writeTestFile(t, "scores.csv", "ID,Name,Course,Score\nS001,Alice,Math,95\nS002,Bob,Science,high\n")
+	summary, err := uploadService.PreviewFile(path, service.DefaultImportOptions(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.ValidRows)
+	assert.Equal(t, 1, summary.Rejected)
+	assert.Equal(t, 1, summary.WouldInsert)
+
+	opts := service.DefaultImportOptions()
+	opts.MapColumns = true
+	_, err = uploadService.PreviewFile(path, opts, 10)
+	assert.Error(t, err)
+
+	var count int64
+	db.Model(&model.Student{}).Count(&count)
+	assert.Equal(t, int64(0), count, "a dry run writes nothing")
+}
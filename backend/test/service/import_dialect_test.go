@@ -0,0 +1,163 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportDialects(t *testing.T) {
+	noHeader, header := false, true
+	tests := []struct {
+		name    string
+		content string
+		dialect service.Dialect
+		rows    []model.Student
+	}{
+		{
+			name:    "semicolon sniffed",
+			content: "student_id;student_name;subject;grade\nS1;Alice;Math;95\nS2;Bob;Art;80\n",
+			rows:    []model.Student{alice, bob},
+		},
+		{
+			name:    "pipe sniffed",
+			content: "student_id|student_name|subject|grade\nS1|Alice|Math|95\n",
+			rows:    []model.Student{alice},
+		},
+		{
+			name:    "delimiters inside quotes are not counted",
+			content: "student_id;student_name;subject;grade\nS1;\"Smith, Alice, Jr\";Math;95\nS2;\"Doe, Bob, Sr\";Art;80\n",
+			rows: []model.Student{
+				{StudentID: "S1", StudentName: "Smith, Alice, Jr", Subject: "Math", Grade: 95},
+				{StudentID: "S2", StudentName: "Doe, Bob, Sr", Subject: "Art", Grade: 80},
+			},
+		},
+		{
+			name:    "comment lines are not sniffed",
+			content: "# exported;by;the;gradebook;tool\nstudent_id,student_name,subject,grade\nS1,Alice,Math,95\n",
+			dialect: service.Dialect{Comment: '#'},
+			rows:    []model.Student{alice},
+		},
+		{
+			name:    "declared delimiter wins",
+			content: "student_id;student_name;subject;grade\nS1;Smith, Alice;Math;95\n",
+			dialect: service.Dialect{Delimiter: ';'},
+			rows:    []model.Student{{StudentID: "S1", StudentName: "Smith, Alice", Subject: "Math", Grade: 95}},
+		},
+		{
+			name:    "single quotes",
+			content: "student_id,student_name,subject,grade\nS1,'O\"Brien, ''Al''',Math,95\n",
+			dialect: service.Dialect{Quote: '\''},
+			rows:    []model.Student{{StudentID: "S1", StudentName: `O"Brien, 'Al'`, Subject: "Math", Grade: 95}},
+		},
+		{
+			name:    "header sniffed as data from a numeric grade",
+			content: "S1,Alice,Math,95\nS2,Bob,Art,80\n",
+			rows:    []model.Student{alice, bob},
+		},
+		{
+			name:    "header declared absent",
+			content: "S1,Alice,Math,95\n",
+			dialect: service.Dialect{Header: &noHeader},
+			rows:    []model.Student{alice},
+		},
+		{
+			name:    "header declared present",
+			content: "S0,Nobody,None,0\nS1,Alice,Math,95\n",
+			dialect: service.Dialect{Header: &header},
+			rows:    []model.Student{alice},
+		},
+		{
+			name:    "skipped lines and trimmed fields",
+			content: "Gradebook export\n2024-06-01\nstudent_id, student_name, subject, grade\nS1,  Alice ,Math , 95\n",
+			dialect: service.Dialect{SkipLines: 2, TrimSpace: true},
+			rows:    []model.Student{alice},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := service.DefaultImportOptions()
+			opts.Format = service.FormatCSV
+			opts.Dialect = tt.dialect
+			rows, summary := previewRows(t, "grades.csv", []byte(tt.content), opts)
+			assert.Empty(t, summary.Errors)
+			assert.Equal(t, tt.rows, rows)
+		})
+	}
+}
+
+func TestImportDialectReportsLinesAfterSkippedLines(t *testing.T) {
+	opts := service.DefaultImportOptions()
+	opts.Dialect = service.Dialect{SkipLines: 2}
+	_, summary := previewRows(t, "grades.csv", []byte("title\n\nstudent_id,student_name,subject,grade\nS1,Alice,Math,high\n"), opts)
+	assert.Equal(t, []service.RowError{{Line: 4, StudentID: "S1", Message: `invalid grade "high"`}}, summary.Errors)
+}
+
+func TestParseDialectValues(t *testing.T) {
+	charTests := []struct {
+		value string
+		char  rune
+		valid bool
+	}{
+		{"", 0, true},
+		{";", ';', true},
+		{"tab", '\t', true},
+		{`\t`, '\t', true},
+		{"é", 'é', true},
+		{";;", 0, false},
+		{"\n", 0, false},
+	}
+	for _, tt := range charTests {
+		char, err := service.ParseChar("delimiter", tt.value)
+		assert.Equal(t, tt.valid, err == nil, tt.value)
+		assert.Equal(t, tt.char, char, tt.value)
+	}
+
+	quoteTests := []struct {
+		value string
+		quote rune
+		valid bool
+	}{
+		{"", '"', true},
+		{"double", '"', true},
+		{"'", '\'', true},
+		{"single", '\'', true},
+		{"`", 0, false},
+	}
+	for _, tt := range quoteTests {
+		quote, err := service.ParseQuote(tt.value)
+		assert.Equal(t, tt.valid, err == nil, tt.value)
+		assert.Equal(t, tt.quote, quote, tt.value)
+	}
+
+	for value, want := range map[string]*bool{"": nil, "auto": nil, "true": boolPtr(true), "0": boolPtr(false)} {
+		got, err := service.ParseHeader(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+	_, err := service.ParseHeader("sometimes")
+	assert.Error(t, err)
+}
+
+func TestDialectValidate(t *testing.T) {
+	tests := []struct {
+		dialect service.Dialect
+		valid   bool
+	}{
+		{service.Dialect{}, true},
+		{service.Dialect{Delimiter: ';', Comment: '#'}, true},
+		{service.Dialect{Delimiter: '"'}, false},
+		{service.Dialect{Comment: '\''}, false},
+		{service.Dialect{Delimiter: '#', Comment: '#'}, false},
+		{service.Dialect{SkipLines: -1}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.valid, tt.dialect.Validate() == nil, "%+v", tt.dialect)
+	}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
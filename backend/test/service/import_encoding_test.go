@@ -0,0 +1,85 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func encodeText(t *testing.T, enc encoding.Encoding, text string) []byte {
+	t.Helper()
+	encoded, err := enc.NewEncoder().Bytes([]byte(text))
+	require.NoError(t, err)
+	return encoded
+}
+
+func TestImportDetectsEncoding(t *testing.T) {
+	text := "student_id,student_name,subject,grade\nS1,José Müller,Math,95\n"
+	jose := model.Student{StudentID: "S1", StudentName: "José Müller", Subject: "Math", Grade: 95}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		declared string
+	}{
+		{"utf-8", []byte(text), ""},
+		{"utf-8 with BOM", append([]byte{0xef, 0xbb, 0xbf}, text...), ""},
+		{"utf-16le with BOM", encodeText(t, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), text), ""},
+		{"utf-16be with BOM", encodeText(t, unicode.UTF16(unicode.BigEndian, unicode.UseBOM), text), ""},
+		{"utf-16le without BOM", encodeText(t, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), text), ""},
+		{"utf-16be without BOM", encodeText(t, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), text), ""},
+		{"windows-1252 detected", []byte("student_id,student_name,subject,grade\nS1,Jos\xe9 M\xfcller,Math,95\n"), ""},
+		{"latin1 declared", []byte("student_id,student_name,subject,grade\nS1,Jos\xe9 M\xfcller,Math,95\n"), "windows-1252"},
+		{"utf-16le declared, BOM still stripped", encodeText(t, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), text), "utf-16le"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := service.DefaultImportOptions()
+			opts.Encoding = tt.declared
+			// Header names only match if the BOM was removed from the first one
+			opts.MapColumns = true
+			rows, summary := previewRows(t, "grades.csv", tt.content, opts)
+			assert.Empty(t, summary.Errors)
+			assert.Equal(t, []model.Student{jose}, rows)
+		})
+	}
+}
+
+func TestImportDetectsEncodingAcrossSplitCharacter(t *testing.T) {
+	// The sniffed sample ends inside a two-byte character, which must not make it look like Windows-1252
+	padding := make([]byte, 64*1024-len("student_id,student_name,subject,grade\nS1,")-1)
+	for i := range padding {
+		padding[i] = 'a'
+	}
+	content := "student_id,student_name,subject,grade\nS1," + string(padding) + "é,Math,95\n"
+
+	opts := service.DefaultImportOptions()
+	rows, _ := previewRows(t, "grades.csv", []byte(content), opts)
+	require.Len(t, rows, 1)
+	assert.Equal(t, string(padding)+"é", rows[0].StudentName)
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		value string
+		name  string
+		valid bool
+	}{
+		{"", "", true},
+		{"auto", "", true},
+		{"UTF8", "utf-8", true},
+		{"latin1", "windows-1252", true},
+		{" utf-16le ", "utf-16le", true},
+		{"klingon", "", false},
+	}
+	for _, tt := range tests {
+		name, err := service.ParseEncoding(tt.value)
+		assert.Equal(t, tt.valid, err == nil, tt.value)
+		assert.Equal(t, tt.name, name, tt.value)
+	}
+}
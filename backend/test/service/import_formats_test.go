@@ -0,0 +1,150 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuri/excelize/v2"
+)
+
+// previewRows dry-runs content and returns the rows it would import
+func previewRows(t *testing.T, name string, content []byte, opts service.ImportOptions) ([]model.Student, *service.ImportSummary) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	summary, err := service.NewUploadService(setupImportDB(t)).PreviewFile(path, opts, 10)
+	require.NoError(t, err)
+	rows := make([]model.Student, len(summary.SampleRows))
+	for i, row := range summary.SampleRows {
+		rows[i] = model.Student{StudentID: row.StudentID, StudentName: row.StudentName, Subject: row.Subject, Grade: row.Grade}
+	}
+	return rows, summary
+}
+
+// workbook builds an XLSX file with rows on the named sheet
+func workbook(t *testing.T, sheet string, rows [][]interface{}) []byte {
+	t.Helper()
+	file := excelize.NewFile()
+	defer file.Close()
+	if sheet != "Sheet1" {
+		_, err := file.NewSheet(sheet)
+		require.NoError(t, err)
+	}
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		require.NoError(t, err)
+		require.NoError(t, file.SetSheetRow(sheet, cell, &row))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, file.Write(&buf))
+	return buf.Bytes()
+}
+
+var (
+	alice = model.Student{StudentID: "S1", StudentName: "Alice", Subject: "Math", Grade: 95}
+	bob   = model.Student{StudentID: "S2", StudentName: "Bob", Subject: "Art", Grade: 80}
+)
+
+func TestImportRecordSources(t *testing.T) {
+	header := []interface{}{"student_id", "student_name", "subject", "grade"}
+	tests := []struct {
+		name     string
+		file     string
+		content  []byte
+		format   service.Format
+		sheet    string
+		rows     []model.Student
+		rejected []service.RowError
+	}{
+		{
+			name:    "csv",
+			file:    "grades.csv",
+			content: []byte("student_id,student_name,subject,grade\nS1,Alice,Math,95\nS2,Bob,Art,80\n"),
+			rows:    []model.Student{alice, bob},
+		},
+		{
+			name:    "tsv sniffed, stray quotes are data",
+			file:    "grades.txt",
+			content: []byte("student_id\tstudent_name\tsubject\tgrade\nS1\tAl \"Ace\" Smith\tMath\t95\n"),
+			rows:    []model.Student{{StudentID: "S1", StudentName: `Al "Ace" Smith`, Subject: "Math", Grade: 95}},
+		},
+		{
+			name:    "tsv declared, commas are data",
+			file:    "grades.tsv",
+			content: []byte("student_id\tstudent_name\tsubject\tgrade\nS1\tSmith, Alice\tMath\t95\n"),
+			format:  service.FormatTSV,
+			rows:    []model.Student{{StudentID: "S1", StudentName: "Smith, Alice", Subject: "Math", Grade: 95}},
+		},
+		{
+			name: "ndjson matches keys by name in any order",
+			file: "grades.ndjson",
+			content: []byte(`{"grade": 95, "subject": "Math", "student_name": "Alice", "student_id": "S1"}` + "\n\n" +
+				`{"id": "S2", "name": "Bob", "Subject": "Art", "Grade": "80", "extra": true}` + "\n"),
+			rows: []model.Student{alice, bob},
+		},
+		{
+			name:     "ndjson reports bad lines by line number",
+			file:     "grades.jsonl",
+			content:  []byte(`{"student_id": "S1", "student_name": "Alice", "subject": "Math", "grade": 95}` + "\n{not json\n"),
+			format:   service.FormatNDJSON,
+			rows:     []model.Student{alice},
+			rejected: []service.RowError{{Line: 2}},
+		},
+		{
+			name:    "xlsx first sheet, blank rows skipped",
+			file:    "grades.xlsx",
+			content: workbook(t, "Sheet1", [][]interface{}{header, {"S1", "Alice", "Math", 95}, {}, {"S2", "Bob", "Art", 80}}),
+			rows:    []model.Student{alice, bob},
+		},
+		{
+			name:    "xlsx named sheet",
+			file:    "grades.xlsx",
+			content: workbook(t, "Term 2", [][]interface{}{header, {"S2", "Bob", "Art", 80}}),
+			format:  service.FormatXLSX,
+			sheet:   "Term 2",
+			rows:    []model.Student{bob},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := service.DefaultImportOptions()
+			opts.Format = tt.format
+			opts.Sheet = tt.sheet
+			opts.MapColumns = true
+			rows, summary := previewRows(t, tt.file, tt.content, opts)
+			assert.Equal(t, tt.rows, rows)
+			require.Len(t, summary.Errors, len(tt.rejected))
+			for i, rejected := range tt.rejected {
+				assert.Equal(t, rejected.Line, summary.Errors[i].Line)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		value  string
+		format service.Format
+		valid  bool
+	}{
+		{"", service.FormatAuto, true},
+		{"auto", service.FormatAuto, true},
+		{" CSV ", service.FormatCSV, true},
+		{"tab", service.FormatTSV, true},
+		{"excel", service.FormatXLSX, true},
+		{"jsonl", service.FormatNDJSON, true},
+		{"json", "", false},
+	}
+	for _, tt := range tests {
+		format, err := service.ParseFormat(tt.value)
+		assert.Equal(t, tt.valid, err == nil, tt.value)
+		assert.Equal(t, tt.format, format, tt.value)
+	}
+}
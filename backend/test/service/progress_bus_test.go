@@ -0,0 +1,187 @@
+package service
+
+import (
+	"backend/internal/service"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drain collects everything queued for subscription, reporting whether
+// anything was dropped along the way
+func drain(subscription *service.ProgressSubscription) ([]service.ProgressEvent, bool) {
+	var all []service.ProgressEvent
+	complete := true
+	for {
+		select {
+		case <-subscription.C:
+			events, ok := subscription.Next()
+			all = append(all, events...)
+			complete = complete && ok
+		default:
+			return all, complete
+		}
+	}
+}
+
+func assertAscendingIDs(t *testing.T, events []service.ProgressEvent) {
+	t.Helper()
+	for i := 1; i < len(events); i++ {
+		if events[i].ID <= events[i-1].ID {
+			t.Fatalf("event %d has ID %d after %d", i, events[i].ID, events[i-1].ID)
+		}
+	}
+}
+
+func TestProgressBusConcurrentPublish(t *testing.T) {
+	uploadService := service.NewUploadService(setupImportDB(t))
+	queued := uploadService.SubscribeProgress()
+	defer queued.Close()
+	live := uploadService.SubscribeProgress()
+
+	const publishers, jobsEach = 8, 30
+	var received []service.ProgressEvent
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for range live.C {
+			events, ok := live.Next()
+			assert.True(t, ok, "a subscriber that keeps up loses nothing")
+			received = append(received, events...)
+			if len(received) == publishers*jobsEach {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for j := 0; j < jobsEach; j++ {
+				uploadService.CreateJob(fmt.Sprintf("file-%d-%d.csv", p, j), "", "")
+				// Subscribers coming and going must not disturb the others
+				uploadService.SubscribeProgress().Close()
+				uploadService.ProgressSnapshot(nil)
+			}
+		}(p)
+	}
+	wg.Wait()
+	<-readerDone
+	live.Close()
+
+	events, ok := drain(queued)
+	require.True(t, ok)
+	require.Len(t, events, publishers*jobsEach)
+	for i, event := range events {
+		assert.Equal(t, uint64(i+1), event.ID, "IDs are consecutive in publish order")
+	}
+	assert.Equal(t, events, received, "every subscriber sees the same sequence")
+
+	replay, ok := uploadService.ProgressEventsSince(0)
+	require.True(t, ok)
+	assert.Equal(t, events, replay)
+
+	stats := uploadService.ProgressBusStats()
+	assert.Equal(t, uint64(publishers*jobsEach), stats.Published)
+	assert.Equal(t, 1, stats.Subscribers)
+	assert.Zero(t, stats.Coalesced)
+	assert.Zero(t, stats.Dropped)
+}
+
+func TestProgressBusCoalescesSupersededStates(t *testing.T) {
+	uploadService := service.NewUploadService(setupImportDB(t))
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
+
+	// Each job publishes twice, uploading then queued: 400 events for a queue of 256
+	const jobs = 200
+	jobIDs := make([]string, jobs)
+	for i := range jobIDs {
+		jobIDs[i] = uploadService.CreateUploadingJob(fmt.Sprintf("file-%d.csv", i), "")
+	}
+	for _, jobID := range jobIDs {
+		uploadService.JobUploaded(jobID)
+	}
+
+	events, ok := drain(subscription)
+	require.True(t, ok, "superseded states make room without losing any job's latest state")
+	assert.Len(t, events, 256)
+	assertAscendingIDs(t, events)
+
+	latest := make(map[string]string)
+	for _, event := range events {
+		latest[event.Progress.JobID] = event.Progress.Status
+	}
+	assert.Len(t, latest, jobs)
+	for _, jobID := range jobIDs {
+		assert.Equal(t, service.StatusQueued, latest[jobID])
+	}
+
+	stats := uploadService.ProgressBusStats()
+	assert.Equal(t, uint64(2*jobs-256), stats.Coalesced)
+	assert.Zero(t, stats.Dropped)
+}
+
+func TestProgressBusDropsForSlowSubscriber(t *testing.T) {
+	uploadService := service.NewUploadService(setupImportDB(t))
+	slow := uploadService.SubscribeProgress()
+	defer slow.Close()
+
+	// Every event is the only state of its job, so nothing can be coalesced
+	const jobs = 300
+	for i := 0; i < jobs; i++ {
+		uploadService.CreateJob(fmt.Sprintf("file-%d.csv", i), "", "")
+	}
+
+	events, ok := drain(slow)
+	assert.False(t, ok, "the subscriber is told it missed events")
+	require.Len(t, events, 256)
+	assert.Equal(t, uint64(jobs-256+1), events[0].ID, "the oldest events are the ones dropped")
+	assertAscendingIDs(t, events)
+
+	stats := uploadService.ProgressBusStats()
+	assert.Equal(t, uint64(jobs-256), stats.Dropped)
+	assert.Zero(t, stats.Coalesced)
+
+	// After a drop the next batch of events is complete again
+	uploadService.CreateJob("after.csv", "", "")
+	events, ok = drain(slow)
+	assert.True(t, ok)
+	assert.Len(t, events, 1)
+}
+
+func TestProgressResyncFromSnapshot(t *testing.T) {
+	uploadService := service.NewUploadService(setupImportDB(t))
+
+	// More events than the replay buffer holds
+	const jobs = 1100
+	for i := 0; i < jobs; i++ {
+		uploadService.CreateJob(fmt.Sprintf("file-%d.csv", i), "", "")
+	}
+
+	_, ok := uploadService.ProgressEventsSince(10)
+	assert.False(t, ok, "events that left the replay buffer cannot be replayed")
+	recent, ok := uploadService.ProgressEventsSince(jobs - 5)
+	require.True(t, ok)
+	assert.Len(t, recent, 5)
+
+	snapshot, cursor := uploadService.ProgressSnapshot(nil)
+	assert.Len(t, snapshot, jobs)
+	assert.Equal(t, uint64(jobs), cursor)
+
+	// Replay continues exactly where the snapshot ends
+	jobID := uploadService.CreateJob("after.csv", "", "")
+	events, ok := uploadService.ProgressEventsSince(cursor)
+	require.True(t, ok)
+	require.Len(t, events, 1)
+	assert.Equal(t, jobID, events[0].Progress.JobID)
+
+	// An ID issued before a restart cannot be continued from
+	_, ok = uploadService.ProgressEventsSince(cursor + 100)
+	assert.False(t, ok)
+}
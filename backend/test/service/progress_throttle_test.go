@@ -0,0 +1,107 @@
+package service
+
+import (
+	"backend/internal/config"
+	"backend/internal/service"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withProgressThrottle sets the progress throttle for the services the test creates
+func withProgressThrottle(t *testing.T, interval time.Duration, minChange float64) {
+	savedInterval, savedMinChange := config.ProgressInterval, config.ProgressMinChange
+	config.ProgressInterval, config.ProgressMinChange = interval, minChange
+	t.Cleanup(func() { config.ProgressInterval, config.ProgressMinChange = savedInterval, savedMinChange })
+}
+
+// studentRows returns a CSV file of rows distinct students
+func studentRows(rows int) string {
+	var content strings.Builder
+	content.WriteString("student_id,student_name,subject,grade\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&content, "S%05d,Student,Math,%d\n", i, i%100)
+	}
+	return content.String()
+}
+
+// importEvents imports a file of rows students and returns the progress
+// events published for it, after checking that none were lost
+func importEvents(t *testing.T, rows int) []service.ProgressEvent {
+	uploadService := service.NewUploadService(setupImportDB(t))
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
+	require.NoError(t, uploadService.ProcessFile(writeTestFile(t, "grades.csv", studentRows(rows)), service.DefaultImportOptions()))
+
+	events, complete := drain(subscription)
+	require.True(t, complete)
+	require.NotEmpty(t, events)
+	final := events[len(events)-1].Progress
+	assert.Equal(t, service.StatusCompleted, final.Status)
+	assert.Equal(t, rows, final.Processed, "the final state is always delivered")
+	return events
+}
+
+// processingCounts returns the Processed counts of the processing events
+func processingCounts(events []service.ProgressEvent) []int {
+	var counts []int
+	for _, event := range events {
+		if event.Progress.Status == service.StatusProcessing {
+			counts = append(counts, event.Progress.Processed)
+		}
+	}
+	return counts
+}
+
+func TestProgressThrottleCoalescesBursts(t *testing.T) {
+	// Neither the interval nor a large enough change is reached during the import
+	withProgressThrottle(t, time.Hour, 101)
+
+	events := importEvents(t, 2000)
+	assert.Equal(t, []int{0}, processingCounts(events), "only the start of processing is broadcast")
+}
+
+func TestProgressThrottleBroadcastsLargeChanges(t *testing.T) {
+	withProgressThrottle(t, time.Hour, 20)
+
+	counts := processingCounts(importEvents(t, 2000))
+	require.NotEmpty(t, counts)
+	assert.LessOrEqual(t, len(counts), 6, "the start, then at most one broadcast per 20%% of the rows")
+	for i := 1; i < len(counts); i++ {
+		assert.GreaterOrEqual(t, counts[i]-counts[i-1], 400, "counts %v", counts)
+	}
+}
+
+func TestProgressThrottleDisabled(t *testing.T) {
+	withProgressThrottle(t, 0, 0)
+
+	// Counters are updated every 100 rows, and each update is broadcast
+	counts := processingCounts(importEvents(t, 2000))
+	assert.GreaterOrEqual(t, len(counts), 20)
+	for i := 1; i < len(counts); i++ {
+		assert.GreaterOrEqual(t, counts[i], counts[i-1])
+	}
+}
+
+func TestProgressThrottleSendsNothingAfterFinalState(t *testing.T) {
+	withProgressThrottle(t, 50*time.Millisecond, 101)
+
+	uploadService := service.NewUploadService(setupImportDB(t))
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
+
+	// Updates held back when the job finishes are superseded by its final
+	// state, so the flush scheduled for them broadcasts nothing
+	require.NoError(t, uploadService.ProcessFile(writeTestFile(t, "grades.csv", studentRows(250)), service.DefaultImportOptions()))
+	events, _ := drain(subscription)
+	require.NotEmpty(t, events)
+	assert.Equal(t, service.StatusCompleted, events[len(events)-1].Progress.Status)
+
+	time.Sleep(100 * time.Millisecond)
+	late, _ := drain(subscription)
+	assert.Empty(t, late)
+}
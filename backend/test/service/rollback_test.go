@@ -0,0 +1,41 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollbackLeavesEditedRowsAlone(t *testing.T) {
+	db := setupImportDB(t)
+	uploadService := service.NewUploadService(db)
+	studentService := service.NewStudentService(db)
+
+	_, err := studentService.CreateStudent(model.Student{StudentID: "S1", StudentName: "Alice", Subject: "Math", Grade: 70}, "")
+	require.NoError(t, err)
+
+	opts := service.DefaultImportOptions()
+	opts.OnConflict = service.ConflictUpdate
+	path := writeTestFile(t, "grades.csv", "student_id,student_name,subject,grade\nS1,Alice,Math,80\nS2,Bob,Science,85\nS3,Carol,Art,75\n")
+	require.NoError(t, uploadService.ProcessFile(path, opts))
+	jobID := uploadService.GetFileProgress("grades.csv").JobID
+
+	grade := 99
+	_, err = studentService.UpdateStudent("S2", service.StudentChanges{Grade: &grade}, false)
+	require.NoError(t, err)
+	assert.Empty(t, findStudent(t, db, "S2").ImportJobID, "an API edit clears the import stamp")
+
+	summary, err := uploadService.RollbackJob(jobID, service.RollbackRestore, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), summary.Deleted)
+	assert.Equal(t, int64(1), summary.Restored)
+
+	assert.Equal(t, 70, findStudent(t, db, "S1").Grade, "overwritten row is restored")
+	assert.Equal(t, 99, findStudent(t, db, "S2").Grade, "edited row keeps the edit")
+	var count int64
+	db.Model(&model.Student{}).Where("student_id = ?", "S3").Count(&count)
+	assert.Equal(t, int64(0), count, "untouched inserted row is removed")
+}
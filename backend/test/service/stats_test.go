@@ -0,0 +1,108 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func seedSubjectGrades(t *testing.T, db *gorm.DB, grades map[string][]int) {
+	for subject, list := range grades {
+		for i, grade := range list {
+			student := model.Student{StudentID: subject + string(rune('A'+i)), StudentName: "Student", Subject: subject, Grade: grade}
+			require.NoError(t, db.Create(&student).Error)
+		}
+	}
+}
+
+func TestGradeStats(t *testing.T) {
+	db := setupTestDB()
+	seedSubjectGrades(t, db, map[string][]int{"Math": {61, 90, 95}, "Art": {80}})
+	studentService := service.NewStudentService(db)
+
+	report, err := studentService.GradeStats(service.StudentFilter{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 10, report.BandWidth)
+
+	assert.Equal(t, int64(4), report.Overall.Count)
+	require.NotNil(t, report.Overall.Mean)
+	assert.InDelta(t, 81.5, *report.Overall.Mean, 1e-9)
+	assert.Equal(t, 61, *report.Overall.Min)
+	assert.Equal(t, 95, *report.Overall.Max)
+	// The 70s hold no grade, so they are not listed
+	assert.Equal(t, []service.GradeBand{{From: 60, To: 69, Count: 1}, {From: 80, To: 89, Count: 1}, {From: 90, To: 99, Count: 2}}, report.Overall.Histogram)
+
+	require.Len(t, report.Subjects, 2)
+	assert.Equal(t, "Art", report.Subjects[0].Subject)
+	assert.Equal(t, int64(1), report.Subjects[0].Count)
+	assert.Equal(t, []service.GradeBand{{From: 80, To: 89, Count: 1}}, report.Subjects[0].Histogram)
+	assert.Equal(t, "Math", report.Subjects[1].Subject)
+	assert.Equal(t, int64(3), report.Subjects[1].Count)
+	assert.Equal(t, []service.GradeBand{{From: 60, To: 69, Count: 1}, {From: 90, To: 99, Count: 2}}, report.Subjects[1].Histogram)
+}
+
+func TestGradeStatsFiltered(t *testing.T) {
+	db := setupTestDB()
+	seedSubjectGrades(t, db, map[string][]int{"Math": {61, 90, 95}, "Art": {80}})
+	studentService := service.NewStudentService(db)
+
+	report, err := studentService.GradeStats(service.StudentFilter{GradeGTE: intPtr(85)}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), report.Overall.Count)
+	assert.Equal(t, []service.GradeBand{{From: 90, To: 94, Count: 1}, {From: 95, To: 99, Count: 1}}, report.Overall.Histogram)
+	require.Len(t, report.Subjects, 1)
+	assert.Equal(t, "Math", report.Subjects[0].Subject)
+}
+
+func TestGradeStatsEmpty(t *testing.T) {
+	studentService := service.NewStudentService(setupTestDB())
+
+	report, err := studentService.GradeStats(service.StudentFilter{}, service.DefaultBandWidth)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), report.Overall.Count)
+	assert.Nil(t, report.Overall.Mean)
+	assert.Nil(t, report.Overall.Min)
+	assert.Nil(t, report.Overall.Max)
+	assert.NotNil(t, report.Overall.Histogram)
+	assert.Empty(t, report.Overall.Histogram)
+	assert.NotNil(t, report.Subjects)
+	assert.Empty(t, report.Subjects)
+}
+
+func TestGradeStatsHugeGrades(t *testing.T) {
+	db := setupTestDB()
+	seedSubjectGrades(t, db, map[string][]int{"Math": {0, 2_000_000_000}, "Art": {math.MaxInt, -5}})
+	studentService := service.NewStudentService(db)
+
+	// Listing every band up to the largest grade would be billions of bands
+	report, err := studentService.GradeStats(service.StudentFilter{}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []service.GradeBand{
+		{From: -5, To: -5, Count: 1},
+		{From: 0, To: 0, Count: 1},
+		{From: 2_000_000_000, To: 2_000_000_000, Count: 1},
+		{From: math.MaxInt, To: math.MaxInt, Count: 1},
+	}, report.Overall.Histogram)
+
+	// Band bounds are exact for huge grades and saturate at the int range
+	report, err = studentService.GradeStats(service.StudentFilter{Subjects: []string{"Art"}}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []service.GradeBand{
+		{From: -10, To: -1, Count: 1},
+		{From: math.MaxInt / 10 * 10, To: math.MaxInt, Count: 1},
+	}, report.Overall.Histogram)
+}
+
+func TestGradeStatsRejectsBandWidth(t *testing.T) {
+	studentService := service.NewStudentService(setupTestDB())
+
+	_, err := studentService.GradeStats(service.StudentFilter{}, 0)
+	var verr *service.ValidationError
+	assert.True(t, errors.As(err, &verr), "got %v", err)
+}
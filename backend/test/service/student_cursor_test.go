@@ -0,0 +1,142 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// seedGrades stores n students S01..Sn with grades that repeat, so sorting by
+// grade needs the student ID tie-breaker
+func seedGrades(t *testing.T, db *gorm.DB, n int) {
+	for i := 1; i <= n; i++ {
+		student := model.Student{StudentID: fmt.Sprintf("S%02d", i), StudentName: fmt.Sprintf("Name %02d", n+1-i), Subject: "Math", Grade: 50 + i%5}
+		require.NoError(t, db.Create(&student).Error)
+	}
+}
+
+// walkCursor follows the cursor from the first page to the last and returns
+// the student IDs in the order they were listed
+func walkCursor(t *testing.T, studentService *service.StudentService, q service.StudentQuery) []string {
+	var ids []string
+	q.UseCursor = true
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 100, "cursor does not advance")
+		page, err := studentService.ListStudents(q)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Students), q.Limit)
+		for _, student := range page.Students {
+			ids = append(ids, student.StudentID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func TestListStudentsCursorMatchesOffsetOrder(t *testing.T) {
+	db := setupTestDB()
+	seedGrades(t, db, 23)
+	studentService := service.NewStudentService(db)
+
+	for _, spec := range []string{"", "grade:desc", "grade:asc,student_name:desc", "subject,student_id:desc"} {
+		t.Run(spec, func(t *testing.T) {
+			sort, err := service.ParseSortSpec(spec)
+			require.NoError(t, err)
+
+			all, err := studentService.ListStudents(service.StudentQuery{Page: 1, Limit: 100, Sort: sort})
+			require.NoError(t, err)
+			var want []string
+			for _, student := range all.Students {
+				want = append(want, student.StudentID)
+			}
+
+			assert.Equal(t, want, walkCursor(t, studentService, service.StudentQuery{Limit: 5, Sort: sort, Count: service.CountNone}))
+		})
+	}
+}
+
+func TestListStudentsCursorIsStableAcrossInserts(t *testing.T) {
+	db := setupTestDB()
+	seedGrades(t, db, 10)
+	studentService := service.NewStudentService(db)
+	q := service.StudentQuery{Limit: 4, Sort: []service.SortField{{Column: "student_id"}}, UseCursor: true, Count: service.CountNone}
+
+	first, err := studentService.ListStudents(q)
+	require.NoError(t, err)
+	require.Len(t, first.Students, 4)
+	assert.Equal(t, "S04", first.Students[3].StudentID)
+
+	// A row inserted before the cursor does not shift the next page, and one
+	// inserted after it is picked up
+	require.NoError(t, db.Create(&model.Student{StudentID: "S00", StudentName: "Early", Subject: "Math", Grade: 1}).Error)
+	require.NoError(t, db.Create(&model.Student{StudentID: "S045", StudentName: "Late", Subject: "Math", Grade: 1}).Error)
+	// Deleting the row the cursor points at does not lose the place either
+	require.NoError(t, db.Delete(&model.Student{StudentID: "S04"}).Error)
+
+	q.Cursor = first.NextCursor
+	second, err := studentService.ListStudents(q)
+	require.NoError(t, err)
+	var ids []string
+	for _, student := range second.Students {
+		ids = append(ids, student.StudentID)
+	}
+	assert.Equal(t, []string{"S045", "S05", "S06", "S07"}, ids)
+}
+
+func TestListStudentsCursorCombinesWithFilters(t *testing.T) {
+	db := setupTestDB()
+	seedGrades(t, db, 30)
+	studentService := service.NewStudentService(db)
+
+	filter := service.StudentFilter{GradeGTE: intPtr(52), StudentIDPrefix: "S1"}
+	ids := walkCursor(t, studentService, service.StudentQuery{Limit: 2, Filter: filter, Sort: []service.SortField{{Column: "grade", Desc: true}}})
+
+	// S10..S19 with grade 50 + i%5 >= 52, highest grade first and by ID within a grade
+	assert.Equal(t, []string{"S14", "S19", "S13", "S18", "S12", "S17"}, ids)
+}
+
+func TestListStudentsRejectsForeignCursors(t *testing.T) {
+	db := setupTestDB()
+	seedGrades(t, db, 5)
+	studentService := service.NewStudentService(db)
+
+	byGrade := []service.SortField{{Column: "grade"}}
+	page, err := studentService.ListStudents(service.StudentQuery{Limit: 2, Sort: byGrade, UseCursor: true})
+	require.NoError(t, err)
+	require.NotEmpty(t, page.NextCursor)
+
+	for name, q := range map[string]service.StudentQuery{
+		"different sort": {Limit: 2, Sort: []service.SortField{{Column: "student_name"}}, UseCursor: true, Cursor: page.NextCursor},
+		"malformed":      {Limit: 2, Sort: byGrade, UseCursor: true, Cursor: "not-a-cursor"},
+		"wrong types":    {Limit: 2, Sort: byGrade, UseCursor: true, Cursor: "eyJzIjoiZ3JhZGU6YXNjLHN0dWRlbnRfaWQ6YXNjIiwidiI6WyJoaWdoIiwiUzAxIl19"},
+	} {
+		_, err := studentService.ListStudents(q)
+		var verr *service.ValidationError
+		assert.True(t, errors.As(err, &verr), "%s: got %v", name, err)
+	}
+}
+
+func TestListStudentsCountModes(t *testing.T) {
+	db := setupTestDB()
+	seedGrades(t, db, 7)
+	studentService := service.NewStudentService(db)
+
+	page, err := studentService.ListStudents(service.StudentQuery{Limit: 3, UseCursor: true, Count: service.CountNone})
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), page.Total)
+
+	// SQLite has no planner estimate, so estimated falls back to an exact count
+	page, err = studentService.ListStudents(service.StudentQuery{Limit: 3, UseCursor: true, Count: service.CountEstimated})
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), page.Total)
+	assert.False(t, page.TotalEstimated)
+	assert.Equal(t, 3, page.TotalPages)
+}
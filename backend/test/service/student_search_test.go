@@ -0,0 +1,108 @@
+package service
+
+import (
+	"backend/internal/database"
+	"backend/internal/model"
+	"backend/internal/service"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// searchNames lists the students matching search in the default (relevance) order
+func searchNames(t *testing.T, studentService *service.StudentService, search string) ([]string, string) {
+	page, err := studentService.ListStudents(service.StudentQuery{Page: 1, Limit: 100, Filter: service.StudentFilter{Search: search}})
+	require.NoError(t, err)
+	var names []string
+	for _, student := range page.Students {
+		names = append(names, student.StudentName)
+	}
+	return names, page.SearchMode
+}
+
+func seedNames(t *testing.T, db *gorm.DB, names ...string) {
+	for i, name := range names {
+		student := model.Student{StudentID: "SEARCH-" + string(rune('A'+i)), StudentName: name, Subject: "Math", Grade: 80}
+		require.NoError(t, db.Create(&student).Error)
+	}
+}
+
+func TestSearchFallsBackToSubstring(t *testing.T) {
+	db := setupTestDB()
+	seedNames(t, db, "Bob Malice", "alicia", "Alice Smith", "100% Pure", "Under_score", "Carol")
+	studentService := service.NewStudentService(db)
+
+	tests := []struct {
+		search string
+		names  []string
+	}{
+		// Case-insensitive, and names containing the search earlier rank higher
+		{"ALIC", []string{"Alice Smith", "alicia", "Bob Malice"}},
+		{"smith", []string{"Alice Smith"}},
+		// LIKE wildcards in the search are literal
+		{"%", []string{"100% Pure"}},
+		{"_", []string{"Under_score"}},
+		// Without pg_trgm there is no typo tolerance
+		{"Alise", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.search, func(t *testing.T) {
+			names, mode := searchNames(t, studentService, tt.search)
+			assert.Equal(t, "substring", mode)
+			assert.Equal(t, tt.names, names)
+		})
+	}
+}
+
+func TestSearchRelevanceSortNeedsSearch(t *testing.T) {
+	studentService := service.NewStudentService(setupTestDB())
+	relevance := []service.SortField{{Column: "relevance", Desc: true}}
+
+	_, err := studentService.ListStudents(service.StudentQuery{Page: 1, Limit: 10, Sort: relevance})
+	var verr *service.ValidationError
+	assert.True(t, errors.As(err, &verr), "got %v", err)
+
+	// Keyset cursors cannot encode a relevance score
+	_, err = studentService.ListStudents(service.StudentQuery{Limit: 10, Sort: relevance, UseCursor: true, Filter: service.StudentFilter{Search: "a"}})
+	assert.True(t, errors.As(err, &verr), "got %v", err)
+}
+
+// TestSearchFuzzyOnPostgres runs against the PostgreSQL database named by
+// TEST_DATABASE_DSN, since pg_trgm cannot be emulated on SQLite. The students
+// table is emptied.
+func TestSearchFuzzyOnPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.Student{}))
+	require.NoError(t, database.MigrateSearch(db))
+	require.True(t, database.SearchAvailable(db))
+
+	require.NoError(t, db.Exec("TRUNCATE TABLE students").Error)
+	t.Cleanup(func() { db.Exec("TRUNCATE TABLE students") })
+	seedNames(t, db, "Alice Smith", "Alicia Keys", "Bob Malice", "Carol Jones", "Jonathan Williams", "100% Pure")
+	studentService := service.NewStudentService(db)
+
+	names, mode := searchNames(t, studentService, "alice")
+	assert.Equal(t, "fuzzy", mode)
+	require.NotEmpty(t, names)
+	assert.Equal(t, "Alice Smith", names[0], "an exact word match ranks first")
+	assert.Contains(t, names, "Bob Malice", "substrings still match")
+	assert.NotContains(t, names, "Carol Jones")
+
+	// A letter missing from a word is tolerated
+	names, _ = searchNames(t, studentService, "Wiliams")
+	assert.Equal(t, []string{"Jonathan Williams"}, names)
+
+	names, _ = searchNames(t, studentService, "%")
+	assert.Equal(t, []string{"100% Pure"}, names)
+}
@@ -1,71 +1,172 @@
 package service
 
 import (
+	"backend/internal/handler"
 	"backend/internal/model"
 	"backend/internal/service"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
+	"encoding/json"
+	"errors"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 )
 
-func setupTestDB() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect to database")
+func TestListStudents(t *testing.T) {
+	db := setupTestDB()
+	studentService := service.NewStudentService(db)
+	seedStudents(db)
+
+	byName := []service.SortField{{Column: "student_name"}}
+	tests := []struct {
+		name          string
+		query         service.StudentQuery
+		expectedLen   int
+		expectedTotal int64
+	}{
+		{"All students", service.StudentQuery{Page: 1, Limit: 10, Sort: byName}, 3, 3},
+		{"Filter by name", service.StudentQuery{Page: 1, Limit: 10, Sort: byName, Filter: service.StudentFilter{StudentName: "john"}}, 1, 1},
+		{"Filter by subject", service.StudentQuery{Page: 1, Limit: 10, Sort: byName, Filter: service.StudentFilter{Subjects: []string{"Math"}}}, 2, 2},
+		{"Filter by grade range", service.StudentQuery{Page: 1, Limit: 10, Sort: byName, Filter: service.StudentFilter{GradeGTE: intPtr(85), GradeLTE: intPtr(90)}}, 2, 2},
+		{"Pagination", service.StudentQuery{Page: 1, Limit: 2, Sort: byName}, 2, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := studentService.ListStudents(tt.query)
+			if err != nil {
+				t.Fatalf("ListStudents() error = %v", err)
+			}
+			if len(page.Students) != tt.expectedLen {
+				t.Errorf("ListStudents() got = %v, want %v", len(page.Students), tt.expectedLen)
+			}
+			if page.Total != tt.expectedTotal {
+				t.Errorf("ListStudents() Total = %v, want %v", page.Total, tt.expectedTotal)
+			}
+			if page.TotalPages != int(math.Ceil(float64(tt.expectedTotal)/float64(tt.query.Limit))) {
+				t.Errorf("ListStudents() TotalPages = %v, want %v", page.TotalPages, int(math.Ceil(float64(tt.expectedTotal)/float64(tt.query.Limit))))
+			}
+		})
 	}
-	db.AutoMigrate(&model.Student{})
-	return db
 }
 
-func TestListStudents(t *testing.T) {
+func TestListStudentsSortOrder(t *testing.T) {
 	db := setupTestDB()
 	studentService := service.NewStudentService(db)
+	seedStudents(db)
+
+	sort, err := service.ParseSortSpec("subject:asc, grade:desc")
+	if err != nil {
+		t.Fatalf("ParseSortSpec() error = %v", err)
+	}
+	page, err := studentService.ListStudents(service.StudentQuery{Page: 1, Limit: 10, Sort: sort})
+	if err != nil {
+		t.Fatalf("ListStudents() error = %v", err)
+	}
+
+	var ids []string
+	for _, student := range page.Students {
+		ids = append(ids, student.StudentID)
+	}
+	if want := []string{"S3", "S1", "S2"}; len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] || ids[2] != want[2] {
+		t.Errorf("ListStudents() order = %v, want %v", ids, want)
+	}
+}
+
+func TestSortWhitelist(t *testing.T) {
+	valid := []string{"grade", "grade:desc,student_name:asc", "Student_ID:DESC", "subject , grade"}
+	for _, spec := range valid {
+		if _, err := service.ParseSortSpec(spec); err != nil {
+			t.Errorf("ParseSortSpec(%q) error = %v", spec, err)
+		}
+	}
+
+	invalid := []string{
+		"password",
+		"created_at",
+		"grade; DROP TABLE students",
+		"(SELECT 1)",
+		"grade:sideways",
+		"grade,grade:desc",
+	}
+	for _, spec := range invalid {
+		_, err := service.ParseSortSpec(spec)
+		var verr *service.ValidationError
+		if !errors.As(err, &verr) {
+			t.Errorf("ParseSortSpec(%q) error = %v, want a ValidationError", spec, err)
+		}
+	}
 
-	// Insert test data
-	students := []model.Student{
-		{StudentName: "John Doe", Subject: "Math", Grade: 90},
-		{StudentName: "Jane Doe", Subject: "Science", Grade: 85},
-		{StudentName: "Alice", Subject: "Math", Grade: 95},
+	var verr *service.ValidationError
+	if _, err := service.LegacySort("student_name desc", "asc"); !errors.As(err, &verr) {
+		t.Errorf("LegacySort() error = %v, want a ValidationError", err)
 	}
-	for _, student := range students {
-		db.Create(&student)
+
+	// Sort fields that bypass parsing are checked again before reaching SQL
+	studentService := service.NewStudentService(setupTestDB())
+	_, err := studentService.ListStudents(service.StudentQuery{Page: 1, Limit: 10, Sort: []service.SortField{{Column: "1; DROP TABLE students"}}})
+	if !errors.As(err, &verr) {
+		t.Errorf("ListStudents() error = %v, want a ValidationError", err)
 	}
+}
+
+func TestListStudentsRejectsUnknownSortColumn(t *testing.T) {
+	db := setupTestDB()
+	seedStudents(db)
+	studentHandler := handler.NewStudentHandler(service.NewStudentService(db))
 
 	tests := []struct {
-		name        string
-		page        int
-		limit       int
-		sortBy      string
-		sortOrder   string
-		studentName string
-		subject     string
-		gradeMin    int
-		gradeMax    int
-		expectedLen int
+		name           string
+		query          string
+		expectedStatus int
 	}{
-		{"All students", 1, 10, "student_name", "asc", "", "", 0, 0, 3},
-		{"Filter by name", 1, 10, "student_name", "asc", "John", "", 0, 0, 1},
-		{"Filter by subject", 1, 10, "student_name", "asc", "", "Math", 0, 0, 2},
-		{"Filter by grade range", 1, 10, "student_name", "asc", "", "", 85, 90, 2},
-		{"Pagination", 1, 2, "student_name", "asc", "", "", 0, 0, 2},
+		{"Known sort_by", "sort_by=grade&sort_order=desc", http.StatusOK},
+		{"Unknown sort_by", "sort_by=password", http.StatusBadRequest},
+		{"Injected sort_by", "sort_by=grade%3B%20DROP%20TABLE%20students", http.StatusBadRequest},
+		{"Invalid sort_order", "sort_by=grade&sort_order=sideways", http.StatusBadRequest},
+		{"Unknown sort column", "sort=grade:desc,password", http.StatusBadRequest},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			students, totalCount, totalPages, err := studentService.ListStudents(tt.page, tt.limit, tt.sortBy, tt.sortOrder, tt.studentName, tt.subject, tt.gradeMin, tt.gradeMax)
-			if err != nil {
-				t.Fatalf("ListStudents() error = %v", err)
+			rr := httptest.NewRecorder()
+			studentHandler.ListStudents(rr, httptest.NewRequest("GET", "/students?"+tt.query, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("ListStudents() status = %v, want %v: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+			if tt.expectedStatus != http.StatusBadRequest {
+				return
 			}
-			if len(students) != tt.expectedLen {
-				t.Errorf("ListStudents() got = %v, want %v", len(students), tt.expectedLen)
+			var response struct {
+				Error   string               `json:"error"`
+				Details []service.FieldError `json:"details"`
 			}
-			if totalCount != int64(len(students)) {
-				t.Errorf("ListStudents() totalCount = %v, want %v", totalCount, len(students))
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
 			}
-			if totalPages != int(math.Ceil(float64(totalCount)/float64(tt.limit))) {
-				t.Errorf("ListStudents() totalPages = %v, want %v", totalPages, int(math.Ceil(float64(totalCount)/float64(tt.limit))))
+			if response.Error != "invalid request" || len(response.Details) == 0 {
+				t.Errorf("ListStudents() body = %+v, want an invalid request with details", response)
 			}
 		})
 	}
+
+	var count int64
+	db.Model(&model.Student{}).Count(&count)
+	if count != 3 {
+		t.Errorf("students count = %v, want 3", count)
+	}
+}
+
+func TestParseGradeMatchesImport(t *testing.T) {
+	for value, valid := range map[string]bool{"95": true, "-3": true, "0": true, " 95": false, "95 ": false, "9.5": false, "": false, "high": false} {
+		_, err := service.ParseGrade(value)
+		if valid && err != nil {
+			t.Errorf("ParseGrade(%q) failed: %v", value, err)
+		}
+		if !valid && (err == nil || err.Error() != "invalid grade "+strconv.Quote(value)) {
+			t.Errorf("ParseGrade(%q) = %v, want the import row error", value, err)
+		}
+	}
 }
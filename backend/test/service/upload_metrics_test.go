@@ -0,0 +1,53 @@
+package service
+
+import (
+	"backend/internal/service"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gauge reads the collector of uploadService whose metric is called name
+func gauge(t *testing.T, uploadService *service.UploadService, name string) float64 {
+	t.Helper()
+	for _, collector := range uploadService.MetricsCollectors() {
+		descs := make(chan *prometheus.Desc, 1)
+		collector.Describe(descs)
+		if strings.Contains((<-descs).String(), `"student_import_`+name+`"`) {
+			return testutil.ToFloat64(collector)
+		}
+	}
+	t.Fatalf("no metric %s", name)
+	return 0
+}
+
+func TestProgressSubscribersExcludeWebhookSender(t *testing.T) {
+	db := setupWebhookDB(t)
+	uploadService := service.NewUploadService(db)
+	go service.NewWebhookService(db).Watch(uploadService)
+	require.Eventually(t, func() bool { return uploadService.ProgressBusStats().Watchers == 1 }, time.Second, time.Millisecond)
+
+	assert.Equal(t, 0.0, gauge(t, uploadService, "progress_subscribers"))
+	subscription := uploadService.SubscribeProgress()
+	assert.Equal(t, 1.0, gauge(t, uploadService, "progress_subscribers"))
+	subscription.Close()
+	assert.Equal(t, 0.0, gauge(t, uploadService, "progress_subscribers"))
+}
+
+func TestQueueDepthCountsQueuedJobs(t *testing.T) {
+	uploadService := service.NewUploadService(setupImportDB(t))
+
+	uploadService.CreateJob("first.csv", "", "")
+	uploadService.CreateUploadingJob("second.csv", "")
+	assert.Equal(t, 1.0, gauge(t, uploadService, "queue_depth"), "uploading jobs are not queued yet")
+
+	path := writeTestFile(t, "third.csv", "student_id,student_name,subject,grade\nS001,Alice,Math,95\n")
+	require.NoError(t, uploadService.ProcessFile(path, service.DefaultImportOptions()))
+	assert.Equal(t, 1.0, gauge(t, uploadService, "queue_depth"))
+	assert.Equal(t, 0.0, gauge(t, uploadService, "active_jobs"))
+}
@@ -1,124 +1,90 @@
-package service_test
+package service
 
 import (
-	//"backend/internal/handler"
 	"backend/internal/model"
 	"backend/internal/service"
-	//"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
+	"github.com/stretchr/testify/require"
 )
 
-func setupTestDB() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
+// nextEvent waits for the next progress event queued for subscription
+func nextEvent(t *testing.T, subscription *service.ProgressSubscription) service.ProgressEvent {
+	t.Helper()
+	select {
+	case <-subscription.C:
+		events, ok := subscription.Next()
+		require.True(t, ok)
+		require.NotEmpty(t, events)
+		return events[len(events)-1]
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Timeout waiting for progress broadcast")
 	}
-	db.AutoMigrate(&model.Student{})
-	return db
+	return service.ProgressEvent{}
 }
 
 func TestNewUploadService(t *testing.T) {
-	db := setupTestDB()
-	service := service.NewUploadService(db)
+	uploadService := service.NewUploadService(setupTestDB())
 
-	assert.NotNil(t, service)
-	assert.Equal(t, db, service.db)
-	assert.NotNil(t, service.fileProgressMap)
-	assert.NotNil(t, service.progressListeners)
+	assert.NotNil(t, uploadService)
+	assert.Empty(t, uploadService.GetAllFileProgress())
+	assert.Equal(t, service.ProgressBusStats{}, uploadService.ProgressBusStats())
 }
 
-func TestRegisterAndUnregisterProgressListener(t *testing.T) {
-	db := setupTestDB()
-	service := service.NewUploadService(db)
-
-	ch := make(chan *ProgressInfo)
-
-	// Register
-	service.RegisterProgressListener(ch)
+func TestSubscribeAndCloseProgress(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB())
 
-	service.listenerLock.RLock()
-	assert.True(t, service.progressListeners[ch])
-	service.listenerLock.RUnlock()
+	// Subscribe
+	subscription := uploadService.SubscribeProgress()
+	assert.Equal(t, 1, uploadService.ProgressBusStats().Subscribers)
 
-	// Unregister
-	service.UnregisterProgressListener(ch)
-
-	service.listenerLock.RLock()
-	assert.False(t, service.progressListeners[ch])
-	service.listenerLock.RUnlock()
+	// Close
+	subscription.Close()
+	assert.Equal(t, 0, uploadService.ProgressBusStats().Subscribers)
 }
 
 func TestBroadcastProgress(t *testing.T) {
-	db := setupTestDB()
-	service := service.NewUploadService(db)
+	uploadService := service.NewUploadService(setupTestDB())
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
 
-	ch := make(chan *ProgressInfo, 1) // Buffer of 1 to prevent blocking
-	service.RegisterProgressListener(ch)
-
-	progress := &ProgressInfo{
-		FileName: "test.csv",
-		Status:   "processing",
-	}
+	jobID := uploadService.CreateJob("test.csv", "", "")
 
-	service.BroadcastProgress(progress)
-
-	select {
-	case received := <-ch:
-		assert.Equal(t, progress, received)
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("Timeout waiting for progress broadcast")
-	}
+	received := nextEvent(t, subscription)
+	assert.Equal(t, jobID, received.Progress.JobID)
+	assert.Equal(t, "test.csv", received.Progress.FileName)
+	assert.Equal(t, service.StatusQueued, received.Progress.Status)
 }
 
 func TestGetFileProgress(t *testing.T) {
-	db := setupTestDB()
-	service := NewUploadService(db)
+	uploadService := service.NewUploadService(setupTestDB())
 
 	// Add a test progress
 	fileName := "test.csv"
-	progress := &ProgressInfo{
-		FileName: fileName,
-		Status:   "processing",
-	}
-
-	service.fileProgressLock.Lock()
-	service.fileProgressMap[fileName] = progress
-	service.fileProgressLock.Unlock()
+	uploadService.CreateJob(fileName, "", "")
 
 	// Test getting existing progress
-	result := service.GetFileProgress(fileName)
+	result := uploadService.GetFileProgress(fileName)
 	assert.NotNil(t, result)
 	assert.Equal(t, fileName, result.FileName)
-	assert.Equal(t, "processing", result.Status)
+	assert.Equal(t, service.StatusQueued, result.Status)
 
 	// Test getting non-existent progress
-	result = service.GetFileProgress("nonexistent.csv")
+	result = uploadService.GetFileProgress("nonexistent.csv")
 	assert.Nil(t, result)
 }
 
 func TestGetAllFileProgress(t *testing.T) {
-	db := setupTestDB()
-	service := NewUploadService(db)
+	uploadService := service.NewUploadService(setupTestDB())
 
 	// Add test progress entries
-	progress1 := &ProgressInfo{FileName: "file1.csv", Status: "processing"}
-	progress2 := &ProgressInfo{FileName: "file2.csv", Status: "completed"}
-
-	service.fileProgressLock.Lock()
-	service.fileProgressMap["file1.csv"] = progress1
-	service.fileProgressMap["file2.csv"] = progress2
-	service.fileProgressLock.Unlock()
+	uploadService.CreateJob("file1.csv", "", "")
+	require.NoError(t, uploadService.CancelJob(uploadService.CreateJob("file2.csv", "", "")))
 
 	// Get all progress
-	results := service.GetAllFileProgress()
+	results := uploadService.GetAllFileProgress()
 
 	assert.Equal(t, 2, len(results))
 
@@ -129,11 +95,11 @@ func TestGetAllFileProgress(t *testing.T) {
 	for _, p := range results {
 		if p.FileName == "file1.csv" {
 			foundFile1 = true
-			assert.Equal(t, "processing", p.Status)
+			assert.Equal(t, service.StatusQueued, p.Status)
 		}
 		if p.FileName == "file2.csv" {
 			foundFile2 = true
-			assert.Equal(t, "completed", p.Status)
+			assert.Equal(t, service.StatusCancelled, p.Status)
 		}
 	}
 
@@ -142,113 +108,74 @@ func TestGetAllFileProgress(t *testing.T) {
 }
 
 func TestUpdateProgress(t *testing.T) {
-	db := setupTestDB()
-	service := NewUploadService(db)
-	ch := make(chan *ProgressInfo, 1)
-	service.RegisterProgressListener(ch)
+	uploadService := service.NewUploadService(setupTestDB())
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
 
-	// Set up initial progress
 	fileName := "test.csv"
-	initialProgress := &ProgressInfo{
-		FileName:  fileName,
-		Processed: 10,
-	}
-
-	service.fileProgressLock.Lock()
-	service.fileProgressMap[fileName] = initialProgress
-	service.fileProgressLock.Unlock()
-
-	// Update progress
-	service.updateProgress(fileName, 5)
-
-	// Check updated value
-	progress := service.GetFileProgress(fileName)
-	assert.Equal(t, 15, progress.Processed)
-
-	// Check broadcast
-	select {
-	case received := <-ch:
-		assert.Equal(t, fileName, received.FileName)
-		assert.Equal(t, 15, received.Processed)
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("Timeout waiting for progress broadcast")
-	}
+	tempFile := writeTestFile(t, fileName, "StudentID,StudentName,Subject,Grade\nS001,Alice,Math,95\nS002,Bob,Science,high\n")
+	require.NoError(t, uploadService.ProcessCSV(tempFile))
+
+	// Check updated value: rejected rows count as processed
+	progress := uploadService.GetFileProgress(fileName)
+	assert.Equal(t, 2, progress.Processed)
+	assert.Equal(t, 1, progress.Rejected)
+
+	// Check broadcast of the final state
+	received := nextEvent(t, subscription)
+	assert.Equal(t, fileName, received.Progress.FileName)
+	assert.Equal(t, service.StatusCompleted, received.Progress.Status)
+	assert.Equal(t, 2, received.Progress.Processed)
 }
 
 func TestUpdateProgressError(t *testing.T) {
-	db := setupTestDB()
-	service := NewUploadService(db)
-	ch := make(chan *ProgressInfo, 1)
-	service.RegisterProgressListener(ch)
+	uploadService := service.NewUploadService(setupTestDB())
+	subscription := uploadService.SubscribeProgress()
+	defer subscription.Close()
 
 	// Set up initial progress
 	fileName := "test.csv"
-	initialProgress := &ProgressInfo{
-		FileName: fileName,
-		Status:   "processing",
-	}
-
-	service.fileProgressLock.Lock()
-	service.fileProgressMap[fileName] = initialProgress
-	service.fileProgressLock.Unlock()
+	jobID := uploadService.CreateUploadingJob(fileName, "")
+	nextEvent(t, subscription)
 
 	// Update progress with error
 	errorMsg := "test error"
-	service.updateProgressError(fileName, errorMsg)
+	uploadService.FailJob(jobID, errorMsg)
 
 	// Check updated values
-	progress := service.GetFileProgress(fileName)
-	assert.Equal(t, "error", progress.Status)
+	progress := uploadService.GetFileProgress(fileName)
+	assert.Equal(t, service.StatusError, progress.Status)
 	assert.Equal(t, errorMsg, progress.Error)
 	assert.False(t, progress.EndTime.IsZero())
 
 	// Check broadcast
-	select {
-	case received := <-ch:
-		assert.Equal(t, fileName, received.FileName)
-		assert.Equal(t, "error", received.Status)
-		assert.Equal(t, errorMsg, received.Error)
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("Timeout waiting for progress broadcast")
-	}
+	received := nextEvent(t, subscription)
+	assert.Equal(t, fileName, received.Progress.FileName)
+	assert.Equal(t, service.StatusError, received.Progress.Status)
+	assert.Equal(t, errorMsg, received.Progress.Error)
 }
 
 func TestCountRecords(t *testing.T) {
-	db := setupTestDB()
-	service := NewUploadService(db)
+	uploadService := service.NewUploadService(setupTestDB())
 
-	// Create a temporary CSV file for testing
-	tempDir, err := ioutil.TempDir("", "test")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(tempDir)
-
-	tempFile := filepath.Join(tempDir, "test.csv")
-	content := "header1,header2,header3\nrow1a,row1b,row1c\nrow2a,row2b,row2c\nrow3a,row3b,row3c"
-	err = ioutil.WriteFile(tempFile, []byte(content), 0644)
-	if err != nil {
-		t.Fatalf("Failed to write test CSV: %v", err)
-	}
-
-	// Count records
-	count, err := service.countRecords(tempFile)
+	// The header is not a record
+	content := "header1,header2,header3,header4\nrow1a,row1b,row1c,1\nrow2a,row2b,row2c,2\nrow3a,row3b,row3c,3"
+	summary, err := uploadService.PreviewFile(writeTestFile(t, "test.csv", content), service.DefaultImportOptions(), 10)
 	assert.NoError(t, err)
-	assert.Equal(t, 3, count)
+	assert.Equal(t, 3, summary.TotalRecords)
 }
 
 func TestSaveBatch(t *testing.T) {
 	db := setupTestDB()
-	service := NewUploadService(db)
+	uploadService := service.NewUploadService(db)
 
-	// Create test data
-	students := []model.Student{
-		{StudentID: "S001", StudentName: "Alice", Subject: "Math", Grade: 95},
-		{StudentID: "S002", StudentName: "Bob", Subject: "Science", Grade: 87},
-	}
-
-	// Save batch
-	service.saveBatch(students)
+	// Save a batch that overwrites a stored student
+	db.Create(&model.Student{StudentID: "S001", StudentName: "Alice", Subject: "Math", Grade: 80})
+	opts := service.DefaultImportOptions()
+	opts.OnConflict = service.ConflictUpdate
+	content := "StudentID,StudentName,Subject,Grade\nS001,Alice,Math,95\nS002,Bob,Science,87\n"
+	require.NoError(t, uploadService.ProcessFile(writeTestFile(t, "batch.csv", content), opts))
+	jobID := uploadService.GetFileProgress("batch.csv").JobID
 
 	// Verify saved data
 	var count int64
@@ -260,42 +187,31 @@ func TestSaveBatch(t *testing.T) {
 	assert.Equal(t, "Alice", found.StudentName)
 	assert.Equal(t, "Math", found.Subject)
 	assert.Equal(t, 95, found.Grade)
+	assert.Equal(t, jobID, found.ImportJobID)
+
+	var backup model.ImportBackup
+	require.NoError(t, db.Where("job_id = ? AND student_id = ?", jobID, "S001").First(&backup).Error)
+	assert.Equal(t, 80, backup.Grade)
 }
 
 func TestProcessCSV(t *testing.T) {
 	db := setupTestDB()
-	service := NewUploadService(db)
-
-	// Create a temporary CSV file for testing
-	tempDir, err := ioutil.TempDir("", "test")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(tempDir)
+	uploadService := service.NewUploadService(db)
 
 	fileName := "test.csv"
-	tempFile := filepath.Join(tempDir, fileName)
 	content := "StudentID,StudentName,Subject,Grade\n" +
 		"S001,Alice,Math,95\n" +
 		"S002,Bob,Science,87\n" +
 		"S003,Charlie,History,92"
 
-	err = ioutil.WriteFile(tempFile, []byte(content), 0644)
-	if err != nil {
-		t.Fatalf("Failed to write test CSV: %v", err)
-	}
-
 	// Process the CSV
-	err = service.ProcessCSV(tempFile)
+	err := uploadService.ProcessCSV(writeTestFile(t, fileName, content))
 	assert.NoError(t, err)
 
-	// Wait for processing to complete
-	time.Sleep(500 * time.Millisecond)
-
 	// Check progress
-	progress := service.GetFileProgress(fileName)
+	progress := uploadService.GetFileProgress(fileName)
 	assert.NotNil(t, progress)
-	assert.Equal(t, "completed", progress.Status)
+	assert.Equal(t, service.StatusCompleted, progress.Status)
 	assert.Equal(t, 3, progress.TotalRecords)
 
 	// Check database
@@ -314,3 +230,26 @@ func TestProcessCSV(t *testing.T) {
 	assert.Equal(t, "Math", alice.Subject)
 	assert.Equal(t, 95, alice.Grade)
 }
+
+func TestUploadTimingStartsWhenRequestIsReceived(t *testing.T) {
+	uploadService := service.NewUploadService(setupTestDB())
+
+	// The request body took a second to arrive before the file was saved
+	receivedAt := time.Now().Add(-time.Second)
+	batchID := uploadService.CreateBatch(receivedAt)
+	jobID := uploadService.CreateUploadingJob("test.csv", batchID)
+	uploadService.JobUploaded(jobID)
+	uploadService.BatchUploaded(batchID)
+
+	progress := uploadService.GetJobProgress(jobID)
+	batch, err := uploadService.GetBatch(batchID)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, progress.Timings.Upload, time.Second)
+	assert.InDelta(t, batch.UploadSeconds, progress.Timings.Upload.Seconds(), 0.1, "job and batch measure the upload from the same point")
+
+	tempFile := writeTestFile(t, "test.csv", "StudentID,StudentName,Subject,Grade\nS001,Alice,Math,95\n")
+	require.NoError(t, uploadService.ProcessJob(jobID, tempFile, service.DefaultImportOptions()))
+	progress = uploadService.GetJobProgress(jobID)
+	assert.Less(t, progress.Timings.QueueWait, time.Second, "upload time is not counted as queue wait")
+	assert.GreaterOrEqual(t, progress.Timings.QueueWait, time.Duration(0))
+}
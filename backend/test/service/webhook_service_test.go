@@ -0,0 +1,191 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// webhookReceiver is a webhook endpoint that answers with statuses in turn,
+// then 200, and records what it received
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	statuses []int
+
+	lock     sync.Mutex
+	received []time.Time
+	payloads []service.WebhookPayload
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// This runs on the server's goroutine, where require must not be used
+	body, err := io.ReadAll(req.Body)
+	if !assert.NoError(r.t, err) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	timestamp := req.Header.Get(service.WebhookTimestampHeader)
+	signature := req.Header.Get(service.WebhookSignatureHeader)
+	assert.Equal(r.t, "sha256="+service.SignWebhook(r.secret, timestamp, body), signature)
+	assert.NotEqual(r.t, "sha256="+service.SignWebhook("wrong", timestamp, body), signature)
+
+	var payload service.WebhookPayload
+	if !assert.NoError(r.t, json.Unmarshal(body, &payload)) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	assert.Equal(r.t, payload.Event, req.Header.Get(service.WebhookEventHeader))
+	assert.Equal(r.t, payload.ID, req.Header.Get(service.WebhookDeliveryHeader))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.received = append(r.received, time.Now())
+	r.payloads = append(r.payloads, payload)
+	status := http.StatusOK
+	if len(r.received) <= len(r.statuses) {
+		status = r.statuses[len(r.received)-1]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) requests() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.received)
+}
+
+func deliveries(t *testing.T, db *gorm.DB) []model.WebhookDelivery {
+	var rows []model.WebhookDelivery
+	require.NoError(t, db.Order("id").Find(&rows).Error)
+	return rows
+}
+
+func TestWebhookRetriesServerErrorsWithBackoff(t *testing.T) {
+	db := setupWebhookDB(t)
+	receiver := &webhookReceiver{t: t, secret: "s3cret", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhookService := service.NewWebhookService(db)
+	webhookService.RetryDelays = []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, time.Second}
+	webhook, err := webhookService.CreateWebhook(server.URL, "s3cret", nil)
+	require.NoError(t, err)
+
+	progress := service.ProgressInfo{JobID: "job-1", FileName: "grades.csv", Status: service.StatusCompleted, TotalRecords: 3, Processed: 3}
+	webhookService.Notify(progress)
+	require.Eventually(t, func() bool { return len(deliveries(t, db)) == 3 }, 2*time.Second, 10*time.Millisecond)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+
+	// Backoff follows RetryDelays
+	assert.GreaterOrEqual(t, receiver.received[1].Sub(receiver.received[0]), 20*time.Millisecond)
+	assert.GreaterOrEqual(t, receiver.received[2].Sub(receiver.received[1]), 40*time.Millisecond)
+
+	rows := deliveries(t, db)
+	for i, row := range rows {
+		assert.Equal(t, webhook.ID, row.WebhookID)
+		assert.Equal(t, i+1, row.Attempt)
+		assert.Equal(t, rows[0].DeliveryID, row.DeliveryID, "retries keep the delivery ID")
+		assert.Equal(t, service.WebhookJobCompleted, row.Event)
+		assert.Equal(t, "job-1", row.JobID)
+	}
+	assert.Equal(t, []int{503, 502, 200}, []int{rows[0].StatusCode, rows[1].StatusCode, rows[2].StatusCode})
+	assert.Contains(t, rows[0].Error, "unexpected response status 503")
+	assert.Empty(t, rows[2].Error)
+
+	for _, payload := range receiver.payloads {
+		assert.Equal(t, rows[0].DeliveryID, payload.ID)
+		assert.Equal(t, "job-1", payload.Job.JobID)
+		assert.Equal(t, 3, payload.Job.Processed)
+	}
+}
+
+func TestWebhookSendsFinalStateOnce(t *testing.T) {
+	db := setupWebhookDB(t)
+	receiver := &webhookReceiver{t: t, secret: "s3cret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhookService := service.NewWebhookService(db)
+	_, err := webhookService.CreateWebhook(server.URL, "s3cret", nil)
+	require.NoError(t, err)
+
+	progress := service.ProgressInfo{JobID: "job-1", Status: service.StatusCancelled}
+	webhookService.Notify(progress)
+	webhookService.Notify(progress)
+	require.Eventually(t, func() bool { return receiver.requests() == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, receiver.requests())
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	db := setupWebhookDB(t)
+	receiver := &webhookReceiver{t: t, secret: "s3cret", statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhookService := service.NewWebhookService(db)
+	webhookService.RetryDelays = []time.Duration{10 * time.Millisecond}
+	_, err := webhookService.CreateWebhook(server.URL, "s3cret", []string{service.WebhookJobFailed})
+	require.NoError(t, err)
+
+	// Events the webhook did not ask for are not sent
+	webhookService.Notify(service.ProgressInfo{JobID: "job-1", Status: service.StatusCompleted})
+	webhookService.Notify(service.ProgressInfo{JobID: "job-2", Status: service.StatusError, Error: "bad file"})
+	require.Eventually(t, func() bool { return len(deliveries(t, db)) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	rows := deliveries(t, db)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "job-2", rows[0].JobID)
+	assert.Equal(t, http.StatusBadRequest, rows[0].StatusCode)
+	assert.Equal(t, 1, receiver.requests())
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	assert.Equal(t, "bad file", receiver.payloads[0].Job.Error)
+}
+
+func TestWebhookReportsFailedInsertsAsFailedJob(t *testing.T) {
+	db := setupWebhookDB(t)
+	// A students table the import cannot write to
+	require.NoError(t, db.Exec("DROP TABLE students").Error)
+	require.NoError(t, db.Exec("CREATE TABLE students (student_id TEXT PRIMARY KEY, grade INTEGER)").Error)
+
+	receiver := &webhookReceiver{t: t, secret: "s3cret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	uploadService := service.NewUploadService(db)
+	webhookService := service.NewWebhookService(db)
+	_, err := webhookService.CreateWebhook(server.URL, "s3cret", nil)
+	require.NoError(t, err)
+	go webhookService.Watch(uploadService)
+	require.Eventually(t, func() bool { return uploadService.ProgressBusStats().Watchers == 1 }, time.Second, time.Millisecond)
+
+	path := writeTestFile(t, "grades.csv", "student_id,student_name,subject,grade\nS001,Alice,Math,95\n")
+	err = uploadService.ProcessFile(path, service.DefaultImportOptions())
+	require.Error(t, err)
+
+	progress := uploadService.GetFileProgress("grades.csv")
+	assert.Equal(t, service.StatusError, progress.Status)
+	assert.True(t, strings.HasPrefix(progress.Error, "Failed to save records: "), progress.Error)
+
+	require.Eventually(t, func() bool { return receiver.requests() == 1 }, time.Second, 10*time.Millisecond)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	assert.Equal(t, service.WebhookJobFailed, receiver.payloads[0].Event)
+}
@@ -3,10 +3,10 @@ import { useRef, useState, useEffect } from 'react';
 import axios from 'axios';
 
 function App() {
-  const [files, setFiles] = useState([]);
+  const [files, setFiles] = useState([]); // by key: the job ID, or a placeholder until the upload returns it
   const [uploadedFiles, setUploadedFiles] = useState([]);
   const [showProgress, setShowProgress] = useState(false);
-  const [progress, setProgress] = useState({});
+  const [progress, setProgress] = useState({}); // by file key
   const [totalProgress, setTotalProgress] = useState({
     upload: 0,
     processing: 0
@@ -23,7 +23,8 @@ function App() {
   const [gradeMaxFilter, setGradeMaxFilter] = useState('');
   const [error, setError] = useState(null);
   const fileInputRef = useRef();
-  const eventSourceRef = useRef(null);
+  const eventSourcesRef = useRef({}); // progress streams by upload batch ID
+  const uploadCountRef = useRef(0); // numbers uploads, for the placeholder keys of their files
 
   const handleFileInputClick = () => {
     fileInputRef.current.click();
@@ -37,76 +38,136 @@ function App() {
     return `${(sizeInBytes / (1024 * 1024 * 1024)).toFixed(2)} GB`;
   };
 
-  // Initialize SSE connection
-  useEffect(() => {
-    if (files.length > 0 && !eventSourceRef.current) {
-      console.log('Establishing SSE connection...');
-      
-      eventSourceRef.current = new EventSource('http://localhost:8080/progress/sse');
-      
-      eventSourceRef.current.onmessage = (event) => {
-        console.log('SSE message received:', event.data);
-        
-        try {
-          const data = JSON.parse(event.data);
-          
-          // Calculate processing percentage based on Processed/TotalRecords
-          const processingPercentage = Math.round(
-            (data.Processed / data.TotalRecords) * 100
-          );
+  // Follow the progress of one upload batch. The stream is limited to the
+  // batch's jobs, so uploads by other users do not show up here.
+  const subscribeToBatch = (batchId) => {
+    if (eventSourcesRef.current[batchId]) return;
+    console.log('Establishing SSE connection for batch', batchId);
 
-          setProgress(prevProgress => {
-            const newProgress = {
-              ...prevProgress,
-              [data.FileName]: {
-                uploadProgress: prevProgress[data.FileName]?.uploadProgress || 100,
-                processingProgress: processingPercentage
-              }
-            };
-
-            // Update total progress
-            setTotalProgress(calculateTotalProgress(newProgress));
+    const eventSource = new EventSource(
+      `http://localhost:8080/progress/sse?batch=${encodeURIComponent(batchId)}`
+    );
+    eventSourcesRef.current[batchId] = eventSource;
 
-            return newProgress;
-          });
+    const close = () => {
+      eventSource.close();
+      delete eventSourcesRef.current[batchId];
+    };
 
-          // Handle completed processing
-          if (processingPercentage === 100) {
-            setFiles(prevFiles => 
-              prevFiles.map(file => 
-                file.name === data.FileName ? { ...file, completed: true } : file
-              )
-            );
-            setUploadedFiles(prevUploaded => [
-              ...prevUploaded,
-              { 
-                name: data.FileName, 
-                size: formatFileSize(files.find(f => f.name === data.FileName)?.size || 0) 
-              }
-            ]);
-          }
-        } catch (error) {
-          console.error('Error processing SSE message:', error);
+    // Job events are matched to files by job ID, since several files of a
+    // batch, or of an archive, can have the same name
+
+    const handleProgressEvent = (event) => {
+      console.log('SSE event received:', event.type, event.data);
+
+      try {
+        const data = JSON.parse(event.data);
+
+        const processingPercentage = Math.round(data.percentage);
+
+        setProgress(prevProgress => {
+          const newProgress = {
+            ...prevProgress,
+            [data.job_id]: {
+              uploadProgress: prevProgress[data.job_id]?.uploadProgress || 100,
+              processingProgress: processingPercentage
+            }
+          };
+
+          // Update total progress
+          setTotalProgress(calculateTotalProgress(newProgress));
+
+          return newProgress;
+        });
+
+        // Handle completed processing; a file without rows completes at 0%
+        if (event.type === 'job.completed') {
+          setFiles(prevFiles =>
+            prevFiles.map(file =>
+              file.key === data.job_id ? { ...file, completed: true } : file
+            )
+          );
+          setUploadedFiles(prevUploaded => [
+            ...prevUploaded,
+            {
+              key: data.job_id,
+              name: data.file_name,
+              size: formatFileSize(files.find(f => f.key === data.job_id)?.size || 0)
+            }
+          ]);
         }
-      };
+      } catch (error) {
+        console.error('Error processing SSE event:', error);
+      }
+    };
+    ['job.queued', 'job.progress', 'job.completed'].forEach(type =>
+      eventSource.addEventListener(type, handleProgressEvent)
+    );
+
+    // A failed or cancelled job stops short of 100%, so it is marked by its event type
+    const handleJobStoppedEvent = (event) => {
+      try {
+        const data = JSON.parse(event.data);
+        const outcome = event.type === 'job.failed' ? 'failed' : 'cancelled';
+        setFiles(prevFiles =>
+          prevFiles.map(file =>
+            file.key === data.job_id ? { ...file, outcome, error: data.error } : file
+          )
+        );
+      } catch (error) {
+        console.error('Error processing SSE event:', error);
+      }
+    };
+    ['job.failed', 'job.cancelled'].forEach(type =>
+      eventSource.addEventListener(type, handleJobStoppedEvent)
+    );
 
-      eventSourceRef.current.onerror = (error) => {
-        console.error('SSE Error:', error);
-        if (eventSourceRef.current) {
-          eventSourceRef.current.close();
-          eventSourceRef.current = null;
+    // The server aggregates each upload batch, so its percentage is the overall one
+    const handleBatchEvent = (event) => {
+      try {
+        const data = JSON.parse(event.data);
+        setTotalProgress(prevTotal => ({
+          ...prevTotal,
+          processing: Math.round(data.percentage)
+        }));
+        if (event.type === 'batch.failed') {
+          setError(data.error || 'Some files failed to import.');
         }
-      };
-    }
+        // Every job of the batch has finished
+        if (event.type !== 'batch.uploading' && event.type !== 'batch.progress') {
+          close();
+        }
+      } catch (error) {
+        console.error('Error processing SSE event:', error);
+      }
+    };
+    ['batch.uploading', 'batch.progress', 'batch.completed', 'batch.failed', 'batch.cancelled'].forEach(type =>
+      eventSource.addEventListener(type, handleBatchEvent)
+    );
 
+    eventSource.addEventListener('stream.end', close);
+
+    // The browser reconnects by itself and sends Last-Event-ID, so the events
+    // missed meanwhile are replayed. It only gives up when the server refuses,
+    // such as with the 204 sent once the batch has finished.
+    eventSource.onerror = (error) => {
+      console.error('SSE Error:', error);
+      if (eventSource.readyState === EventSource.CLOSED) {
+        delete eventSourcesRef.current[batchId];
+      }
+    };
+  };
+
+  // Close the progress streams when the page goes away
+  useEffect(() => {
+    const eventSources = eventSourcesRef.current;
     return () => {
-      if (eventSourceRef.current) {
+      Object.values(eventSources).forEach(eventSource => {
         console.log('Closing SSE connection');
-        eventSourceRef.current.close();
-        eventSourceRef.current = null;
-      }
+        eventSource.close();
+      });
     };
-  }, [files]);  
+  }, []);
 
   const calculateTotalProgress = (progressData) => {
     const activeFiles = Object.keys(progressData);
@@ -146,24 +207,28 @@ function App() {
 
     setShowProgress(true);
 
+    // Until the server assigns job IDs the files are keyed by their position in this upload
+    const uploadNumber = ++uploadCountRef.current;
+    const uploadKeys = selectedFiles.map((file, index) => `upload-${uploadNumber}-${index}`);
+
     const newProgress = { ...progress };
-    selectedFiles.forEach(file => {
-      newProgress[file.name] = { uploadProgress: 0, processingProgress: 0 };
+    uploadKeys.forEach(key => {
+      newProgress[key] = { uploadProgress: 0, processingProgress: 0 };
     });
     setProgress(newProgress);
     setTotalProgress(calculateTotalProgress(newProgress));
 
     const formData = new FormData();
-    selectedFiles.forEach((file) => {
+    selectedFiles.forEach((file, index) => {
       formData.append('files', file);
       setFiles((prevFiles) => [
         ...prevFiles,
-        { name: file.name, size: file.size, completed: false }
+        { key: uploadKeys[index], name: file.name, size: file.size, completed: false }
       ]);
     });
 
     try {
-      await axios.post('http://localhost:8080/upload', formData, {
+      const response = await axios.post('http://localhost:8080/upload', formData, {
         headers: { 'Content-Type': 'multipart/form-data' },
         onUploadProgress: (progressEvent) => {
           const percentCompleted = Math.round(
@@ -172,9 +237,9 @@ function App() {
           
           setProgress(prevProgress => {
             const newProgress = { ...prevProgress };
-            selectedFiles.forEach(file => {
-              newProgress[file.name] = {
-                ...newProgress[file.name],
+            uploadKeys.forEach(key => {
+              newProgress[key] = {
+                ...newProgress[key],
                 uploadProgress: percentCompleted
               };
             });
@@ -185,13 +250,27 @@ function App() {
         },
       });
 
-      // Set upload progress to 100% after successful upload
+      // Replace the placeholders with the jobs, uploaded in full. An archive
+      // becomes one job per file in it.
+      const jobs = response.data.jobs;
+      setFiles(prevFiles => [
+        ...prevFiles.filter(file => !uploadKeys.includes(file.key)),
+        ...jobs.map(job => ({
+          key: job.jobId,
+          name: job.parentFile ? `${job.parentFile}/${job.fileName}` : job.fileName,
+          size: job.parentFile ? 0 : selectedFiles.find(file => file.name === job.fileName)?.size || 0,
+          completed: false
+        }))
+      ]);
       setProgress(prevProgress => {
         const newProgress = { ...prevProgress };
-        selectedFiles.forEach(file => {
-          newProgress[file.name] = {
-            ...newProgress[file.name],
-            uploadProgress: 100
+        uploadKeys.forEach(key => {
+          delete newProgress[key];
+        });
+        jobs.forEach(job => {
+          newProgress[job.jobId] = {
+            uploadProgress: 100,
+            processingProgress: newProgress[job.jobId]?.processingProgress || 0
           };
         });
         
@@ -199,19 +278,20 @@ function App() {
         return newProgress;
       });
 
+      subscribeToBatch(response.data.batchId);
     } catch (error) {
       console.error('Error uploading files:', error);
       setError('Failed to upload files. Please try again.');
       
       // Clean up failed uploads
       setFiles(prevFiles => 
-        prevFiles.filter(f => !selectedFiles.some(sf => sf.name === f.name))
+        prevFiles.filter(f => !uploadKeys.includes(f.key))
       );
       
       setProgress(prevProgress => {
         const newProgress = { ...prevProgress };
-        selectedFiles.forEach(file => {
-          delete newProgress[file.name];
+        uploadKeys.forEach(key => {
+          delete newProgress[key];
         });
         setTotalProgress(calculateTotalProgress(newProgress));
         return newProgress;
@@ -305,25 +385,29 @@ function App() {
 
           <h3>Individual File Progress</h3>
           {files.map((file) => (
-            <div key={file.name} className={`file-progress ${file.completed ? 'completed' : ''}`}>
-              <p>{file.name} - {formatFileSize(file.size)} {file.completed && "(Completed)"}</p>
+            <div key={file.key} className={`file-progress ${file.completed ? 'completed' : ''} ${file.outcome || ''}`}>
+              <p>
+                {file.name} - {formatFileSize(file.size)} {file.completed && "(Completed)"}
+                {file.outcome === 'failed' && `(Failed${file.error ? `: ${file.error}` : ''})`}
+                {file.outcome === 'cancelled' && "(Cancelled)"}
+              </p>
               
               <div className="progress-bar-container">
                 <label>Upload Progress:</label>
                 <progress 
-                  value={progress[file.name]?.uploadProgress || 0} 
+                  value={progress[file.key]?.uploadProgress || 0} 
                   max="100"
                 ></progress>
-                <span>{progress[file.name]?.uploadProgress || 0}%</span>
+                <span>{progress[file.key]?.uploadProgress || 0}%</span>
               </div>
 
               <div className="progress-bar-container">
                 <label>Processing Progress:</label>
                 <progress 
-                  value={progress[file.name]?.processingProgress || 0} 
+                  value={progress[file.key]?.processingProgress || 0} 
                   max="100"
                 ></progress>
-                <span>{progress[file.name]?.processingProgress || 0}%</span>
+                <span>{progress[file.key]?.processingProgress || 0}%</span>
               </div>
             </div>
           ))}